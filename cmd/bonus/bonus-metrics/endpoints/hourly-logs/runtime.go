@@ -7,17 +7,37 @@ import (
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-)
 
-// cmd mongodb-specific flags
-var (
-	mgoAddress    string
-	mgoDatabase   string
-	mgoCollection string
+	"github.com/glendc/data-ingestion-challenge/pkg"
 )
 
-func newRuntime() (*runtime, error) {
-	session, err := mgo.Dial(mgoAddress)
+// Config is used to configure the mongo instance
+// the hourly logs are aggregated from
+type Config struct {
+	Address    string
+	Database   string
+	Collection string
+}
+
+// DefaultConfig creates a mongo config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{
+		Address:    "localhost:27017",
+		Database:   "events",
+		Collection: "hourly",
+	}
+}
+
+// RegisterFlags binds the properties of this config to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Address, "mgo-address", cfg.Address, "mongo instance address")
+	fs.StringVar(&cfg.Database, "mgo-db", cfg.Database, "mongo database")
+	fs.StringVar(&cfg.Collection, "mgo-collection", cfg.Collection, "mongo db collection")
+}
+
+func newRuntime(cfg *Config) (*runtime, error) {
+	session, err := mgo.Dial(cfg.Address)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open mongo session: %q", err)
 	}
@@ -28,24 +48,33 @@ func newRuntime() (*runtime, error) {
 	}
 
 	return &runtime{
+		cfg:     cfg,
 		session: session,
 	}, nil
 }
 
 type runtime struct {
+	cfg     *Config
 	session *mgo.Session
 }
 
-// GetPerUserMetrics computed using MongoDB aggregations
+// matchTenant is the first stage of each aggregation,
+// only selecting the hourly logs of the given tenant
+func matchTenant(tenant string) bson.M {
+	return bson.M{"$match": bson.M{pkg.EventTenantID: tenant}}
+}
+
+// GetPerUserMetrics of a tenant computed using MongoDB aggregations
 // live from the specified document (collection)
-func (rt *runtime) GetPerUserMetrics() (interface{}, error) {
+func (rt *runtime) GetPerUserMetrics(tenant string) (interface{}, error) {
 	collection, err := rt.getCollection()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get collection: %q", err)
 	}
 
 	pipe := collection.Pipe([]bson.M{
-		bson.M{ // first and only stage: group all metrics together
+		matchTenant(tenant),
+		bson.M{ // second and last stage: group all metrics together
 			"$group": bson.M{
 				"_id": bson.M{
 					"username": "$username",
@@ -71,16 +100,17 @@ func (rt *runtime) GetPerUserMetrics() (interface{}, error) {
 	return all, nil
 }
 
-// GetTotalMetrics computed using MongoDB aggregations
+// GetTotalMetrics of a tenant computed using MongoDB aggregations
 // live from the specified document (collection)
-func (rt *runtime) GetTotalMetrics() (interface{}, error) {
+func (rt *runtime) GetTotalMetrics(tenant string) (interface{}, error) {
 	collection, err := rt.getCollection()
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get collection: %q", err)
 	}
 
 	pipe := collection.Pipe([]bson.M{
-		bson.M{ // first and only stage: group all metrics together
+		matchTenant(tenant),
+		bson.M{ // second and last stage: group all metrics together
 			"$group": bson.M{
 				"_id":     "$metric",
 				"minimum": bson.M{"$min": "$count"},
@@ -110,35 +140,29 @@ func (rt *runtime) Close() error {
 }
 
 func (rt *runtime) getCollection() (*mgo.Collection, error) {
-	db := rt.session.DB(mgoDatabase)
+	db := rt.session.DB(rt.cfg.Database)
 	if db == nil {
-		return nil, fmt.Errorf("no mongo database could be found for %q", mgoDatabase)
+		return nil, fmt.Errorf("no mongo database could be found for %q", rt.cfg.Database)
 	}
-	collection := db.C(mgoCollection)
+	collection := db.C(rt.cfg.Collection)
 	if collection == nil {
 		return nil, fmt.Errorf("no collection named %q could be found in %q",
-			mgoCollection, mgoDatabase)
+			rt.cfg.Collection, rt.cfg.Database)
 	}
 
 	return collection, nil
 }
 
-// ValidateFlags ensures given flags make sense
-func ValidateFlags() error {
-	if mgoAddress == "" {
+// Validate the Config properties
+func (cfg *Config) Validate() error {
+	if cfg.Address == "" {
 		return errors.New("mongo instance's address not given, while this is required")
 	}
-	if mgoDatabase == "" {
+	if cfg.Database == "" {
 		return errors.New("mongo database's name not given, while this is required")
 	}
-	if mgoCollection == "" {
+	if cfg.Collection == "" {
 		return errors.New("mongodb collection's name not given, while this is required")
 	}
 	return nil
 }
-
-func init() {
-	flag.StringVar(&mgoAddress, "mgo-address", "localhost:27017", "mongo instance address")
-	flag.StringVar(&mgoDatabase, "mgo-db", "events", "mongo database")
-	flag.StringVar(&mgoCollection, "mgo-collection", "hourly", "mongo db collection")
-}
@@ -11,9 +11,10 @@ type service struct {
 	rt *runtime
 }
 
-// NewService creates a new hourly-logs service
-func NewService() (endpoints.Service, error) {
-	rt, err := newRuntime()
+// NewService creates a new hourly-logs service,
+// using the given (validated) config
+func NewService(cfg *Config) (endpoints.Service, error) {
+	rt, err := newRuntime(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -23,8 +24,8 @@ func NewService() (endpoints.Service, error) {
 	}, nil
 }
 
-// Serve the /hourly_logs endpoint
-func (s *service) Serve(path string, w http.ResponseWriter, r *http.Request) bool {
+// Serve the /hourly_logs endpoint, for the given tenant
+func (s *service) Serve(path, tenant string, w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != http.MethodGet { // this service only handles get endpoints
 		http.NotFound(w, r)
 		return false
@@ -32,7 +33,7 @@ func (s *service) Serve(path string, w http.ResponseWriter, r *http.Request) boo
 
 	switch strings.TrimSuffix(path, "/") {
 	case "total":
-		result, err := s.rt.GetTotalMetrics()
+		result, err := s.rt.GetTotalMetrics(tenant)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return false
@@ -40,7 +41,7 @@ func (s *service) Serve(path string, w http.ResponseWriter, r *http.Request) boo
 		return endpoints.WriteJSON(result, w)
 
 	case "per_user":
-		result, err := s.rt.GetPerUserMetrics()
+		result, err := s.rt.GetPerUserMetrics(tenant)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return false
@@ -52,6 +53,16 @@ func (s *service) Serve(path string, w http.ResponseWriter, r *http.Request) boo
 	return false
 }
 
+// Endpoints lists the paths served by this service
+func (s *service) Endpoints() []string {
+	return []string{"total", "per_user"}
+}
+
+// Ping the mongodb session
+func (s *service) Ping() error {
+	return s.rt.session.Ping()
+}
+
 // Close any open mongodb connections
 func (s *service) Close() error {
 	return s.rt.Close()
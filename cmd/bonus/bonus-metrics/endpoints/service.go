@@ -21,8 +21,14 @@ func WriteJSON(data interface{}, w http.ResponseWriter) bool {
 
 // Service defines a simplistic per-endpoint service
 type Service interface {
-	// Serve an endpoint and return if it was successfull
-	Serve(path string, w http.ResponseWriter, r *http.Request) bool
+	// Serve an endpoint and return if it was successfull,
+	// only metrics of the given tenant are to be served
+	Serve(path, tenant string, w http.ResponseWriter, r *http.Request) bool
+	// Endpoints lists the paths served by this service,
+	// used as the routes its requests are tracked by
+	Endpoints() []string
+	// Ping the backing store of the service, used to check its readiness
+	Ping() error
 	// Close any open connections
 	Close() error
 }
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -12,8 +13,14 @@ import (
 
 	"github.com/glendc/data-ingestion-challenge/cmd/bonus/bonus-metrics/endpoints"
 	"github.com/glendc/data-ingestion-challenge/cmd/bonus/bonus-metrics/endpoints/hourly-logs"
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/admin"
+	"github.com/glendc/data-ingestion-challenge/pkg/auth"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
 	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
 )
 
 // Metric-Collector Specific Flags
@@ -21,26 +28,114 @@ import (
 var (
 	port               int
 	responseBufferSize int
+	latencyWindowsList string
+	latencyWindows     []time.Duration
 	requestBufferSize  int
+	authKeysPath       string
+	authMaxSkew        time.Duration
+	authReloadInterval time.Duration
 )
 
+// configs of the packages used by this service, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig        = log.DefaultConfig()
+	adminConfig      = admin.DefaultConfig()
+	shutdownConfig   = shutdown.DefaultConfig()
+	hourlyLogsConfig = hourlylogs.DefaultConfig()
+)
+
+// API keys used to authenticate requests, nil if authentication is disabled
+var apiKeys *auth.Keys
+
+// tenantOf authenticates a request, returning the tenant whose metrics it can query,
+// which is the default tenant in case authentication is disabled
+func tenantOf(r *http.Request) (string, error) {
+	if apiKeys == nil {
+		return pkg.DefaultTenant, nil
+	}
+	// metrics are only queried using GET requests, which have no body to sign
+	key, err := apiKeys.Authenticate(r, nil)
+	if err != nil {
+		return "", err
+	}
+	return key.TenantName(), nil
+}
+
+// serviceHandler creates the handler serving all paths of a service,
+// available under the given path prefix
+func serviceHandler(prefix string, service endpoints.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantOf(r)
+		if err != nil {
+			log.Warningf("request was rejected: %q", err)
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf("%s, %s", auth.SchemeBearer, auth.SchemeHMAC))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		service.Serve(strings.TrimPrefix(r.URL.Path, prefix), tenant, w, r)
+	})
+}
+
 // ensure given flags make sense
 func validateFlags() error {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return err
+	}
 	if port < 0 {
 		return fmt.Errorf(
 			"%d is an invalid port, should be a positive number", port)
 	}
+	var err error
+	if latencyWindows, err = metrics.ParseLatencyWindows(latencyWindowsList); err != nil {
+		return err
+	}
+	if authMaxSkew <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid auth max skew, should be a positive duration", authMaxSkew)
+	}
+	if authReloadInterval <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid auth reload interval, should be a positive duration", authReloadInterval)
+	}
 
 	// if our flags are correct we can check our submodule flags
-	return hourlylogs.ValidateFlags()
+	if err = adminConfig.Validate(); err != nil {
+		return err
+	}
+	if err = shutdownConfig.Validate(); err != nil {
+		return err
+	}
+	return hourlyLogsConfig.Validate()
 }
 
 func main() {
-	flag.Parse() // parse all (non-)specific flags
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
 	err := validateFlags()
 	if err != nil {
 		flag.Usage()
-		log.Errorf("invalid flag: %q", err)
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// load the API keys, reloaded whenever the keys file is modified
+	if authKeysPath != "" {
+		if apiKeys, err = auth.Load(authKeysPath, authMaxSkew); err != nil {
+			log.Fatalf("couldn't load API keys: %q", err)
+		}
+		go apiKeys.Watch(authReloadInterval, shutdown.Signal())
+	} else {
+		log.Warningf("no API keys given, anyone can query the metrics of the default tenant")
 	}
 
 	// create a worker that is used
@@ -48,9 +143,10 @@ func main() {
 	serverMetrics, err := metrics.NewServer(
 		metrics.DefaultServerConfig().
 			WithRequestBufferSize(requestBufferSize).
-			WithResponseBufferSize(responseBufferSize))
+			WithResponseBufferSize(responseBufferSize).
+			WithLatencyWindows(latencyWindows))
 	if err != nil {
-		log.Errorf("couldn't create server metrics: %q", err)
+		log.Fatalf("couldn't create server metrics: %q", err)
 	}
 
 	// expose (publish) any custom expvars we care about
@@ -62,36 +158,68 @@ func main() {
 	// collects all services
 	services := make(map[string]endpoints.Service)
 	// hourly-log endpoint
-	services["hourly_logs"], err = hourlylogs.NewService()
+	services["hourly_logs"], err = hourlylogs.NewService(hourlyLogsConfig)
 	if err != nil {
-		log.Errorf("couldn't create hourly_logs metrics service: %q", err)
+		log.Fatalf("couldn't create hourly_logs metrics service: %q", err)
 	}
 	defer services["hourly_logs"].Close()
 
+	// expose all metrics of this service in the Prometheus format,
+	// next to the expvar format (/debug/vars)
+	http.Handle("/metrics", metrics.Handler())
+	// liveness (/healthz) and readiness (/readyz) endpoints
+	health.Handle(http.DefaultServeMux, adminConfig.Health)
+	// serve the admin endpoints (e.g. to change the log level) in the background
+	if err = admin.Serve(adminConfig, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start admin listener: %q", err)
+	}
+
 	for path, service := range services {
+		health.Register(path, service.Ping)
 		path = fmt.Sprintf("/metrics/%s/", path)
 		log.Infof("Creating handler for %s", path)
-		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-			start := time.Now()
-			p := strings.TrimPrefix(r.URL.Path, path)
-			success := service.Serve(p, w, r)
-			serverMetrics.Request(r, start, success)
-		})
+		handler := serviceHandler(path, service)
+		// every request is tracked by the server metrics,
+		// per route, method and status code
+		for _, endpoint := range service.Endpoints() {
+			http.Handle(path+endpoint, serverMetrics.Middleware(path+endpoint, handler))
+		}
+		// any other path of the service is tracked as a single route
+		http.Handle(path, serverMetrics.Middleware(path+"*", handler))
 	}
 
 	log.Infof("Bonus Metrics Service listening to port %d", port)
-	uri := fmt.Sprintf(":%d", port)
-	if err := http.ListenAndServe(uri, http.DefaultServeMux); err != nil {
-		log.Errorf("couldn't start bonus metrics service: %q", err)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: http.DefaultServeMux,
+	}
+	// serve until SIGINT/SIGTERM, finishing in-flight requests
+	// before the services are closed
+	if err := shutdown.ListenAndServe(server, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start bonus metrics service: %q", err)
 	}
 }
 
 func init() {
-	// register metric-collector specific flag(s)
+	// register the flags of the packages used by this service
+	logConfig.RegisterFlags(flag.CommandLine)
+	adminConfig.RegisterFlags(flag.CommandLine)
+	shutdownConfig.RegisterFlags(flag.CommandLine)
+	hourlyLogsConfig.RegisterFlags(flag.CommandLine)
+
+	// register bonus-metrics specific flag(s)
 	flag.IntVar(&port, "port", 3000,
 		"port the bonus metrics service will listen to")
 	flag.IntVar(&responseBufferSize, "resp-buffer", 256,
 		"amount of responseTimes to cache, used to compute the avg resp time")
 	flag.IntVar(&requestBufferSize, "req-buffer", 1024,
-		"amount of requests that can wait in line to be tracked before the server is blocked")
+		"amount of requests that can wait in line to be tracked, requests are dropped from the metrics once it is full")
+	flag.StringVar(&latencyWindowsList, "latency-windows", "1m,5m,15m",
+		"comma-separated rolling windows over which latency percentiles and request rates are reported")
+	flag.StringVar(&authKeysPath, "auth-keys", "",
+		"JSON file containing the API keys required to query metrics (authentication is disabled if not given)")
+	flag.DurationVar(&authMaxSkew, "auth-max-skew", time.Minute*5,
+		"how far the timestamp of a signed request is allowed to be in the past or future")
+	flag.DurationVar(&authReloadInterval, "auth-reload-interval", time.Second*10,
+		"interval on which the API keys file is reloaded, in case it was modified")
 }
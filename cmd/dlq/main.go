@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+)
+
+// cmd dlq-specific flags
+// see: init function for more information about each flag
+var (
+	queue string
+	limit int
+	all   bool
+	edit  bool
+	force bool
+)
+
+// configs of the packages used by this tool, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig       = log.DefaultConfig()
+	amqpConfig      = rpc.DefaultConfig()
+	eventSchemaPath string
+)
+
+// commands supported by this tool
+const (
+	commandList   = "list"
+	commandShow   = "show"
+	commandReplay = "replay"
+)
+
+// maximum length of an error, as listed
+const maxListedErrorLength = 60
+
+// usage of this tool, printed prior to the flags
+const usage = `Usage: dlq [flags] <command> [message...]
+
+Inspects and replays the dead letters of a consumer queue (e.g. accountName).
+Messages are selected by their message ID, or their index as listed.
+
+Commands:
+  list      list the dead letters, and the reason they were rejected
+  show      show the headers and body of the selected (or all) dead letters
+  replay    replay the selected (or all, using -all) dead letters directly to the queue
+            that rejected them (not to the exchange), after editing their body (using -edit)
+
+Flags:
+`
+
+// ensure given flags make sense,
+// validating the command unless only the config is printed
+func validateFlags(printConfig bool) error {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return err
+	}
+	if queue == "" {
+		return errors.New("queue not given, while this is required")
+	}
+	if limit < 1 {
+		return fmt.Errorf("%d is an invalid limit, should be at least 1", limit)
+	}
+	if printConfig {
+		return amqpConfig.Validate()
+	}
+
+	switch flag.Arg(0) {
+	case commandList, commandShow:
+	case commandReplay:
+		if !all && flag.NArg() < 2 {
+			return errors.New("no messages given to replay, use -all to replay all of them")
+		}
+	case "":
+		return errors.New("no command given")
+	default:
+		return fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+	return amqpConfig.Validate()
+}
+
+// selectLetters returns the dead letters identified by the given message IDs or indices,
+// or all of them in case none are given
+func selectLetters(letters []*rpc.DeadLetter, ids []string) ([]*rpc.DeadLetter, error) {
+	if len(ids) == 0 {
+		return letters, nil
+	}
+
+	var selected []*rpc.DeadLetter
+	for _, id := range ids {
+		letter := findLetter(letters, id)
+		if letter == nil {
+			return nil, fmt.Errorf("no dead letter found for %q (within the first %d)", id, limit)
+		}
+		selected = append(selected, letter)
+	}
+	return selected, nil
+}
+
+// findLetter finds a dead letter by its message ID, or by its index
+func findLetter(letters []*rpc.DeadLetter, id string) *rpc.DeadLetter {
+	for _, letter := range letters {
+		if letter.MessageID != "" && letter.MessageID == id {
+			return letter
+		}
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(id, "#"))
+	if err != nil || index < 1 || index > len(letters) {
+		return nil
+	}
+	return letters[index-1]
+}
+
+// list the dead letters as a table
+func list(letters []*rpc.DeadLetter) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tMESSAGE ID\tQUEUE\tREASON\tREJECTED AT\tERROR")
+	for _, letter := range letters {
+		e := letter.Error
+		if len(e) > maxListedErrorLength {
+			e = e[:maxListedErrorLength-3] + "..."
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", letter.Index, orNone(letter.MessageID),
+			orNone(letter.Queue), orNone(letter.Reason), formatTime(letter.RejectedAt), e)
+	}
+	w.Flush()
+}
+
+// show the properties, headers and body of a dead letter
+func show(letter *rpc.DeadLetter) {
+	fmt.Printf("#%d\n", letter.Index)
+	fmt.Printf("message id:   %s\n", orNone(letter.MessageID))
+	fmt.Printf("queue:        %s\n", orNone(letter.Queue))
+	fmt.Printf("reason:       %s\n", orNone(letter.Reason))
+	fmt.Printf("error:        %s\n", orNone(letter.Error))
+	fmt.Printf("rejected at:  %s\n", formatTime(letter.RejectedAt))
+	fmt.Printf("exchange:     %s\n", orNone(letter.Exchange))
+	fmt.Printf("routing key:  %s\n", orNone(letter.RoutingKey))
+	fmt.Printf("content type: %s\n", orNone(letter.ContentType))
+
+	keys := make([]string, 0, len(letter.Headers))
+	for key := range letter.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Println("headers:")
+	for _, key := range keys {
+		fmt.Printf("  %s: %v\n", key, letter.Headers[key])
+	}
+
+	fmt.Println("body:")
+	fmt.Println(readableBody(letter))
+	fmt.Println()
+}
+
+// readableBody returns the body of a dead letter as (indented) JSON if possible,
+// decoding it using the codec of its content type if it isn't JSON,
+// or as a quoted string otherwise
+func readableBody(letter *rpc.DeadLetter) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, letter.Body, "", "  "); err == nil {
+		return buf.String()
+	}
+	if codec, err := rpc.CodecFor(letter.ContentType); err == nil {
+		var event pkg.Event
+		if err = codec.Unmarshal(letter.Body, &event); err == nil {
+			if data, err := json.MarshalIndent(&event, "", "  "); err == nil {
+				return string(data)
+			}
+		}
+	}
+	return strconv.Quote(string(letter.Body))
+}
+
+// editBody lets the user edit the (readable) body of a dead letter using $EDITOR,
+// after which it is replayed as JSON. Returns false if the edited body is empty.
+func editBody(letter *rpc.DeadLetter) (bool, error) {
+	file, err := ioutil.TempFile("", "dlq-")
+	if err != nil {
+		return false, fmt.Errorf("couldn't create temporary file: %q", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(readableBody(letter) + "\n")
+	file.Close()
+	if err != nil {
+		return false, fmt.Errorf("couldn't write temporary file: %q", err)
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command(editor, file.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Run(); err != nil {
+		return false, fmt.Errorf("couldn't run editor %q: %q", editor, err)
+	}
+
+	body, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return false, fmt.Errorf("couldn't read edited file: %q", err)
+	}
+	if body = bytes.TrimSpace(body); len(body) == 0 {
+		return false, nil
+	}
+	letter.Body = body
+	letter.ContentType = rpc.ContentTypeJSON
+	return true, nil
+}
+
+// validateLetter ensures a dead letter can be consumed, prior to replaying it,
+// such that it isn't dead-lettered again right away
+func validateLetter(letter *rpc.DeadLetter) error {
+	codec, err := rpc.CodecFor(letter.ContentType)
+	if err != nil {
+		return err
+	}
+	var event pkg.Event
+	if err = codec.Unmarshal(letter.Body, &event); err != nil {
+		return err
+	}
+	return event.Validate()
+}
+
+// replay the given dead letters, one by one,
+// returning the amount of dead letters replayed
+func replay(dl *rpc.DeadLetters, letters []*rpc.DeadLetter) (int, error) {
+	var replayed int
+	for _, letter := range letters {
+		if edit {
+			ok, err := editBody(letter)
+			if err != nil {
+				return replayed, err
+			}
+			if !ok {
+				log.Warningf("skipped #%d, as its edited body is empty", letter.Index)
+				continue
+			}
+		}
+
+		if err := validateLetter(letter); err != nil {
+			if !force {
+				log.Warningf("skipped #%d, as it would be rejected again (use -force to replay it anyway): %q",
+					letter.Index, err)
+				continue
+			}
+			log.Warningf("replaying #%d, while it is invalid: %q", letter.Index, err)
+		}
+
+		if err := dl.Replay(letter); err != nil {
+			return replayed, fmt.Errorf("couldn't replay #%d: %q", letter.Index, err)
+		}
+		replayed++
+		log.Infof("replayed #%d (%s)", letter.Index, orNone(letter.MessageID))
+	}
+	return replayed, nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
+	err := validateFlags(loader.PrintRequested())
+	if err != nil {
+		flag.Usage()
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// load the schema used to validate replayed events
+	if err = pkg.LoadEventSchema(eventSchemaPath); err != nil {
+		log.Fatalf("couldn't load event schema: %q", err)
+	}
+
+	dl, err := rpc.OpenDeadLetters(amqpConfig, queue)
+	if err != nil {
+		log.Fatalf("couldn't open dead letters: %q", err)
+	}
+	// dead letters that weren't replayed are returned to the queue
+	defer dl.Close()
+
+	letters, err := dl.Fetch(limit)
+	if err != nil {
+		log.Fatalf("couldn't fetch dead letters: %q", err)
+	}
+	if len(letters) == 0 {
+		log.Infof("no dead letters in %s", dl.Queue())
+		return
+	}
+
+	selected, err := selectLetters(letters, flag.Args()[1:])
+	if err != nil {
+		log.Fatalf("couldn't select dead letters: %q", err)
+	}
+
+	switch flag.Arg(0) {
+	case commandList:
+		list(selected)
+	case commandShow:
+		for _, letter := range selected {
+			show(letter)
+		}
+	case commandReplay:
+		replayed, err := replay(dl, selected)
+		log.Infof("replayed %d of %d dead letters directly to the queue that rejected them (%s)",
+			replayed, len(selected), queue)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+}
+
+func init() {
+	// register the flags of the packages used by this tool
+	logConfig.RegisterFlags(flag.CommandLine)
+	amqpConfig.RegisterFlags(flag.CommandLine)
+	pkg.RegisterEventSchemaFlag(flag.CommandLine, &eventSchemaPath)
+
+	// register dlq specific flag(s)
+	flag.StringVar(&queue, "queue", "",
+		"consumer queue whose dead letters are inspected (e.g. accountName, distinctName or hourlyLog)")
+	flag.IntVar(&limit, "limit", 1000,
+		"maximum amount of dead letters fetched, the oldest ones first")
+	flag.BoolVar(&all, "all", false,
+		"replay all (fetched) dead letters, rather than the given ones")
+	flag.BoolVar(&edit, "edit", false,
+		"edit the body of each dead letter using $EDITOR before replaying it (as JSON)")
+	flag.BoolVar(&force, "force", false,
+		"replay dead letters even though they're invalid, and thus would be rejected again")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/auth"
+)
+
+// API keys used to authenticate requests, nil if authentication is disabled
+var apiKeys *auth.Keys
+
+// authenticate a request, returning the API key it was made with,
+// or nil in case authentication is disabled.
+// The body of signed requests is read here already, as it is part of the signature,
+// after which it is made available again for processing.
+func authenticate(r *http.Request) (*auth.Key, error) {
+	if apiKeys == nil {
+		return nil, nil
+	}
+
+	var body []byte
+	if auth.IsSigned(r) {
+		var err error
+		body, err = ioutil.ReadAll(&countingReader{reader: r.Body, limit: maxBodySize})
+		r.Body.Close()
+		if err != nil {
+			return nil, readError(err, "couldn't read body")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	key, err := apiKeys.Authenticate(r, body)
+	if err != nil {
+		return nil, newRejection(http.StatusUnauthorized, reasonUnauthorized, err)
+	}
+	return key, nil
+}
+
+// authorize an event, ensuring that the API key
+// it was posted with is allowed to post it,
+// and assigning the event to the tenant of that key.
+// The tenant is never taken from the event itself,
+// events posted without authentication belong to the default tenant.
+func authorize(key *auth.Key, event *pkg.Event) error {
+	if key == nil {
+		tenant := pkg.DefaultTenant
+		event.Tenant = &tenant
+		return nil
+	}
+	// properties can be optional in a custom event schema
+	var username, metric string
+	if event.Username != nil {
+		username = *event.Username
+	}
+	if event.Metric != nil {
+		metric = *event.Metric
+	}
+	if err := key.Allows(username, metric); err != nil {
+		return newRejection(http.StatusForbidden, reasonForbidden, err)
+	}
+	tenant := key.TenantName()
+	event.Tenant = &tenant
+	return nil
+}
+
+// wwwAuthenticate is the challenge send along with a 401 response
+var wwwAuthenticate = fmt.Sprintf("%s, %s", auth.SchemeBearer, auth.SchemeHMAC)
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/auth"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/ratelimit"
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+	"github.com/glendc/data-ingestion-challenge/pkg/trace"
+)
+
+// Content types accepted by the /events endpoint
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// Status of a single item within a batch
+const (
+	batchItemAccepted = "accepted"
+	batchItemRejected = "rejected"
+)
+
+// batchResult is the per-item result document returned by the /events endpoint
+type batchResult struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+
+	// amount of items limited by the bucket of their username,
+	// and the result of the most restrictive username bucket
+	rateLimited int
+	limit       *ratelimit.Result
+}
+
+// batchItemResult is the result of a single item within a batch,
+// the index refers to the position of the item within the batch
+type batchItemResult struct {
+	Index      int                `json:"index"`
+	ID         string             `json:"id,omitempty"`
+	Status     string             `json:"status"`
+	Spooled    bool               `json:"spooled,omitempty"`
+	Reason     string             `json:"reason,omitempty"`
+	Violations []schema.Violation `json:"violations,omitempty"`
+	// seconds to wait before retrying an item that was rate limited
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// processBatchRequest splits the body of a batch request into raw items,
+// either as a JSON array or as newline-delimited JSON.
+// Items are only split here, decoding happens on a per-item basis,
+// so that a single invalid item doesn't fail the entire batch.
+func processBatchRequest(r *http.Request) ([][]byte, error) {
+	log.Debugf("processing batch of events")
+
+	// validate content type
+	ct := r.Header.Get("Content-Type")
+	if ct != contentTypeJSON && ct != contentTypeNDJSON {
+		return nil, newRejection(http.StatusUnsupportedMediaType, reasonContentType,
+			fmt.Errorf("invalid content-type %q, expected %s or %s",
+				ct, contentTypeJSON, contentTypeNDJSON))
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var items [][]byte
+	// a JSON array is expected to be the only value in the body,
+	// anything else is treated as newline-delimited JSON
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var rawItems []json.RawMessage
+		if err = json.Unmarshal(trimmed, &rawItems); err != nil {
+			return nil, fmt.Errorf("couldn't decode batch: %q", err)
+		}
+		for _, item := range rawItems {
+			items = append(items, item)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		// allow lines as big as the entire body
+		scanner.Buffer(make([]byte, 0, 4096), len(body)+1)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue // blank lines are allowed and ignored
+			}
+			items = append(items, append([]byte(nil), line...))
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("couldn't split batch: %q", err)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("batch doesn't contain any events")
+	}
+	if len(items) > maxBatchSize {
+		return nil, newRejection(http.StatusRequestEntityTooLarge, reasonBatchTooLarge,
+			fmt.Errorf("batch can contain at most %d events", maxBatchSize))
+	}
+
+	return items, nil
+}
+
+// dispatchBatch decodes each item of a batch separately,
+// and dispatches all valid items at once, collecting the result of each item.
+// The event IDs are derived from the given idempotency key, if one was given,
+// and each event has to be allowed by the given API key (if authentication is enabled).
+// Decoding each item and dispatching all events are traced as children of the span of the given context.
+func dispatchBatch(ctx context.Context, dispatcher *dispatcher, apiKey *auth.Key, key string, items [][]byte) *batchResult {
+	result := &batchResult{
+		Results: make([]batchItemResult, len(items)),
+	}
+
+	var (
+		events  []*pkg.Event
+		indices []int // index of each decoded event within the batch
+	)
+	for index, item := range items {
+		result.Results[index].Index = index
+
+		id, err := eventID(key, index)
+		if err != nil {
+			result.reject(index, err)
+			continue
+		}
+		_, decodeSpan := trace.Start(ctx, "decode")
+		decodeSpan.SetAttribute("index", index)
+		event, err := decodeEvent(id, item)
+		decodeSpan.Finish(err)
+		if err != nil {
+			result.reject(index, err)
+			continue
+		}
+		if err = authorize(apiKey, event); err != nil {
+			result.reject(index, err)
+			continue
+		}
+		limit, err := limitEvent(event)
+		result.limit = mostRestrictive(result.limit, limit)
+		if err != nil {
+			if limit != nil && !limit.Allowed {
+				result.rateLimited++
+				result.Results[index].RetryAfter = ceilSeconds(limit.RetryAfter)
+			}
+			result.reject(index, err)
+			continue
+		}
+		result.Results[index].ID = id
+		events = append(events, event)
+		indices = append(indices, index)
+	}
+
+	dispatchCtx, dispatchSpan := trace.Start(ctx, "dispatch")
+	dispatchSpan.SetAttribute("events", len(events))
+	dispatchResults := dispatcher.DispatchAll(dispatchCtx, events)
+	dispatchSpan.Finish(nil)
+
+	for i, dispatched := range dispatchResults {
+		index := indices[i]
+		if dispatched.err != nil {
+			result.Results[index].ID = ""
+			result.reject(index, dispatched.err)
+			continue
+		}
+		result.Results[index].Spooled = dispatched.spooled
+		result.Results[index].Status = batchItemAccepted
+		result.Accepted++
+	}
+
+	return result
+}
+
+// reject the item at the given index for the given reason,
+// counting the rejection like any other rejected event
+func (result *batchResult) reject(index int, reason error) {
+	rej := rejectionOf(reason)
+	rej.count()
+	log.Warningf("batch item %d was rejected (%s): %q", index, rej.reason, rej.err)
+	result.Results[index].Status = batchItemRejected
+	result.Results[index].Reason = rej.Error()
+	result.Results[index].Violations = rej.violations()
+	result.Rejected++
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// amount of decompressed bytes that are always allowed,
+// prior to enforcing the maximum compression ratio,
+// as small bodies tend to have unrepresentative compression ratios
+const minRatioCheckSize = 64 * 1024
+
+// errors returned by a guardedReader
+var (
+	errBodyTooLarge    = errors.New("body is too large")
+	errDecodedTooLarge = errors.New("decompressed body is too large")
+	errCompressionBomb = errors.New("body exceeds the maximum compression ratio")
+)
+
+// readBody reads the entire body of a request, decompressing it if required.
+// The compressed and decompressed sizes are limited by the
+// max-body-size and max-decoded-size flags, both resulting in a 413 rejection.
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+
+	if r.ContentLength > maxBodySize {
+		return nil, newRejection(http.StatusRequestEntityTooLarge, reasonBodyTooLarge,
+			fmt.Errorf("body can be at most %d bytes", maxBodySize))
+	}
+
+	compressed := &countingReader{reader: r.Body, limit: maxBodySize}
+	var reader io.Reader = compressed
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		// body is not compressed
+
+	case "gzip":
+		gzipReader, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, readError(err, "couldn't decompress gzip body")
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+
+	case "deflate":
+		deflateReader, err := newDeflateReader(compressed)
+		if err != nil {
+			return nil, readError(err, "couldn't decompress deflate body")
+		}
+		defer deflateReader.Close()
+		reader = deflateReader
+
+	default:
+		return nil, newRejection(http.StatusUnsupportedMediaType, reasonContentEncoding,
+			fmt.Errorf("unsupported content-encoding %q, expected gzip or deflate", encoding))
+	}
+
+	body, err := ioutil.ReadAll(&guardedReader{
+		reader:     reader,
+		compressed: compressed,
+		enforce:    reader != compressed,
+	})
+	if err != nil {
+		return nil, readError(err, "couldn't read body")
+	}
+	return body, nil
+}
+
+// readError turns an error that happened while reading a body into a rejection
+func readError(err error, context string) error {
+	switch err {
+	case errBodyTooLarge:
+		return newRejection(http.StatusRequestEntityTooLarge, reasonBodyTooLarge,
+			fmt.Errorf("body can be at most %d bytes", maxBodySize))
+	case errDecodedTooLarge:
+		return newRejection(http.StatusRequestEntityTooLarge, reasonDecodedTooLarge,
+			fmt.Errorf("decompressed body can be at most %d bytes", maxDecodedSize))
+	case errCompressionBomb:
+		return newRejection(http.StatusRequestEntityTooLarge, reasonDecompression,
+			fmt.Errorf("body can be compressed with a ratio of at most %d", maxCompressionRatio))
+	}
+	return newRejection(http.StatusBadRequest, reasonDecode, fmt.Errorf("%s: %q", context, err))
+}
+
+// newDeflateReader creates a reader for a deflate encoded body.
+// HTTP defines deflate as zlib wrapped data, while some clients send raw deflate data,
+// so the zlib header is checked for in order to support both.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib header: compression method 8 (deflate) and a valid header checksum
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// countingReader counts the bytes read from the underlying reader,
+// failing as soon as more bytes than the limit are read
+type countingReader struct {
+	reader io.Reader
+	limit  int64
+	n      int64
+}
+
+// Read implements io.Reader
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	if r.n > r.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// guardedReader limits the amount of decompressed bytes read,
+// and guards against decompression bombs by enforcing a maximum compression ratio
+type guardedReader struct {
+	reader     io.Reader
+	compressed *countingReader
+	enforce    bool // only enforce the compression ratio for compressed bodies
+	n          int64
+}
+
+// Read implements io.Reader
+func (r *guardedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	if r.n > maxDecodedSize {
+		return n, errDecodedTooLarge
+	}
+	if r.enforce && r.n > minRatioCheckSize &&
+		r.n > r.compressed.n*int64(maxCompressionRatio) {
+		return n, errCompressionBomb
+	}
+	return n, err
+}
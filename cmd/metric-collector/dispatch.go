@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/spool"
+)
+
+// dispatcher dispatches events using the RPC producer,
+// falling back to a local disk spool when the producer fails (if enabled)
+type dispatcher struct {
+	producer rpc.Producer
+	spool    *spool.Spool // nil if spooling is disabled
+}
+
+// dispatchResult is the result of dispatching a single event,
+// spooled is true in case the event will only be dispatched once the spool is drained
+type dispatchResult struct {
+	spooled bool
+	err     error
+}
+
+// Dispatch an event, returning true in case the event was spooled,
+// meaning it will only be dispatched to the exchange once the spool is drained
+func (d *dispatcher) Dispatch(ctx context.Context, event *pkg.Event) (bool, error) {
+	result := d.DispatchAll(ctx, []*pkg.Event{event})[0]
+	return result.spooled, result.err
+}
+
+// DispatchAll dispatches multiple events, returning the result of each event.
+// In case the producer supports it, all events are dispatched before waiting
+// on any confirmation, such that they are confirmed by the broker in batches.
+// The trace of the span carried by the given context is propagated with each event.
+func (d *dispatcher) DispatchAll(ctx context.Context, events []*pkg.Event) []dispatchResult {
+	results := make([]dispatchResult, len(events))
+
+	// as long as spooled events are pending, new events are spooled as well,
+	// such that events reach the exchange in the order they were received
+	if d.spool != nil && d.spool.Pending() > 0 {
+		for index, event := range events {
+			results[index] = d.spoolEvent(event)
+		}
+		return results
+	}
+
+	for index, err := range d.dispatchAll(ctx, events) {
+		if err == nil {
+			continue
+		}
+		if d.spool == nil {
+			results[index].err = dispatchRejection(err)
+			continue
+		}
+		log.Warningf("couldn't dispatch event, spooling it instead: %q", err)
+		results[index] = d.spoolEvent(events[index])
+	}
+	return results
+}
+
+// dispatchAll dispatches all events using the producer,
+// returning the error (if any) of each event
+func (d *dispatcher) dispatchAll(ctx context.Context, events []*pkg.Event) []error {
+	errs := make([]error, len(events))
+
+	producer, ok := d.producer.(rpc.AsyncProducer)
+	if !ok {
+		for index, event := range events {
+			errs[index] = d.producer.Dispatch(ctx, event)
+		}
+		return errs
+	}
+
+	futures := make([]*rpc.Future, len(events))
+	for index, event := range events {
+		futures[index] = producer.DispatchAsync(ctx, event)
+	}
+	for index, future := range futures {
+		errs[index] = future.Wait()
+	}
+	return errs
+}
+
+// dispatchRejection returns the rejection for an event that couldn't be dispatched
+func dispatchRejection(err error) *rejection {
+	switch err {
+	case rpc.ErrNacked:
+		return newRejection(http.StatusServiceUnavailable, reasonNacked, err)
+	case rpc.ErrDispatchTimeout:
+		return newRejection(http.StatusGatewayTimeout, reasonConfirmTimeout, err)
+	case rpc.ErrNotConnected:
+		return newRejection(http.StatusServiceUnavailable, reasonDispatch, err)
+	}
+	return newRejection(http.StatusInternalServerError, reasonDispatch, err)
+}
+
+// spoolEvent appends an event to the spool
+func (d *dispatcher) spoolEvent(event *pkg.Event) dispatchResult {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return dispatchResult{err: newRejection(http.StatusInternalServerError, reasonInternal, err)}
+	}
+	if err = d.spool.Append(data); err != nil {
+		if err == spool.ErrFull {
+			return dispatchResult{err: newRejection(http.StatusServiceUnavailable, reasonSpoolFull,
+				fmt.Errorf("couldn't dispatch event and the spool is full"))}
+		}
+		return dispatchResult{err: newRejection(http.StatusInternalServerError, reasonDispatch,
+			fmt.Errorf("couldn't spool event: %q", err))}
+	}
+	return dispatchResult{spooled: true}
+}
+
+// drain a spooled event back to the exchange,
+// used as the callback of spool.Drain. The trace of a spooled event isn't kept,
+// hence its dispatch starts a new trace.
+func (d *dispatcher) drain(data []byte) error {
+	var event pkg.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		// retrying won't help, so the event is dropped
+		log.Warningf("dropping invalid spooled event: %q", err)
+		return nil
+	}
+	return d.producer.Dispatch(context.Background(), &event)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// header clients can use to supply their own event ID,
+// such that retried requests are only processed once
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// header used to return the ID of an accepted event to the client
+const eventIDHeader = "X-Event-ID"
+
+// maximum length of a client-supplied idempotency key
+const maxIdempotencyKeyLength = 128
+
+// separates the idempotency key of a batch and the index of an event within it,
+// not allowed within keys, such that the ID of an event in a batch
+// can never equal the ID of a single event
+const batchIndexSeparator = ':'
+
+// idempotencyKey returns the client-supplied idempotency key,
+// an empty string is returned in case no key was given
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", newRejection(http.StatusBadRequest, reasonIdempotencyKey,
+			fmt.Errorf("%s header is too long, can be at most %d characters",
+				idempotencyKeyHeader, maxIdempotencyKeyLength))
+	}
+	for _, c := range key {
+		if c < '!' || c > '~' {
+			return "", newRejection(http.StatusBadRequest, reasonIdempotencyKey,
+				fmt.Errorf("%s header can only contain printable ASCII characters",
+					idempotencyKeyHeader))
+		}
+		if c == batchIndexSeparator {
+			return "", newRejection(http.StatusBadRequest, reasonIdempotencyKey,
+				fmt.Errorf("%s header can't contain %q", idempotencyKeyHeader, batchIndexSeparator))
+		}
+	}
+	return key, nil
+}
+
+// eventID returns the ID for an event, derived from the idempotency key,
+// or a newly generated ID in case no key was given.
+// Events within a batch get the index appended to the key, as each event requires its own ID.
+func eventID(key string, index int) (string, error) {
+	if key == "" {
+		return newEventID()
+	}
+	if index < 0 {
+		return key, nil
+	}
+	return fmt.Sprintf("%s%c%d", key, batchIndexSeparator, index), nil
+}
+
+// newEventID generates a new random 128-bit event ID
+func newEventID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", newRejection(http.StatusInternalServerError, reasonInternal,
+			fmt.Errorf("couldn't generate event ID: %q", err))
+	}
+	return hex.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	testCases := []struct {
+		key   string
+		valid bool
+	}{
+		{"", true},
+		{"4f7c0a2e", true},
+		{"retry-1_of/3!", true},
+		{strings.Repeat("k", maxIdempotencyKeyLength), true},
+		{strings.Repeat("k", maxIdempotencyKeyLength+1), false},
+		{"abc def", false},
+		{"abc\x7f", false},
+		{"abcé", false},
+		// would collide with the IDs of events within a batch
+		{"abc:0", false},
+		{":", false},
+	}
+	for _, tc := range testCases {
+		r, _ := http.NewRequest("POST", "http://localhost:3000/event", nil)
+		r.Header.Set(idempotencyKeyHeader, tc.key)
+		key, err := idempotencyKey(r)
+		if !tc.valid {
+			if _, ok := err.(*rejection); !ok {
+				t.Errorf("%q: expected a rejection, got %v", tc.key, err)
+			}
+			continue
+		}
+		if err != nil || key != tc.key {
+			t.Errorf("%q: expected the key to be returned, got %q (%v)", tc.key, key, err)
+		}
+	}
+}
+
+func TestEventID(t *testing.T) {
+	testCases := []struct {
+		key      string
+		index    int
+		expected string
+	}{
+		{"abc", -1, "abc"},
+		{"abc", 0, "abc:0"},
+		{"abc", 12, "abc:12"},
+	}
+	for _, tc := range testCases {
+		if id, err := eventID(tc.key, tc.index); err != nil || id != tc.expected {
+			t.Errorf("%q #%d: expected ID %q, got %q (%v)", tc.key, tc.index, tc.expected, id, err)
+		}
+	}
+
+	// IDs are generated when no key is given
+	first, err := eventID("", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := eventID("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 || first == second {
+		t.Errorf("expected unique 128-bit hex IDs, got %q and %q", first, second)
+	}
+}
@@ -1,77 +1,362 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"expvar"
 	_ "expvar"
 
 	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/admin"
+	"github.com/glendc/data-ingestion-challenge/pkg/auth"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
 	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
+	"github.com/glendc/data-ingestion-challenge/pkg/ratelimit"
 	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+	"github.com/glendc/data-ingestion-challenge/pkg/spool"
+	"github.com/glendc/data-ingestion-challenge/pkg/trace"
 )
 
 // Metric-Collector Specific Flags
 // see: init function for more information about each flag
 var (
-	port               int
-	responseBufferSize int
-	requestBufferSize  int
+	port                int
+	responseBufferSize  int
+	latencyWindowsList  string
+	latencyWindows      []time.Duration
+	requestBufferSize   int
+	maxBatchSize        int
+	maxPastSkew         time.Duration
+	maxFutureSkew       time.Duration
+	clampTimestamps     bool
+	maxBodySize         int64
+	maxDecodedSize      int64
+	maxCompressionRatio int
+	spoolDir            string
+	spoolMaxSize        int64
+	spoolSegmentSize    int64
+	spoolDrainRate      int
+	producerPoolSize    int
+	producerConnections int
+	authKeysPath        string
+	authMaxSkew         time.Duration
+	authReloadInterval  time.Duration
+
+	rateLimitsPath         string
+	rateLimitRedisAddress  string
+	rateLimitRedisPassword string
+	rateLimitRedisDB       int
+)
+
+// configs of the packages used by this service, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig       = log.DefaultConfig()
+	amqpConfig      = rpc.DefaultConfig()
+	adminConfig     = admin.DefaultConfig()
+	traceConfig     = trace.DefaultConfig()
+	shutdownConfig  = shutdown.DefaultConfig()
+	eventSchemaPath string
 )
 
 // rawEvent is the structure we expect as incoming data of this Metric-Collector
 type rawEvent struct {
-	Username string `json:"username"`
-	Metric   string `json:"metric"`
-	Count    int64  `json:"count"`
+	Username  string          `json:"username"`
+	Metric    string          `json:"metric"`
+	Count     int64           `json:"count"`
+	Timestamp json.RawMessage `json:"timestamp"` // optional
 }
 
 func processRequest(r *http.Request) (*pkg.Event, error) {
-	log.Infof("processing and validating event")
+	log.Debugf("processing and validating event")
+
+	// validate content type, all content types supported by rpc codecs are accepted
+	ct := r.Header.Get("Content-Type")
+	codec, err := rpc.CodecFor(ct)
+	if err != nil {
+		return nil, newRejection(http.StatusUnsupportedMediaType, reasonContentType,
+			fmt.Errorf("invalid content-type %q, expected one of %v", ct, rpc.ContentTypes()))
+	}
+
+	key, err := idempotencyKey(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := eventID(key, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec.ContentType() == rpc.ContentTypeJSON {
+		return decodeEvent(id, body)
+	}
+	return decodeEncodedEvent(id, codec, body)
+}
+
+// startRequestSpan starts the span of a request, continuing the trace of its traceparent header (if any),
+// which is returned as a response header as well, such that clients can look up the trace
+func startRequestSpan(w http.ResponseWriter, r *http.Request, name string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(trace.Extract(r.Context(), r.Header.Get(trace.Header)), name)
+	w.Header().Set(trace.Header, span.Context().Traceparent())
+	return ctx, span
+}
+
+// validateEventSize ensures an event isn't bigger than allowed by the event schema
+func validateEventSize(body []byte) error {
+	maxSize := pkg.EventSchema().MaxBodySize
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return newRejection(http.StatusRequestEntityTooLarge, reasonBodyTooLarge,
+			&schema.ValidationError{
+				Violations: []schema.Violation{{
+					Rule:    schema.RuleMaxBodySize,
+					Message: fmt.Sprintf("event can be at most %d bytes", maxSize),
+				}},
+			})
+	}
+	return nil
+}
 
-	// validate content type
-	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
-		return nil, fmt.Errorf("invalid content-type %q, expected application/json", ct)
+// decodeEvent validates a JSON serialized raw event against the event schema,
+// and decodes it as a complete event if it is valid
+func decodeEvent(id string, body []byte) (*pkg.Event, error) {
+	if err := validateEventSize(body); err != nil {
+		return nil, err
+	}
+
+	// validate properties of event, prior to decoding them
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var fields interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonDecode,
+			fmt.Errorf("couldn't decode event: %q", err))
+	}
+	if err := pkg.EventSchema().ValidateInput(fields); err != nil {
+		return nil, err
 	}
 
-	// validate types of given properties
-	defer r.Body.Close()
-	decoder := json.NewDecoder(r.Body)
 	var event rawEvent
-	if err := decoder.Decode(&event); err != nil {
-		return nil, fmt.Errorf("couldn't decode event: %q", err)
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonDecode,
+			fmt.Errorf("couldn't decode event: %q", err))
 	}
 
-	timestamp := time.Now().UTC().Unix()
+	ev, err := newEvent(id, &event)
+	if err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonTimestamp, err)
+	}
+	return ev, nil
+}
+
+// decodeEncodedEvent decodes a raw event encoded using any other rpc codec,
+// validating its properties against the event schema, as it would for a JSON event
+func decodeEncodedEvent(id string, codec rpc.Codec, body []byte) (*pkg.Event, error) {
+	if err := validateEventSize(body); err != nil {
+		return nil, err
+	}
+
+	// validate properties of event, including unknown ones, prior to decoding them,
+	// codecs unable to decode properties as is can only have their known properties validated
+	var decoded pkg.Event
+	var fields map[string]interface{}
+	var err error
+	if unmarshaler, ok := codec.(rpc.FieldsUnmarshaler); ok {
+		fields, err = unmarshaler.UnmarshalFields(body)
+	} else if err = codec.Unmarshal(body, &decoded); err == nil {
+		fields = decoded.Fields()
+	}
+	if err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonDecode,
+			fmt.Errorf("couldn't decode event: %q", err))
+	}
+	if err := pkg.EventSchema().ValidateInput(fields); err != nil {
+		return nil, err
+	}
+	if err := decoded.SetFields(fields); err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonDecode,
+			fmt.Errorf("couldn't decode event: %q", err))
+	}
+
+	var event rawEvent
+	if decoded.Username != nil {
+		event.Username = *decoded.Username
+	}
+	if decoded.Metric != nil {
+		event.Metric = *decoded.Metric
+	}
+	if decoded.Count != nil {
+		event.Count = *decoded.Count
+	}
+	if decoded.Timestamp != nil {
+		event.Timestamp = json.RawMessage(strconv.FormatInt(*decoded.Timestamp, 10))
+	}
+
+	ev, err := newEvent(id, &event)
+	if err != nil {
+		return nil, newRejection(http.StatusBadRequest, reasonTimestamp, err)
+	}
+	return ev, nil
+}
+
+// newEvent creates a complete event from a decoded raw event,
+// the timestamp defaults to the time the event was received,
+// in case the client didn't supply one itself
+func newEvent(id string, event *rawEvent) (*pkg.Event, error) {
+	now := time.Now().UTC()
+	receivedAt := now.Unix()
+
+	clientTime, ok, err := parseTimestamp(event.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if now, err = checkTimestampSkew(clientTime, now); err != nil {
+			return nil, err
+		}
+	}
+	timestamp := now.Unix()
+
 	return &pkg.Event{
-		Username:  &event.Username, // required
-		Metric:    &event.Metric,   // required
-		Count:     &event.Count,    // required
-		Timestamp: &timestamp,      // required
+		ID:         &id,
+		Username:   &event.Username, // required
+		Metric:     &event.Metric,   // required
+		Count:      &event.Count,    // required
+		Timestamp:  &timestamp,      // required
+		ReceivedAt: &receivedAt,
 	}, nil
 }
 
 // ensure given flags make sense
 func validateFlags() error {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return err
+	}
 	if port < 0 {
 		return fmt.Errorf(
 			"%d is an invalid port, should be a positive number", port)
 	}
+	var err error
+	if latencyWindows, err = metrics.ParseLatencyWindows(latencyWindowsList); err != nil {
+		return err
+	}
+	if maxBatchSize < 1 {
+		return fmt.Errorf(
+			"%d is an invalid max batch size, should be at least 1", maxBatchSize)
+	}
+	if maxPastSkew < 0 {
+		return fmt.Errorf(
+			"%v is an invalid max past skew, should be a positive duration", maxPastSkew)
+	}
+	if maxFutureSkew < 0 {
+		return fmt.Errorf(
+			"%v is an invalid max future skew, should be a positive duration", maxFutureSkew)
+	}
+	if maxBodySize < 1 {
+		return fmt.Errorf(
+			"%d is an invalid max body size, should be at least 1", maxBodySize)
+	}
+	if maxDecodedSize < 1 {
+		return fmt.Errorf(
+			"%d is an invalid max decoded size, should be at least 1", maxDecodedSize)
+	}
+	if maxCompressionRatio < 1 {
+		return fmt.Errorf(
+			"%d is an invalid max compression ratio, should be at least 1", maxCompressionRatio)
+	}
+	if producerPoolSize < 1 {
+		return fmt.Errorf(
+			"%d is an invalid producer pool size, should be at least 1", producerPoolSize)
+	}
+	if authMaxSkew <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid auth max skew, should be a positive duration", authMaxSkew)
+	}
+	if authReloadInterval <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid auth reload interval, should be a positive duration", authReloadInterval)
+	}
+	if producerConnections < 1 || producerConnections > producerPoolSize {
+		return fmt.Errorf(
+			"%d is an invalid amount of producer connections, should be in the range [1, %d]",
+			producerConnections, producerPoolSize)
+	}
 
-	return nil
+	if err = adminConfig.Validate(); err != nil {
+		return err
+	}
+	if err = traceConfig.Validate(); err != nil {
+		return err
+	}
+	if err = shutdownConfig.Validate(); err != nil {
+		return err
+	}
+	return amqpConfig.Validate()
 }
 
 func main() {
-	flag.Parse() // parse all (non-)specific flags
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
 	err := validateFlags()
 	if err != nil {
 		flag.Usage()
-		log.Errorf("invalid flag: %q", err)
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// export the spans of traced requests (if configured)
+	if err = trace.Open(traceConfig); err != nil {
+		log.Fatalf("couldn't open trace exporter: %q", err)
+	}
+	defer trace.Close()
+
+	// load the schema used to validate incoming events
+	if err = pkg.LoadEventSchema(eventSchemaPath); err != nil {
+		log.Fatalf("couldn't load event schema: %q", err)
+	}
+
+	// load the API keys, reloaded whenever the keys file is modified
+	if authKeysPath != "" {
+		if apiKeys, err = auth.Load(authKeysPath, authMaxSkew); err != nil {
+			log.Fatalf("couldn't load API keys: %q", err)
+		}
+		go apiKeys.Watch(authReloadInterval, shutdown.Signal())
+	} else {
+		log.Warningf("no API keys given, anyone can post events")
+	}
+
+	// load the rate limits, enforced per API key, username and client IP
+	if rateLimitsPath != "" {
+		if rateLimits, err = ratelimit.LoadConfig(rateLimitsPath); err != nil {
+			log.Fatalf("couldn't load rate limits: %q", err)
+		}
+		if limiter, err = newLimiter(); err != nil {
+			log.Fatalf("couldn't create rate limiter: %q", err)
+		}
 	}
 
 	// create a worker that is used
@@ -79,9 +364,10 @@ func main() {
 	serverMetrics, err := metrics.NewServer(
 		metrics.DefaultServerConfig().
 			WithRequestBufferSize(requestBufferSize).
-			WithResponseBufferSize(responseBufferSize))
+			WithResponseBufferSize(responseBufferSize).
+			WithLatencyWindows(latencyWindows))
 	if err != nil {
-		log.Errorf("couldn't create server metrics: %q", err)
+		log.Fatalf("couldn't create server metrics: %q", err)
 	}
 
 	// expose (publish) any custom expvars we care about
@@ -90,51 +376,238 @@ func main() {
 	// spawn coroutine this metrics worker can use to wait and listen
 	go serverMetrics.ListenAndCompute()
 
-	// create RPC producer, used to dispatch our events to
-	producer, err := rpc.NewAMQPProducer()
+	// create RPC producer pool, used to dispatch our events to,
+	// such that concurrent requests can dispatch their events concurrently
+	producer, err := rpc.NewAMQPProducerPool(amqpConfig, producerPoolSize, producerConnections)
 	if err != nil {
-		log.Errorf("couldn't create amqp producer: %q", err)
+		log.Fatalf("couldn't create amqp producer pool: %q", err)
 	}
 	defer producer.Close()
+	expvar.Publish("producerPool", producer)
+	health.Register("amqp", producer.Ping)
 
-	http.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+	// optional local disk spool, used when the producer fails to dispatch events
+	dispatcher := &dispatcher{producer: producer}
+	if spoolDir != "" {
+		dispatcher.spool, err = spool.Open(
+			spool.DefaultConfig(spoolDir).
+				WithMaxSize(spoolMaxSize).
+				WithSegmentSize(spoolSegmentSize).
+				WithDrainRate(spoolDrainRate))
+		if err != nil {
+			log.Fatalf("couldn't open spool: %q", err)
+		}
+		defer dispatcher.spool.Close()
+
+		expvar.Publish("spool", dispatcher.spool)
+		// spawn coroutine draining spooled events back to the exchange
+		go dispatcher.spool.Drain(dispatcher.drain)
+	}
+
+	// expose all metrics in the Prometheus format,
+	// next to the expvar format (/debug/vars)
+	http.Handle("/metrics", metrics.Handler())
+	// liveness (/healthz) and readiness (/readyz) endpoints
+	health.Handle(http.DefaultServeMux, adminConfig.Health)
+	// serve the admin endpoints (e.g. to change the log level) in the background
+	if err = admin.Serve(adminConfig, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start admin listener: %q", err)
+	}
+
+	// every request is tracked by the server metrics,
+	// per route, method and status code
+	http.Handle("/event", serverMetrics.Middleware("/event", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request continues the trace of the client (if any),
+		// which is propagated to the workers along with the event
+		ctx, span := startRequestSpan(w, r, "collector.event")
+		var err error
+		defer func() { span.Finish(err) }()
 
 		if r.Method != http.MethodPost {
+			rejections.Add(reasonMethod, 1)
 			http.NotFound(w, r)
-			serverMetrics.Request(r, start, false)
 			return
 		}
 
+		apiKey, err := authenticate(r)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		limit, err := limitRequest(r, apiKey, 1)
+		setRateLimitHeaders(w, limit)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		_, decodeSpan := trace.Start(ctx, "decode")
 		event, err := processRequest(r)
+		decodeSpan.Finish(err)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		if err = authorize(apiKey, event); err != nil {
+			reject(w, err)
+			return
+		}
+
+		eventLimit, err := limitEvent(event)
+		setRateLimitHeaders(w, mostRestrictive(limit, eventLimit))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			serverMetrics.Request(r, start, false)
+			// the event isn't dispatched, hence it doesn't count towards the limit of the request
+			refundRequest(r, apiKey, 1)
+			reject(w, err)
 			return
 		}
 
-		if err = producer.Dispatch(event); err != nil {
+		span.SetAttribute("event.id", *event.ID)
+		dispatchCtx, dispatchSpan := trace.Start(ctx, "dispatch")
+		spooled, err := dispatcher.Dispatch(dispatchCtx, event)
+		dispatchSpan.SetAttribute("spooled", spooled)
+		dispatchSpan.Finish(err)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		w.Header().Set(eventIDHeader, *event.ID)
+		if spooled {
+			// event is accepted, but only dispatched once the spool is drained
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})))
+
+	http.Handle("/events", serverMetrics.Middleware("/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// tracked as a batch, even if it fails before its items are known
+		metrics.SetBatchSize(w, 0)
+
+		ctx, span := startRequestSpan(w, r, "collector.events")
+		var err error
+		defer func() { span.Finish(err) }()
+
+		if r.Method != http.MethodPost {
+			rejections.Add(reasonMethod, 1)
+			http.NotFound(w, r)
+			return
+		}
+
+		apiKey, err := authenticate(r)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		key, err := idempotencyKey(r)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		items, err := processBatchRequest(r)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+		metrics.SetBatchSize(w, len(items))
+
+		// every event of the batch counts towards the rate limit
+		limit, err := limitRequest(r, apiKey, len(items))
+		setRateLimitHeaders(w, limit)
+		if err != nil {
+			reject(w, err)
+			return
+		}
+
+		// every item gets dispatched on its own,
+		// such that a single invalid item doesn't fail the entire batch
+		result := dispatchBatch(ctx, dispatcher, apiKey, key, items)
+		// events limited by their username don't count towards the limit of the request,
+		// while the headers list the most restrictive limit of the request and its events
+		refundRequest(r, apiKey, result.rateLimited)
+		setRateLimitHeaders(w, mostRestrictive(limit, result.limit))
+		bytes, err := json.Marshal(result)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			serverMetrics.Request(r, start, false)
 			return
 		}
 
-		serverMetrics.Request(r, start, true)
-	})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytes)
+	})))
 
 	log.Infof("Metric Collector Service listening to port %d", port)
-	uri := fmt.Sprintf(":%d", port)
-	if err := http.ListenAndServe(uri, http.DefaultServeMux); err != nil {
-		log.Errorf("couldn't start metric collector service: %q", err)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: http.DefaultServeMux,
+	}
+	// serve until SIGINT/SIGTERM, finishing in-flight requests
+	// before the spool and producer are closed
+	if err := shutdown.ListenAndServe(server, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start metric collector service: %q", err)
 	}
 }
 
 func init() {
+	// register the flags of the packages used by this service
+	logConfig.RegisterFlags(flag.CommandLine)
+	amqpConfig.RegisterFlags(flag.CommandLine)
+	adminConfig.RegisterFlags(flag.CommandLine)
+	traceConfig.RegisterFlags(flag.CommandLine)
+	shutdownConfig.RegisterFlags(flag.CommandLine)
+	pkg.RegisterEventSchemaFlag(flag.CommandLine, &eventSchemaPath)
+
 	// register metric-collector specific flag(s)
 	flag.IntVar(&port, "port", 3000,
 		"port the metric collector service will listen to")
 	flag.IntVar(&responseBufferSize, "resp-buffer", 256,
 		"amount of responseTimes to cache, used to compute the avg resp time")
 	flag.IntVar(&requestBufferSize, "req-buffer", 1024,
-		"amount of requests that can wait in line to be tracked before the server is blocked")
+		"amount of requests that can wait in line to be tracked, requests are dropped from the metrics once it is full")
+	flag.StringVar(&latencyWindowsList, "latency-windows", "1m,5m,15m",
+		"comma-separated rolling windows over which latency percentiles and request rates are reported")
+	flag.IntVar(&maxBatchSize, "max-batch", 1000,
+		"maximum amount of events that can be send in a single batch to /events")
+	flag.DurationVar(&maxPastSkew, "max-past-skew", time.Hour*24*7,
+		"how far in the past a client-supplied timestamp is allowed to be")
+	flag.DurationVar(&maxFutureSkew, "max-future-skew", time.Minute*5,
+		"how far in the future a client-supplied timestamp is allowed to be")
+	flag.BoolVar(&clampTimestamps, "clamp-timestamps", false,
+		"clamp client-supplied timestamps outside of the skew window, instead of rejecting them")
+	flag.Int64Var(&maxBodySize, "max-body-size", 1<<20,
+		"maximum size (in bytes) of a (compressed) request body")
+	flag.Int64Var(&maxDecodedSize, "max-decoded-size", 8<<20,
+		"maximum size (in bytes) of a decompressed request body")
+	flag.IntVar(&maxCompressionRatio, "max-compression-ratio", 100,
+		"maximum compression ratio of a compressed request body, guarding against decompression bombs")
+	flag.StringVar(&spoolDir, "spool-dir", "",
+		"directory used to spool events when they can't be dispatched (disabled if not given)")
+	flag.Int64Var(&spoolMaxSize, "spool-max-size", 1<<30,
+		"maximum size (in bytes) of the spool, events are refused with a 503 once it is full")
+	flag.Int64Var(&spoolSegmentSize, "spool-segment-size", 16<<20,
+		"size (in bytes) of a single spool segment")
+	flag.IntVar(&spoolDrainRate, "spool-drain-rate", 1000,
+		"maximum amount of spooled events dispatched per second, once the exchange is reachable again")
+	flag.IntVar(&producerPoolSize, "producer-pool-size", 8,
+		"amount of AMQP channels used to dispatch events concurrently")
+	flag.IntVar(&producerConnections, "producer-connections", 1,
+		"amount of AMQP connections the channels of the producer pool are spread over")
+	flag.StringVar(&authKeysPath, "auth-keys", "",
+		"JSON file containing the API keys required to post events (authentication is disabled if not given)")
+	flag.DurationVar(&authMaxSkew, "auth-max-skew", time.Minute*5,
+		"how far the timestamp of a signed request is allowed to be in the past or future")
+	flag.DurationVar(&authReloadInterval, "auth-reload-interval", time.Second*10,
+		"interval on which the API keys file is reloaded, in case it was modified")
+	flag.StringVar(&rateLimitsPath, "rate-limits", "",
+		"JSON file containing the rate limits enforced per API key, username or client IP "+
+			"(rate limiting is disabled if not given)")
+	flag.StringVar(&rateLimitRedisAddress, "rate-limit-redis", "",
+		"redis instance address used to share rate limits between collectors (local limits if not given)")
+	flag.StringVar(&rateLimitRedisPassword, "rate-limit-redis-password", "",
+		"password of the redis instance used to share rate limits")
+	flag.IntVar(&rateLimitRedisDB, "rate-limit-redis-db", 0,
+		"db of the redis instance used to share rate limits")
 }
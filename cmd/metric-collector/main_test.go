@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+)
+
+func TestValidateEventSize(t *testing.T) {
+	maxSize := int(pkg.EventSchema().MaxBodySize)
+	if maxSize <= 0 {
+		t.Fatalf("expected the event schema to define a max body size, got %d", maxSize)
+	}
+	if err := validateEventSize(bytes.Repeat([]byte{' '}, maxSize)); err != nil {
+		t.Errorf("unexpected error for an event of %d bytes: %v", maxSize, err)
+	}
+
+	err := validateEventSize(bytes.Repeat([]byte{' '}, maxSize+1))
+	r, ok := err.(*rejection)
+	if !ok {
+		t.Fatalf("expected a rejection for an event of %d bytes, got %v", maxSize+1, err)
+	}
+	if r.status != http.StatusRequestEntityTooLarge || r.reason != reasonBodyTooLarge {
+		t.Errorf("expected a %d %s rejection, got %d %s",
+			http.StatusRequestEntityTooLarge, reasonBodyTooLarge, r.status, r.reason)
+	}
+	verr, ok := r.err.(*schema.ValidationError)
+	if !ok || len(verr.Violations) != 1 || verr.Violations[0].Rule != schema.RuleMaxBodySize {
+		t.Errorf("expected a single %s violation, got %v", schema.RuleMaxBodySize, r.err)
+	}
+}
+
+func TestDecodeEventValidatesSchema(t *testing.T) {
+	if _, err := decodeEvent("id", []byte(`{"username":"kodingbot","metric":"kite_call","count":12}`)); err != nil {
+		t.Errorf("unexpected error for a valid event: %v", err)
+	}
+
+	_, err := decodeEvent("id", []byte(`{}`))
+	verr, ok := err.(*schema.ValidationError)
+	if !ok {
+		t.Fatalf("expected a *schema.ValidationError for an empty event, got %T: %v", err, err)
+	}
+	if len(verr.Violations) != 3 {
+		t.Errorf("expected 3 violations (username, metric and count are required), got %v", verr.Violations)
+	}
+}
+
+func TestDecodeEventRejectsUnknownProperties(t *testing.T) {
+	protobufCodec, err := rpc.CodecFor(rpc.ContentTypeProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, metric, count := "kodingbot", "kite_call", int64(12)
+	protobuf, err := protobufCodec.Marshal(&pkg.Event{Username: &username, Metric: &metric, Count: &count})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decodeEncodedEvent("id", protobufCodec, protobuf); err != nil {
+		t.Errorf("unexpected error for a valid event: %v", err)
+	}
+
+	testCases := []struct {
+		contentType string
+		body        []byte
+		field       string
+	}{
+		{
+			rpc.ContentTypeJSON,
+			[]byte(`{"username":"kodingbot","metric":"kite_call","count":12,"extra":true}`),
+			"extra",
+		},
+		{
+			rpc.ContentTypeMsgpack,
+			append([]byte{0x84,
+				0xa8, 'u', 's', 'e', 'r', 'n', 'a', 'm', 'e', 0xa9, 'k', 'o', 'd', 'i', 'n', 'g', 'b', 'o', 't',
+				0xa6, 'm', 'e', 't', 'r', 'i', 'c', 0xa9, 'k', 'i', 't', 'e', '_', 'c', 'a', 'l', 'l',
+				0xa5, 'c', 'o', 'u', 'n', 't', 0x0c},
+				0xa5, 'e', 'x', 't', 'r', 'a', 0xc3),
+			"extra",
+		},
+		// protobuf doesn't encode the name of a field, so its number is used instead
+		{rpc.ContentTypeProtobuf, append(protobuf, 8<<3, 0x01), "8"},
+	}
+	for _, tc := range testCases {
+		codec, err := rpc.CodecFor(tc.contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decodeErr error
+		if tc.contentType == rpc.ContentTypeJSON {
+			_, decodeErr = decodeEvent("id", tc.body)
+		} else {
+			_, decodeErr = decodeEncodedEvent("id", codec, tc.body)
+		}
+		verr, ok := decodeErr.(*schema.ValidationError)
+		if !ok {
+			t.Errorf("%s: expected a *schema.ValidationError, got %T: %v", tc.contentType, decodeErr, decodeErr)
+			continue
+		}
+		expected := []schema.Violation{{
+			Field:   tc.field,
+			Rule:    schema.RuleAdditionalProperties,
+			Message: "unknown property is not allowed",
+		}}
+		if !reflect.DeepEqual(verr.Violations, expected) {
+			t.Errorf("%s: expected violations %v, got %v", tc.contentType, expected, verr.Violations)
+		}
+	}
+}
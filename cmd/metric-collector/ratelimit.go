@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v5"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/auth"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/ratelimit"
+)
+
+// rate limiting rules and the limiter enforcing them,
+// both nil in case rate limiting is disabled
+var (
+	rateLimits *ratelimit.Config
+	limiter    ratelimit.Limiter
+)
+
+// newLimiter creates the limiter used to enforce the rate limits,
+// keeping its buckets in Redis in case an address is given, in memory otherwise
+func newLimiter() (ratelimit.Limiter, error) {
+	if rateLimitRedisAddress == "" {
+		return ratelimit.NewMemoryLimiter(), nil
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     rateLimitRedisAddress,
+		Password: rateLimitRedisPassword,
+		DB:       rateLimitRedisDB,
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		return nil, fmt.Errorf("couldn't ping redis server: %q", err)
+	}
+	return ratelimit.NewRedisLimiter(client), nil
+}
+
+// rateBucket is the token bucket of a single rule, limiting a single value
+type rateBucket struct {
+	by    string
+	value string
+	key   string
+	limit ratelimit.Limit
+}
+
+// bucketsFor returns the bucket of each rule limiting one of the given values,
+// scoped to the given scope, if any
+func bucketsFor(values map[string]string, scope string) []rateBucket {
+	var buckets []rateBucket
+	for index, rule := range rateLimits.Rules {
+		value, ok := values[rule.By]
+		if !ok {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d:%s", rule.By, index, value)
+		if scope != "" {
+			key = fmt.Sprintf("%s:%d:%s:%s", rule.By, index, scope, value)
+		}
+		buckets = append(buckets, rateBucket{
+			by:    rule.By,
+			value: value,
+			key:   key,
+			limit: rule.LimitFor(value),
+		})
+	}
+	return buckets
+}
+
+// requestBuckets returns the buckets of the API key and client IP of a request
+func requestBuckets(r *http.Request, apiKey *auth.Key) []rateBucket {
+	var values = map[string]string{ratelimit.ByIP: clientIP(r)}
+	if apiKey != nil {
+		values[ratelimit.ByAPIKey] = apiKey.ID
+	}
+	return bucketsFor(values, "")
+}
+
+// limitRequest takes the given amount of tokens (events) from the buckets
+// of the API key and client IP of a request,
+// returning the result of the most restrictive bucket (see setRateLimitHeaders)
+func limitRequest(r *http.Request, apiKey *auth.Key, cost int) (*ratelimit.Result, error) {
+	if rateLimits == nil {
+		return nil, nil
+	}
+	return takeTokens(requestBuckets(r, apiKey), cost)
+}
+
+// refundRequest returns the given amount of tokens to the buckets of a request,
+// for events that were limited by the bucket of their username
+func refundRequest(r *http.Request, apiKey *auth.Key, cost int) {
+	if rateLimits == nil || cost == 0 {
+		return
+	}
+	refundTokens(requestBuckets(r, apiKey), cost)
+}
+
+// limitEvent takes a token from the bucket of the username of an event,
+// usernames are scoped to the tenant of the event, such that tenants don't share buckets
+func limitEvent(event *pkg.Event) (*ratelimit.Result, error) {
+	if rateLimits == nil || event.Username == nil {
+		return nil, nil
+	}
+	return takeTokens(bucketsFor(map[string]string{ratelimit.ByUsername: *event.Username},
+		event.TenantName()), 1)
+}
+
+// takeTokens takes tokens from the given buckets,
+// returning the result of the most restrictive bucket (nil if there are no buckets).
+// Tokens are only taken in case all buckets allow it, as the tokens taken so far
+// are returned once a bucket doesn't, such that one limit doesn't drain the others.
+// Requests are allowed in case the limiter fails, as to not depend on its availability.
+func takeTokens(buckets []rateBucket, cost int) (*ratelimit.Result, error) {
+	// the cost can never be taken at once from a bucket that can't hold it
+	for _, bucket := range buckets {
+		if cost > bucket.limit.Burst {
+			return nil, newRejection(http.StatusRequestEntityTooLarge, reasonBatchTooLarge,
+				fmt.Errorf("batch of %d events exceeds the burst of %d events of the rate limit for %s %q, "+
+					"split it into smaller batches", cost, bucket.limit.Burst, bucket.by, bucket.value))
+		}
+	}
+
+	var restrictive *ratelimit.Result
+	for index, bucket := range buckets {
+		result, err := limiter.Take(bucket.key, bucket.limit, cost)
+		if err != nil {
+			log.Warningf("couldn't take rate limit tokens of %s %q: %q", bucket.by, bucket.value, err)
+			continue
+		}
+		if !result.Allowed {
+			refundTokens(buckets[:index], cost)
+			return &result, newRejection(http.StatusTooManyRequests, reasonRateLimited,
+				fmt.Errorf("rate limit of %v events per second exceeded for %s %q, retry in %v",
+					result.Limit.Rate, bucket.by, bucket.value, result.RetryAfter))
+		}
+		restrictive = mostRestrictive(restrictive, &result)
+	}
+	return restrictive, nil
+}
+
+// refundTokens returns the given amount of tokens to the given buckets
+func refundTokens(buckets []rateBucket, cost int) {
+	for _, bucket := range buckets {
+		if err := limiter.Refund(bucket.key, bucket.limit, cost); err != nil {
+			log.Warningf("couldn't refund rate limit tokens of %s %q: %q", bucket.by, bucket.value, err)
+		}
+	}
+}
+
+// mostRestrictive returns the most restrictive of two results,
+// a result that isn't allowed being more restrictive than one that is
+func mostRestrictive(a, b *ratelimit.Result) *ratelimit.Result {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.Allowed != b.Allowed {
+		if !a.Allowed {
+			return a
+		}
+		return b
+	}
+	if b.Remaining < a.Remaining {
+		return b
+	}
+	return a
+}
+
+// setRateLimitHeaders sets the X-RateLimit-* headers (and Retry-After header if limited)
+// of a response, given the result of its most restrictive bucket
+func setRateLimitHeaders(w http.ResponseWriter, result *ratelimit.Result) {
+	if result == nil {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+// clientIP returns the IP address of the client that made the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds returns a duration in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/ratelimit"
+)
+
+// a rate low enough for buckets not to be refilled while testing
+const testRate = 0.001
+
+// useRateLimits enables rate limiting using the given rules, kept in memory
+func useRateLimits(rules ...*ratelimit.Rule) {
+	rateLimits = &ratelimit.Config{Rules: rules}
+	limiter = ratelimit.NewMemoryLimiter()
+}
+
+// disableRateLimits disables rate limiting, as it is by default
+func disableRateLimits() {
+	rateLimits, limiter = nil, nil
+}
+
+// remaining returns the tokens left in a bucket, without taking any
+func remaining(t *testing.T, bucket rateBucket) int {
+	result, err := limiter.Take(bucket.key, bucket.limit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Remaining
+}
+
+func TestTakeTokens(t *testing.T) {
+	defer disableRateLimits()
+
+	testCases := []struct {
+		name      string
+		cost      int
+		status    int // status of the rejection, if any
+		remaining []int
+	}{
+		{"allowed", 2, 0, []int{8, 3}},
+		{"limited by second bucket", 4, http.StatusTooManyRequests, []int{8, 3}},
+		{"allowed again", 3, 0, []int{5, 0}},
+		{"limited by an empty bucket", 1, http.StatusTooManyRequests, []int{5, 0}},
+		{"exceeds burst", 11, http.StatusRequestEntityTooLarge, []int{5, 0}},
+	}
+
+	useRateLimits(
+		&ratelimit.Rule{By: ratelimit.ByAPIKey, Limit: ratelimit.Limit{Rate: testRate, Burst: 10}},
+		&ratelimit.Rule{By: ratelimit.ByIP, Limit: ratelimit.Limit{Rate: testRate, Burst: 5}},
+	)
+	buckets := bucketsFor(map[string]string{
+		ratelimit.ByAPIKey: "koding",
+		ratelimit.ByIP:     "10.0.0.1",
+	}, "")
+	if len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(buckets))
+	}
+
+	for _, tc := range testCases {
+		result, err := takeTokens(buckets, tc.cost)
+		var status int
+		if err != nil {
+			status = rejectionOf(err).status
+		}
+		if status != tc.status {
+			t.Errorf("%s: expected status %d, got %d (%v)", tc.name, tc.status, status, err)
+		}
+		if tc.status == http.StatusTooManyRequests && (result == nil || result.Allowed || result.RetryAfter <= 0) {
+			t.Errorf("%s: expected a limited result to retry after, got %+v", tc.name, result)
+		}
+		// a limited request doesn't drain the buckets that did allow it
+		for i, bucket := range buckets {
+			if left := remaining(t, bucket); left != tc.remaining[i] {
+				t.Errorf("%s: expected %d tokens left in the %s bucket, got %d",
+					tc.name, tc.remaining[i], bucket.by, left)
+			}
+		}
+	}
+}
+
+func TestBucketsFor(t *testing.T) {
+	defer disableRateLimits()
+
+	useRateLimits(
+		&ratelimit.Rule{By: ratelimit.ByUsername, Limit: ratelimit.Limit{Rate: 1, Burst: 5},
+			Overrides: map[string]ratelimit.Limit{"kodingbot": {Rate: 10, Burst: 50}}},
+		&ratelimit.Rule{By: ratelimit.ByIP, Limit: ratelimit.Limit{Rate: 1, Burst: 5}},
+	)
+
+	testCases := []struct {
+		username, scope string
+		key             string
+		burst           int
+	}{
+		{"glendc", "", "username:0:glendc", 5},
+		{"glendc", "koding", "username:0:koding:glendc", 5},
+		{"kodingbot", "koding", "username:0:koding:kodingbot", 50},
+	}
+	for _, tc := range testCases {
+		buckets := bucketsFor(map[string]string{ratelimit.ByUsername: tc.username}, tc.scope)
+		if len(buckets) != 1 {
+			t.Errorf("%s: expected a single bucket, got %d", tc.username, len(buckets))
+			continue
+		}
+		if buckets[0].key != tc.key || buckets[0].limit.Burst != tc.burst {
+			t.Errorf("%s: expected bucket %s with burst %d, got %s with burst %d",
+				tc.username, tc.key, tc.burst, buckets[0].key, buckets[0].limit.Burst)
+		}
+	}
+}
+
+func TestMostRestrictive(t *testing.T) {
+	allowed := &ratelimit.Result{Allowed: true, Remaining: 5}
+	scarce := &ratelimit.Result{Allowed: true, Remaining: 1}
+	limited := &ratelimit.Result{Allowed: false, Remaining: 3}
+
+	testCases := []struct {
+		a, b, expected *ratelimit.Result
+	}{
+		{nil, nil, nil},
+		{allowed, nil, allowed},
+		{nil, allowed, allowed},
+		{allowed, scarce, scarce},
+		{scarce, allowed, scarce},
+		{scarce, limited, limited},
+		{limited, allowed, limited},
+	}
+	for i, tc := range testCases {
+		if result := mostRestrictive(tc.a, tc.b); result != tc.expected {
+			t.Errorf("case %d: expected %+v, got %+v", i, tc.expected, result)
+		}
+	}
+}
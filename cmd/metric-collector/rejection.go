@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+)
+
+// Reasons a request or event can be rejected for,
+// each reason is counted separately in the rejections expvar
+const (
+	reasonMethod          = "method"
+	reasonUnauthorized    = "unauthorized"
+	reasonForbidden       = "forbidden"
+	reasonRateLimited     = "rate-limited"
+	reasonContentType     = "content-type"
+	reasonContentEncoding = "content-encoding"
+	reasonBodyTooLarge    = "body-too-large"
+	reasonDecodedTooLarge = "decoded-too-large"
+	reasonDecompression   = "decompression-bomb"
+	reasonBatchTooLarge   = "batch-too-large"
+	reasonIdempotencyKey  = "idempotency-key"
+	reasonDecode          = "decode"
+	reasonSchema          = "schema"
+	reasonTimestamp       = "timestamp"
+	reasonDispatch        = "dispatch"
+	reasonNacked          = "nacked"
+	reasonConfirmTimeout  = "confirm-timeout"
+	reasonSpoolFull       = "spool-full"
+	reasonInternal        = "internal"
+)
+
+// rejections counts all rejected requests and events per reason
+var rejections = expvar.NewMap("rejections")
+
+// rejection is an error that rejects a request (or a single event within a batch),
+// defining the status code to respond with and the reason it is counted under
+type rejection struct {
+	status int
+	reason string
+	err    error
+}
+
+// newRejection creates a rejection for the given reason
+func newRejection(status int, reason string, err error) *rejection {
+	return &rejection{
+		status: status,
+		reason: reason,
+		err:    err,
+	}
+}
+
+// Error returns the actual error that caused the rejection
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+// rejectionOf returns the given error as a rejection,
+// errors that aren't a rejection yet are considered to be a bad request
+func rejectionOf(err error) *rejection {
+	switch e := err.(type) {
+	case *rejection:
+		return e
+	case *schema.ValidationError:
+		return newRejection(http.StatusBadRequest, reasonSchema, err)
+	}
+	return newRejection(http.StatusBadRequest, reasonDecode, err)
+}
+
+// count the rejection in the rejections expvar
+func (r *rejection) count() {
+	rejections.Add(r.reason, 1)
+}
+
+// violations returns the violated schema rules, if any
+func (r *rejection) violations() []schema.Violation {
+	if verr, ok := r.err.(*schema.ValidationError); ok {
+		return verr.Violations
+	}
+	return nil
+}
+
+// errorResponse is the structured JSON body used to report rejections,
+// listing each violated rule in case the event was rejected by the event schema
+type errorResponse struct {
+	Error      string             `json:"error"`
+	Reason     string             `json:"reason"`
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+// reject a request, counting the rejection
+// and writing it as a structured JSON body
+func reject(w http.ResponseWriter, err error) {
+	rej := rejectionOf(err)
+	rej.count()
+	log.Warningf("request was rejected (%s): %q", rej.reason, rej.err)
+
+	resp := errorResponse{
+		Error:      rej.Error(),
+		Reason:     rej.reason,
+		Violations: rej.violations(),
+	}
+	if resp.Violations != nil {
+		resp.Error = "event is invalid according to the event schema"
+	}
+
+	bytes, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rej.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", wwwAuthenticate)
+	}
+	w.WriteHeader(rej.status)
+	w.Write(bytes)
+}
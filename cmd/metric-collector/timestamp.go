@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// any numerical timestamp equal to or bigger than this value
+// is interpreted as milliseconds instead of seconds,
+// as in seconds it would be a date in the year 5138,
+// while in milliseconds it means a date in early 1973.
+const millisecondsThreshold = 1e11
+
+// parseTimestamp parses an optional client-supplied timestamp,
+// which can be given in seconds, milliseconds or as an RFC3339 string.
+// The returned boolean is false in case no timestamp was given.
+func parseTimestamp(raw json.RawMessage) (time.Time, bool, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return time.Time{}, false, nil
+	}
+
+	// RFC3339 formatted timestamp
+	if raw[0] == '"' {
+		var str string
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid timestamp: %q", err)
+		}
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf(
+				"invalid timestamp %q, expected RFC3339 format: %q", str, err)
+		}
+		return t.UTC(), true, nil
+	}
+
+	// numerical timestamp in seconds or milliseconds
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err != nil {
+		return time.Time{}, false, fmt.Errorf(
+			"invalid timestamp %s, expected a number or RFC3339 string", raw)
+	}
+	value, err := number.Float64()
+	if err != nil || math.IsInf(value, 0) || value < 0 {
+		return time.Time{}, false, fmt.Errorf(
+			"invalid timestamp %s, expected a positive number", raw)
+	}
+	if value >= millisecondsThreshold {
+		ms := int64(value)
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(), true, nil
+	}
+	sec, frac := math.Modf(value)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), true, nil
+}
+
+// checkTimestampSkew ensures the given timestamp is within the configured
+// past and future skew windows, relative to the time the event was received.
+// Timestamps outside of the window are either rejected or clamped
+// to the closest window boundary, depending on the clamp-timestamps flag.
+func checkTimestampSkew(timestamp, receivedAt time.Time) (time.Time, error) {
+	if lower := receivedAt.Add(-maxPastSkew); timestamp.Before(lower) {
+		if !clampTimestamps {
+			return timestamp, fmt.Errorf(
+				"timestamp %s is more than %v in the past",
+				timestamp.Format(time.RFC3339), maxPastSkew)
+		}
+		return lower, nil
+	}
+	if upper := receivedAt.Add(maxFutureSkew); timestamp.After(upper) {
+		if !clampTimestamps {
+			return timestamp, fmt.Errorf(
+				"timestamp %s is more than %v in the future",
+				timestamp.Format(time.RFC3339), maxFutureSkew)
+		}
+		return upper, nil
+	}
+	return timestamp, nil
+}
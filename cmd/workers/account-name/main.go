@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/admin"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
 	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+	"github.com/glendc/data-ingestion-challenge/pkg/trace"
 
 	_ "github.com/lib/pq"
 )
@@ -17,14 +27,38 @@ import (
 // cmd postgres-specific flags
 // see: init function for more information about each flag
 var (
-	pgAddress  string
-	pgUser     string
-	pgPassword string
-	pgDatabase string
-	pgTable    string
-	pgSSLMode  string
+	pgAddress   string
+	pgUser      string
+	pgPassword  string
+	pgDatabase  string
+	pgTable     string
+	pgSSLMode   string
+	dedupWindow time.Duration
 )
 
+// configs of the packages used by this worker, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig       = log.DefaultConfig()
+	amqpConfig      = rpc.DefaultConfig()
+	adminConfig     = admin.DefaultConfig()
+	traceConfig     = trace.DefaultConfig()
+	shutdownConfig  = shutdown.DefaultConfig()
+	eventSchemaPath string
+)
+
+// runtimeConfig is used to configure the postgres runtime,
+// see validateFlags
+type runtimeConfig struct {
+	address     string
+	user        string
+	password    string
+	database    string
+	table       string
+	sslMode     string
+	dedupWindow time.Duration
+}
+
 // Postgres SSL mode can be one of following
 // More info: https://godoc.org/github.com/lib/pq
 var sslModeEnum = []string{sslModeDisable, "require", "verify-ca", "verify-full"}
@@ -41,14 +75,56 @@ var rexTableName = regexp.MustCompile(reTableName)
 
 // properties used in postgres records
 const (
+	propTenant    = "tenant"
 	propUsername  = "username"
 	propTimestamp = "timestamp"
+	propID        = "id"
+	propProcessed = "processed"
 )
 
+// suffix of the table used to store the IDs of processed events
+const processedTableSuffix = "_processed"
+
+// interval on which processed event IDs older than the dedup window are removed
+const dedupCleanupInterval = time.Hour
+
+// processedTable returns the name of the table used to store the processed event IDs
+// of the given table
+func processedTable(table string) string {
+	return table + processedTableSuffix
+}
+
+// tableQueries returns the queries creating the tables used by this worker.
+// Records are isolated per tenant, using a tenant column that is part of their unique key.
+// Tables created prior to tenants being introduced are migrated,
+// with all their existing records belonging to the default tenant.
+func tableQueries(table string) []string {
+	processed := processedTable(table)
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s text, %s integer);`,
+			table, propUsername, propTimestamp),
+		fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s text NOT NULL DEFAULT '%s';`,
+			table, propTenant, pkg.DefaultTenant),
+		fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS %s_%s_%s_key ON %s (%s, %s);`,
+			table, propTenant, propUsername, table, propTenant, propUsername),
+		fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s_%s_key;`,
+			table, table, propUsername),
+
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s text NOT NULL, %s integer);`,
+			processed, propID, propProcessed),
+		fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s text NOT NULL DEFAULT '%s';`,
+			processed, propTenant, pkg.DefaultTenant),
+		fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS %s_%s_%s_key ON %s (%s, %s);`,
+			processed, propTenant, propID, processed, propTenant, propID),
+		fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s_pkey;`,
+			processed, processed),
+	}
+}
+
 // create a new postgres runtime client
-func newRuntime() (*runtime, error) {
+func newRuntime(cfg *runtimeConfig) (*runtime, error) {
 	uri := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
-		pgUser, pgPassword, pgAddress, pgDatabase, pgSSLMode)
+		cfg.user, cfg.password, cfg.address, cfg.database, cfg.sslMode)
 	db, err := sql.Open("postgres", uri)
 	if err != nil {
 		return nil, err
@@ -58,25 +134,32 @@ func newRuntime() (*runtime, error) {
 		return nil, fmt.Errorf("postgres is not reachable: %q", err)
 	}
 
-	resp, err := db.Query(fmt.Sprintf(
-		`CREATE TABLE IF NOT EXISTS %s (%s text unique, %s integer);`,
-		pgTable, propUsername, propTimestamp))
-	if err != nil {
-		return nil, err
+	for _, query := range tableQueries(cfg.table) {
+		if _, err = db.Exec(query); err != nil {
+			return nil, fmt.Errorf("couldn't prepare tables: %q", err)
+		}
 	}
-	resp.Close()
 
 	return &runtime{
-		db: db,
+		cfg:   cfg,
+		db:    db,
+		store: metrics.NewStore("postgres"),
 	}, nil
 }
 
 type runtime struct {
-	db *sql.DB
+	cfg   *runtimeConfig
+	db    *sql.DB
+	store *metrics.Store
 }
 
-func (rt *runtime) Consume(event *pkg.Event) *rpc.ConsumeError {
+func (rt *runtime) Consume(ctx context.Context, event *pkg.Event) *rpc.ConsumeError {
+	_, span := trace.Start(ctx, "postgres.insert")
+	start := time.Now()
 	inserted, err := rt.record(event)
+	rt.store.Observe("insert", start, err)
+	span.SetAttribute("recorded", inserted)
+	span.Finish(err)
 	if err != nil {
 		// requeue is required as this is a mistake on our part
 		// perhaps another accountName worker can handle this
@@ -85,7 +168,8 @@ func (rt *runtime) Consume(event *pkg.Event) *rpc.ConsumeError {
 	}
 
 	if inserted {
-		log.Infof("recorded first time event for %q", *event.Username)
+		log.Debugf("recorded first time event for %q of tenant %q",
+			*event.Username, event.TenantName())
 	}
 
 	return nil
@@ -96,23 +180,79 @@ func (rt *runtime) Close() error {
 }
 
 // record ftue into Postgres
-// there is only one record inserted per user,
+// there is only one record inserted per user (of a tenant),
 // which is the first event that gets recorded for that user.
 // After that nothing will be inserted and the returned boolean will be false.
+// Events with an ID are recorded as processed within the same transaction,
+// such that a redelivered event is never recorded twice.
 func (rt *runtime) record(event *pkg.Event) (bool, error) {
-	resp, err := rt.db.Query(fmt.Sprintf(
-		`INSERT INTO %s VALUES($1, $2) ON CONFLICT (%s) DO NOTHING RETURNING *;`,
-		pgTable, propUsername), *event.Username, *event.Timestamp)
+	tx, err := rt.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // no-op in case the transaction was committed
+
+	tenant := event.TenantName()
+
+	// events without an ID can't be deduplicated
+	if event.ID != nil {
+		var first bool
+		first, err = queryInserted(tx, fmt.Sprintf(
+			`INSERT INTO %s (%s, %s, %s) VALUES($1, $2, $3) ON CONFLICT (%s, %s) DO NOTHING RETURNING *;`,
+			processedTable(rt.cfg.table), propTenant, propID, propProcessed, propTenant, propID),
+			tenant, *event.ID, time.Now().UTC().Unix())
+		if err != nil {
+			return false, err
+		}
+		if !first {
+			log.Debugf("skipped already processed event %q", *event.ID)
+			return false, tx.Commit()
+		}
+	}
+
+	inserted, err := queryInserted(tx, fmt.Sprintf(
+		`INSERT INTO %s (%s, %s, %s) VALUES($1, $2, $3) ON CONFLICT (%s, %s) DO NOTHING RETURNING *;`,
+		rt.cfg.table, propTenant, propUsername, propTimestamp, propTenant, propUsername),
+		tenant, *event.Username, *event.Timestamp)
+	if err != nil {
+		return false, err
+	}
+
+	return inserted, tx.Commit()
+}
+
+// queryInserted executes an insert query,
+// returning true in case a row was inserted
+func queryInserted(tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	resp, err := tx.Query(query, args...)
 	if err != nil {
 		return false, err
 	}
 	defer resp.Close()
-	return resp.Next(), nil
+	inserted := resp.Next()
+	return inserted, resp.Err()
 }
 
-func validateSSLMode() bool {
+// RemoveProcessed removes all processed event IDs older than the dedup window
+func (rt *runtime) RemoveProcessed() error {
+	start := time.Now()
+	limit := start.UTC().Add(rt.cfg.dedupWindow * -1).Unix()
+	result, err := rt.db.Exec(fmt.Sprintf(
+		`DELETE FROM %s WHERE %s < $1;`, processedTable(rt.cfg.table), propProcessed), limit)
+	rt.store.Observe("cleanup", start, err)
+	if err != nil {
+		return err
+	}
+
+	if removed, err := result.RowsAffected(); err == nil {
+		log.Infof("removed %d processed event IDs", removed)
+	}
+	return nil
+}
+
+func validateSSLMode(mode string) bool {
 	for sslModeIndex := range sslModeEnum {
-		if sslModeEnum[sslModeIndex] == pgSSLMode {
+		if sslModeEnum[sslModeIndex] == mode {
 			return true
 		}
 	}
@@ -120,55 +260,167 @@ func validateSSLMode() bool {
 	return false
 }
 
-// ensure given flags make sense
-func validateFlags() error {
+// ensure given flags make sense,
+// returning the runtime config they result in
+func validateFlags() (*runtimeConfig, error) {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return nil, err
+	}
 	if pgAddress == "" {
-		return errors.New("postgres instance's address not given, while this is required")
+		return nil, errors.New("postgres instance's address not given, while this is required")
 	}
 	if pgUser == "" {
-		return errors.New("postgres username not given, while this is required")
+		return nil, errors.New("postgres username not given, while this is required")
 	}
 	if pgDatabase == "" {
-		return errors.New("postgres database's name not given, while this is required")
+		return nil, errors.New("postgres database's name not given, while this is required")
 	}
 	if !rexTableName.MatchString(pgTable) {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"postgres table's name %q is not valid according to regexp(%q)",
 			pgTable, reTableName)
 	}
-	if !validateSSLMode() {
-		return fmt.Errorf("postgres ssl-mode has to be one of %v", sslModeEnum)
+	if !validateSSLMode(pgSSLMode) {
+		return nil, fmt.Errorf("postgres ssl-mode has to be one of %v", sslModeEnum)
+	}
+	if dedupWindow <= 0 {
+		return nil, errors.New("dedup window has to be positive and non-zero")
 	}
 
-	return nil
+	if err := amqpConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := adminConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := traceConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := shutdownConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &runtimeConfig{
+		address:     pgAddress,
+		user:        pgUser,
+		password:    pgPassword,
+		database:    pgDatabase,
+		table:       pgTable,
+		sslMode:     pgSSLMode,
+		dedupWindow: dedupWindow,
+	}, nil
+}
+
+// dedupCleanupJob is a seperate coroutine,
+// removing processed event IDs that are older than the dedup window,
+// until the given stop channel is closed
+func dedupCleanupJob(rt *runtime, stop <-chan struct{}) {
+	log.Infof("dedup clean up job up and running, removing old event IDs every %v",
+		dedupCleanupInterval)
+	var gcError error
+
+	for {
+		if gcError = rt.RemoveProcessed(); gcError != nil {
+			log.Warningf("couldn't cleanup processed event IDs: %q", gcError)
+		}
+
+		select {
+		case <-stop:
+			log.Infof("dedup clean up job stopped")
+			return
+		case <-time.After(dedupCleanupInterval):
+		}
+	}
 }
 
 func main() {
-	flag.Parse() // parse all (non-)specific flags
-	err := validateFlags()
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
+	rtConfig, err := validateFlags()
 	if err != nil {
 		flag.Usage()
-		log.Errorf("invalid flag: %q", err)
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// load the schema used to validate consumed events
+	if err = pkg.LoadEventSchema(eventSchemaPath); err != nil {
+		log.Fatalf("couldn't load event schema: %q", err)
 	}
 
-	rt, err := newRuntime()
+	// export the spans of consumed events (if configured)
+	if err = trace.Open(traceConfig); err != nil {
+		log.Fatalf("couldn't open trace exporter: %q", err)
+	}
+	defer trace.Close()
+
+	rt, err := newRuntime(rtConfig)
 	if err != nil {
-		log.Errorf("couldn't create postgres runtime: %q", err)
+		log.Fatalf("couldn't create postgres runtime: %q", err)
 	}
 	defer rt.Close()
 
-	cfg := rpc.NewAMQPConsConfig().WithName("accountName")
+	// serve the admin endpoints (metrics, health) in the background
+	health.Register("postgres", rt.db.Ping)
+	if err = admin.Serve(adminConfig, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start admin listener: %q", err)
+	}
+
+	// background jobs are stopped, and waited for, prior to closing the runtime
+	var jobs sync.WaitGroup
+	stopJobs := make(chan struct{})
+	defer jobs.Wait()
+	defer close(stopJobs)
+
+	// dedup cleanup job
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		dedupCleanupJob(rt, stopJobs)
+	}()
+
+	cfg := rpc.NewAMQPConsConfig(amqpConfig).WithName("accountName")
 	consumer, err := rpc.NewAMQPConsumer(cfg)
 	if err != nil {
-		log.Errorf("couldn't create consumer: %q", err)
+		log.Fatalf("couldn't create consumer: %q", err)
 	}
 	defer consumer.Close()
+	health.Register("amqp", consumer.Ping)
+
+	// cancel consumption on SIGINT/SIGTERM, such that the deliveries
+	// received so far are processed and acknowledged before we exit
+	go func() {
+		<-shutdown.Signal()
+		if err := consumer.Cancel(); err != nil {
+			log.Warningf("couldn't cancel consumer: %q", err)
+		}
+		// stop waiting for remaining deliveries once the shutdown timeout passed,
+		// unacknowledged deliveries are requeued by the broker
+		time.AfterFunc(shutdownConfig.Timeout, func() { consumer.Close() })
+	}()
 
 	// Listen & Consume Loop
 	consumer.ListenAndConsume(rt.Consume)
 }
 
 func init() {
+	// register the flags of the packages used by this worker
+	logConfig.RegisterFlags(flag.CommandLine)
+	amqpConfig.RegisterFlags(flag.CommandLine)
+	adminConfig.RegisterFlags(flag.CommandLine)
+	traceConfig.RegisterFlags(flag.CommandLine)
+	shutdownConfig.RegisterFlags(flag.CommandLine)
+	pkg.RegisterEventSchemaFlag(flag.CommandLine, &eventSchemaPath)
+
+	// register worker specific flag(s)
 	flag.StringVar(&pgAddress, "address", "localhost:5432", "postgres address")
 	flag.StringVar(&pgUser, "user", "postgres", "postgres user")
 	flag.StringVar(&pgPassword, "password", "", "postgres password")
@@ -177,4 +429,6 @@ func init() {
 		"postgres table to use to store accountNames events")
 	flag.StringVar(&pgSSLMode, "ssl-mode", sslModeDisable,
 		fmt.Sprintf("ssl mode used to connect to postgreg %v", sslModeEnum))
+	flag.DurationVar(&dedupWindow, "dedup-window", time.Hour*24,
+		"how long processed event IDs are remembered, to prevent recording an event twice")
 }
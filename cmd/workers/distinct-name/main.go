@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/admin"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
 	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+	"github.com/glendc/data-ingestion-challenge/pkg/trace"
 
 	"gopkg.in/redis.v5"
 )
@@ -22,33 +31,86 @@ var (
 	redisDB        int
 	mergeInterval  time.Duration
 	mergerDisabled bool
+	dedupWindow    time.Duration
 )
 
-// prefixes for/and keys used for redis storage
+// configs of the packages used by this worker, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig       = log.DefaultConfig()
+	amqpConfig      = rpc.DefaultConfig()
+	adminConfig     = admin.DefaultConfig()
+	traceConfig     = trace.DefaultConfig()
+	shutdownConfig  = shutdown.DefaultConfig()
+	eventSchemaPath string
+)
+
+// runtimeConfig is used to configure the redis runtime and its merge job,
+// see validateFlags
+type runtimeConfig struct {
+	address        string
+	password       string
+	db             int
+	mergeInterval  time.Duration
+	mergerDisabled bool
+	dedupWindow    time.Duration
+}
+
+// mergerLog logs the messages of the merge job
+var mergerLog = log.With("component", "merger")
+
+// prefixes for/and keys used for redis storage,
+// all keys (except the tenants set) are prefixed with the tenant they belong to
 const (
-	prefix       = "metrics-distinct"
-	keyLastMerge = prefix + ":last-merge"
+	prefix     = "metrics-distinct"
+	keyTenants = prefix + ":tenants"
 )
 
 // we only merge events into a monthly bucket when they are older than 30 days
 const mergeTimeLimitSubtractor = time.Hour * 24 * 30 * -1
 
 // key functions to generate redis keys used for storage
-func keyMonthly(date time.Time) string {
-	return fmt.Sprintf("%s:%d:%02d",
-		prefix, date.Year(), date.Month())
+func keyMonthly(tenant string, date time.Time) string {
+	return fmt.Sprintf("%s:%s:%d:%02d",
+		prefix, tenant, date.Year(), date.Month())
+}
+func keyDaily(tenant string, date time.Time) string {
+	return fmt.Sprintf("%s:%s:%d:%02d:%02d",
+		prefix, tenant, date.Year(), date.Month(), date.Day())
 }
-func keyDaily(date time.Time) string {
-	return fmt.Sprintf("%s:%d:%02d:%02d",
-		prefix, date.Year(), date.Month(), date.Day())
+func keyProcessed(tenant, id string) string {
+	return fmt.Sprintf("%s:%s:processed:%s", prefix, tenant, id)
+}
+func keyLastMerge(tenant string) string {
+	return fmt.Sprintf("%s:%s:last-merge", prefix, tenant)
 }
 
+// recordOnceScript records a daily event, only if it wasn't processed before.
+// The processed event ID is stored for the duration of the dedup window,
+// both happen atomically, so that an event is never counted twice.
+// The tenant of the event is added to the tenants set, so its logs get merged.
+//
+//	KEYS[1]: processed key of the event
+//	KEYS[2]: daily bucket
+//	KEYS[3]: tenants set
+//	ARGV[1]: dedup window in seconds
+//	ARGV[2]: metric
+//	ARGV[3]: tenant
+var recordOnceScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], "1", "NX", "EX", ARGV[1]) then
+	redis.call("HINCRBY", KEYS[2], ARGV[2], 1)
+	redis.call("SADD", KEYS[3], ARGV[3])
+	return 1
+end
+return 0
+`)
+
 // create a new redis runtime client
-func newRuntime() (*runtime, error) {
+func newRuntime(cfg *runtimeConfig) (*runtime, error) {
 	client := redis.NewClient(&redis.Options{
-		Addr:     redisAddress,
-		Password: redisPassword,
-		DB:       redisDB,
+		Addr:     cfg.address,
+		Password: cfg.password,
+		DB:       cfg.db,
 	})
 
 	if _, err := client.Ping().Result(); err != nil {
@@ -56,25 +118,40 @@ func newRuntime() (*runtime, error) {
 	}
 
 	return &runtime{
+		cfg:    cfg,
 		client: client,
+		store:  metrics.NewStore("redis"),
 	}, nil
 }
 
 type runtime struct {
+	cfg    *runtimeConfig
 	client *redis.Client
+	store  *metrics.Store
 }
 
 // Consume raw incoming data as a daily event and record it
 // see runtime::Record for more information
-func (rt *runtime) Consume(event *pkg.Event) *rpc.ConsumeError {
-	if err := rt.record(event); err != nil {
+func (rt *runtime) Consume(ctx context.Context, event *pkg.Event) *rpc.ConsumeError {
+	_, span := trace.Start(ctx, "redis.record")
+	start := time.Now()
+	recorded, err := rt.record(event)
+	rt.store.Observe("record", start, err)
+	span.SetAttribute("recorded", recorded)
+	span.Finish(err)
+	if err != nil {
 		// requeue is required as this is a mistake on our part
 		// perhaps another distinctName worker can handle this
 		// or we can try again later
 		return rpc.NewConsumeError(err, true)
 	}
 
-	log.Infof("recorded distinct event for metric %q", *event.Metric)
+	if !recorded {
+		log.Debugf("skipped already processed event %q", *event.ID)
+		return nil
+	}
+
+	log.Debugf("recorded distinct event for metric %q of tenant %q", *event.Metric, event.TenantName())
 	return nil
 }
 
@@ -103,7 +180,7 @@ func (m *dailyEventMerger) Merge(tx *redis.Tx) error {
 	// as this is possible for various reasons
 	// (eg. no worker was active that day to collect events)
 	if len(demap) > 0 {
-		log.Infof("[MERGER] merging distinct events from %q into %q",
+		mergerLog.Infof("merging distinct events from %q into %q",
 			m.dailyBucket, m.monthlyBucket)
 		// this can be done as one transaction, keys are already watched
 		pipe := tx.Pipeline()
@@ -138,7 +215,7 @@ func (m *dailyEventMerger) Merge(tx *redis.Tx) error {
 	return nil
 }
 
-// MergeOldLogs collects all events older then 30 days,
+// MergeOldLogs collects all events of a tenant older then 30 days,
 // merges them all together in a monthly bucket,
 // and deletes the original records of those events.
 //
@@ -155,22 +232,23 @@ func (m *dailyEventMerger) Merge(tx *redis.Tx) error {
 //           - Piped Transaction with actual Merge (incl del daily bucket at the end);
 //
 // Meaning that if we merge every 24 hours it should only ever require 6 or 12 transactions.
-func (rt *runtime) MergeOldLogs(lastMerge *redis.Tx) error {
+func (rt *runtime) MergeOldLogs(tenant string, lastMerge *redis.Tx) error {
 	now := time.Now().UTC()
+	lastMergeKey := keyLastMerge(tenant)
 
 	// check if lastMerge is actually set
-	dateRaw, err := lastMerge.Get(keyLastMerge).Result()
+	dateRaw, err := lastMerge.Get(lastMergeKey).Result()
 	if err != nil {
-		return fmt.Errorf("error getting %q: %q", keyLastMerge, err)
+		return fmt.Errorf("error getting %q: %q", lastMergeKey, err)
 	}
 	// if empty we'll assume it's not set yet
 	if dateRaw == "" {
-		log.Infof("[MERGER] %q was not set yet, setting it to current time", keyLastMerge)
+		mergerLog.Infof("%q was not set yet, setting it to current time", lastMergeKey)
 		// we want to store the last merge as 1 day before, as today isn't merged yet
 		date := now.Add(time.Hour * -24)
-		cmd := lastMerge.Set(keyLastMerge, date.Format(time.RFC1123Z), 0)
+		cmd := lastMerge.Set(lastMergeKey, date.Format(time.RFC1123Z), 0)
 		if err = cmd.Err(); err != nil {
-			return fmt.Errorf("couldn't set %q to current time: %q", keyLastMerge, err)
+			return fmt.Errorf("couldn't set %q to current time: %q", lastMergeKey, err)
 		}
 
 		return nil
@@ -179,7 +257,7 @@ func (rt *runtime) MergeOldLogs(lastMerge *redis.Tx) error {
 	// parse lastMerge Date as we need it in order to merge events
 	date, mergeErr := time.Parse(time.RFC1123Z, dateRaw)
 	if mergeErr != nil {
-		return fmt.Errorf("couldn't parse %q: %q", keyLastMerge, mergeErr)
+		return fmt.Errorf("couldn't parse %q: %q", lastMergeKey, mergeErr)
 	}
 	limit := now.Add(mergeTimeLimitSubtractor - (time.Hour * 24))
 	originalDate := date // so we know if date was updated
@@ -191,8 +269,8 @@ func (rt *runtime) MergeOldLogs(lastMerge *redis.Tx) error {
 
 		// create daily merger
 		merger := dailyEventMerger{
-			dailyBucket:   keyDaily(date),
-			monthlyBucket: keyMonthly(date),
+			dailyBucket:   keyDaily(tenant, date),
+			monthlyBucket: keyMonthly(tenant, date),
 		}
 
 		// watch keys & merge daily bucket into the monthly bucket
@@ -205,79 +283,225 @@ func (rt *runtime) MergeOldLogs(lastMerge *redis.Tx) error {
 
 	// store the updated lastMergeDate
 	if date.After(originalDate) {
-		log.Infof("[MERGER] updating %q to %q", keyLastMerge, date)
-		cmd := lastMerge.Set(keyLastMerge, date.Format(time.RFC1123Z), 0)
+		mergerLog.Infof("updating %q to %q", lastMergeKey, date)
+		cmd := lastMerge.Set(lastMergeKey, date.Format(time.RFC1123Z), 0)
 		if err = cmd.Err(); err != nil {
-			return fmt.Errorf("couldn't set %q to the %v: %q", keyLastMerge, date, err)
+			return fmt.Errorf("couldn't set %q to the %v: %q", lastMergeKey, date, err)
 		}
 	} else {
-		log.Infof("[MERGER] no events older than 30 days found, nothing to do here")
+		mergerLog.Infof("no events older than 30 days found, nothing to do here")
 	}
 
 	return nil
 }
 
-// record a daily event into Redis, storing it up to 30 days
-func (rt *runtime) record(event *pkg.Event) error {
+// record a daily event into Redis, storing it up to 30 days,
+// events with an ID are only recorded once within the dedup window,
+// the returned boolean is false in case the event was already recorded before
+func (rt *runtime) record(event *pkg.Event) (bool, error) {
 	date := time.Unix(*event.Timestamp, 0).UTC()
-	cmd := rt.client.HIncrBy(keyDaily(date), *event.Metric, 1)
-	return cmd.Err()
+	tenant := event.TenantName()
+
+	// events without an ID can't be deduplicated
+	if event.ID == nil {
+		_, err := rt.client.TxPipelined(func(pipe *redis.Pipeline) error {
+			pipe.HIncrBy(keyDaily(tenant, date), *event.Metric, 1)
+			pipe.SAdd(keyTenants, tenant)
+			return nil
+		})
+		return err == nil, err
+	}
+
+	result, err := recordOnceScript.Run(rt.client,
+		[]string{keyProcessed(tenant, *event.ID), keyDaily(tenant, date), keyTenants},
+		int64(rt.cfg.dedupWindow/time.Second), *event.Metric, tenant).Result()
+	if err != nil {
+		return false, err
+	}
+	recorded, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected record result %v", result)
+	}
+	return recorded == 1, nil
 }
 
-// ensure given flags make sense
-func validateFlags() error {
+// ensure given flags make sense,
+// returning the runtime config they result in
+func validateFlags() (*runtimeConfig, error) {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return nil, err
+	}
 	if redisAddress == "" {
-		return errors.New("redis instance's address not given, while this is required")
+		return nil, errors.New("redis instance's address not given, while this is required")
+	}
+	if dedupWindow < time.Second {
+		return nil, errors.New("dedup window has to be at least 1 second")
+	}
+	if mergeInterval <= 0 {
+		return nil, errors.New("merge interval has to be positive and non-zero")
+	}
+
+	if err := amqpConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := adminConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := traceConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := shutdownConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &runtimeConfig{
+		address:        redisAddress,
+		password:       redisPassword,
+		db:             redisDB,
+		mergeInterval:  mergeInterval,
+		mergerDisabled: mergerDisabled,
+		dedupWindow:    dedupWindow,
+	}, nil
+}
+
+// mergeAllOldLogs merges the old logs of each tenant separately,
+// such that a failing merge of one tenant doesn't block the others
+func (rt *runtime) mergeAllOldLogs() error {
+	tenants, err := rt.client.SMembers(keyTenants).Result()
+	if err != nil {
+		return fmt.Errorf("couldn't get %q: %q", keyTenants, err)
+	}
+
+	for _, tenant := range tenants {
+		tenant := tenant
+		start := time.Now()
+		err = rt.client.Watch(func(lastMerge *redis.Tx) error {
+			return rt.MergeOldLogs(tenant, lastMerge)
+		}, keyLastMerge(tenant))
+		rt.store.Observe("merge", start, err)
+		if err != nil {
+			mergerLog.With("tenant", tenant).Warningf("couldn't merge monthly logs: %q", err)
+		}
 	}
 	return nil
 }
 
-// mergeJob is a seperate coroutine, running just a merge (cleanup) job
-func mergeJob(rt *runtime) {
-	log.Infof("[MERGER] merge job up and running, merging old logs every %v", mergeInterval)
+// mergeJob is a seperate coroutine, running just a merge (cleanup) job,
+// until the given stop channel is closed
+func mergeJob(rt *runtime, stop <-chan struct{}) {
+	mergerLog.Infof("merge job up and running, merging old logs every %v", rt.cfg.mergeInterval)
 	var mError error
 
 	for {
-		mError = rt.client.Watch(rt.MergeOldLogs, keyLastMerge)
-		if mError != nil {
-			log.Warningf("[MERGER] couldn't merge monthly logs: %q", mError)
+		if mError = rt.mergeAllOldLogs(); mError != nil {
+			mergerLog.Warningf("couldn't merge monthly logs: %q", mError)
+		}
+
+		select {
+		case <-stop:
+			mergerLog.Infof("merge job stopped")
+			return
+		case <-time.After(rt.cfg.mergeInterval):
 		}
-		time.Sleep(mergeInterval)
 	}
 }
 
 func main() {
-	flag.Parse() // parse all (non-)specific flags
-	err := validateFlags()
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
+	rtConfig, err := validateFlags()
 	if err != nil {
 		flag.Usage()
-		log.Errorf("invalid flag: %q", err)
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// load the schema used to validate consumed events
+	if err = pkg.LoadEventSchema(eventSchemaPath); err != nil {
+		log.Fatalf("couldn't load event schema: %q", err)
+	}
+
+	// export the spans of consumed events (if configured)
+	if err = trace.Open(traceConfig); err != nil {
+		log.Fatalf("couldn't open trace exporter: %q", err)
 	}
+	defer trace.Close()
 
-	rt, err := newRuntime()
+	rt, err := newRuntime(rtConfig)
 	if err != nil {
-		log.Errorf("couldn't create redis runtime: %q", err)
+		log.Fatalf("couldn't create redis runtime: %q", err)
 	}
 	defer rt.Close()
 
+	// move the keys stored prior to tenants to the default tenant (once)
+	if err = rt.migrateLegacyKeys(); err != nil {
+		log.Fatalf("couldn't migrate legacy keys: %q", err)
+	}
+
+	// serve the admin endpoints (metrics, health) in the background
+	health.Register("redis", func() error { return rt.client.Ping().Err() })
+	if err = admin.Serve(adminConfig, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start admin listener: %q", err)
+	}
+
+	// background jobs are stopped, and waited for, prior to closing the runtime
+	var jobs sync.WaitGroup
+	stopJobs := make(chan struct{})
+	defer jobs.Wait()
+	defer close(stopJobs)
+
 	// spawn merge job as coroutine
 	// collecting logs older then 30 days and merging them into a single bucket
-	if !mergerDisabled {
-		go mergeJob(rt)
+	if !rtConfig.mergerDisabled {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			mergeJob(rt, stopJobs)
+		}()
 	}
 
-	cfg := rpc.NewAMQPConsConfig().WithName("distinctName")
+	cfg := rpc.NewAMQPConsConfig(amqpConfig).WithName("distinctName")
 	consumer, err := rpc.NewAMQPConsumer(cfg)
 	if err != nil {
-		log.Errorf("couldn't create consumer: %q", err)
+		log.Fatalf("couldn't create consumer: %q", err)
 	}
 	defer consumer.Close()
+	health.Register("amqp", consumer.Ping)
+
+	// cancel consumption on SIGINT/SIGTERM, such that the deliveries
+	// received so far are processed and acknowledged before we exit
+	go func() {
+		<-shutdown.Signal()
+		if err := consumer.Cancel(); err != nil {
+			log.Warningf("couldn't cancel consumer: %q", err)
+		}
+		// stop waiting for remaining deliveries once the shutdown timeout passed,
+		// unacknowledged deliveries are requeued by the broker
+		time.AfterFunc(shutdownConfig.Timeout, func() { consumer.Close() })
+	}()
 
 	// Listen & Consume Loop
 	consumer.ListenAndConsume(rt.Consume)
 }
 
 func init() {
+	// register the flags of the packages used by this worker
+	logConfig.RegisterFlags(flag.CommandLine)
+	amqpConfig.RegisterFlags(flag.CommandLine)
+	adminConfig.RegisterFlags(flag.CommandLine)
+	traceConfig.RegisterFlags(flag.CommandLine)
+	shutdownConfig.RegisterFlags(flag.CommandLine)
+	pkg.RegisterEventSchemaFlag(flag.CommandLine, &eventSchemaPath)
+
+	// register worker specific flag(s)
 	flag.StringVar(&redisAddress, "address", "localhost:6379", "redis instance address")
 	flag.StringVar(&redisPassword, "password", "", "redis instance password")
 	flag.IntVar(&redisDB, "db", 0, "redis instance db")
@@ -285,4 +509,6 @@ func init() {
 		"Merge time interval on which it merges logs older then 30 days into a monthly bucket")
 	flag.BoolVar(&mergerDisabled, "disable-merger", false,
 		"don't run the async merger responsible for merging logs older than 30 days")
+	flag.DurationVar(&dedupWindow, "dedup-window", time.Hour*24,
+		"how long processed event IDs are remembered, to prevent counting an event twice")
 }
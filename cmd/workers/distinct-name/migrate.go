@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+
+	"gopkg.in/redis.v5"
+)
+
+// keys stored prior to tenants (keyspace version 1),
+// see migrateLegacyKeys
+const (
+	keyVersion         = prefix + ":version"
+	keyLegacyLastMerge = prefix + ":last-merge"
+	// keys are prefixed with the tenant they belong to since version 2
+	keyspaceVersion = 2
+)
+
+// rexLegacyBucket matches the daily (YYYY:MM:DD) and monthly (YYYY:MM) buckets stored prior to tenants,
+// these can't be confused with the buckets of a tenant, as tenants can't start with a digit
+var rexLegacyBucket = regexp.MustCompile(`^` + prefix + `:\d{4}:\d{2}(:\d{2})?$`)
+
+// migrationLog logs the messages of the keyspace migration
+var migrationLog = log.With("component", "migration")
+
+// migrateBucketScript merges a legacy bucket into the same bucket of the default tenant,
+// deleting the legacy bucket afterwards, such that migrating it again has no effect.
+//
+//	KEYS[1]: legacy bucket
+//	KEYS[2]: bucket of the default tenant
+//	returns: amount of metrics merged
+var migrateBucketScript = redis.NewScript(`
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+	redis.call("HINCRBY", KEYS[2], fields[i], fields[i + 1])
+end
+redis.call("DEL", KEYS[1])
+return #fields / 2
+`)
+
+// migrateLegacyKeys moves the keys stored prior to tenants to the default tenant, once.
+// Legacy daily and monthly buckets are merged into those of the default tenant,
+// and the last merge date of the default tenant is set to the earliest of both,
+// such that the merger doesn't skip any of the legacy daily buckets.
+// Processed event IDs aren't migrated, as they expire within the dedup window anyway.
+// Migrating is safe to do by multiple workers at once.
+func (rt *runtime) migrateLegacyKeys() error {
+	version, err := rt.client.Get(keyVersion).Int64()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("couldn't get %q: %q", keyVersion, err)
+	}
+	if version >= keyspaceVersion {
+		return nil
+	}
+
+	var buckets int
+	var cursor uint64
+	for {
+		keys, next, err := rt.client.Scan(cursor, prefix+":*", 1000).Result()
+		if err != nil {
+			return fmt.Errorf("couldn't scan keys: %q", err)
+		}
+		for _, key := range keys {
+			if !rexLegacyBucket.MatchString(key) {
+				continue
+			}
+			target := fmt.Sprintf("%s:%s:%s", prefix, pkg.DefaultTenant, strings.TrimPrefix(key, prefix+":"))
+			if err = migrateBucketScript.Run(rt.client, []string{key, target}).Err(); err != nil {
+				return fmt.Errorf("couldn't migrate %q to %q: %q", key, target, err)
+			}
+			buckets++
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	if err = rt.client.Watch(rt.migrateLastMerge, keyLegacyLastMerge, keyLastMerge(pkg.DefaultTenant)); err != nil {
+		return fmt.Errorf("couldn't migrate %q: %q", keyLegacyLastMerge, err)
+	}
+	// the default tenant has to be merged, even if no new events are recorded for it
+	if buckets > 0 {
+		if err = rt.client.SAdd(keyTenants, pkg.DefaultTenant).Err(); err != nil {
+			return fmt.Errorf("couldn't add %q to %q: %q", pkg.DefaultTenant, keyTenants, err)
+		}
+	}
+	if err = rt.client.Set(keyVersion, keyspaceVersion, 0).Err(); err != nil {
+		return fmt.Errorf("couldn't set %q: %q", keyVersion, err)
+	}
+
+	migrationLog.Infof("migrated %d legacy buckets to tenant %q", buckets, pkg.DefaultTenant)
+	return nil
+}
+
+// migrateLastMerge moves the legacy last merge date to the default tenant,
+// keeping the earliest date in case the default tenant was merged already
+func (rt *runtime) migrateLastMerge(tx *redis.Tx) error {
+	lastMergeKey := keyLastMerge(pkg.DefaultTenant)
+
+	legacy, err := tx.Get(keyLegacyLastMerge).Result()
+	if err == redis.Nil {
+		return nil // nothing to migrate
+	}
+	if err != nil {
+		return err
+	}
+	current, err := tx.Get(lastMergeKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if current != "" && !isEarlier(legacy, current) {
+		legacy = current
+	}
+
+	pipe := tx.Pipeline()
+	defer pipe.Close()
+	pipe.Set(lastMergeKey, legacy, 0)
+	pipe.Del(keyLegacyLastMerge)
+	_, err = pipe.Exec()
+	return err
+}
+
+// isEarlier returns true if the first (RFC1123Z) date is earlier than the second,
+// or in case only the second date is invalid
+func isEarlier(a, b string) bool {
+	dateA, err := time.Parse(time.RFC1123Z, a)
+	if err != nil {
+		return false
+	}
+	dateB, err := time.Parse(time.RFC1123Z, b)
+	if err != nil {
+		return true
+	}
+	return dateA.Before(dateB)
+}
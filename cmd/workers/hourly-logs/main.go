@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/admin"
+	"github.com/glendc/data-ingestion-challenge/pkg/config"
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
 	"github.com/glendc/data-ingestion-challenge/pkg/rpc"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+	"github.com/glendc/data-ingestion-challenge/pkg/trace"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -22,12 +31,46 @@ var (
 	mgoCollection string
 	gcInterval    time.Duration
 	gcDisabled    bool
+	dedupWindow   time.Duration
 )
 
+// configs of the packages used by this worker, bound to their flags
+// see: init function, validated by validateFlags
+var (
+	logConfig       = log.DefaultConfig()
+	amqpConfig      = rpc.DefaultConfig()
+	adminConfig     = admin.DefaultConfig()
+	traceConfig     = trace.DefaultConfig()
+	shutdownConfig  = shutdown.DefaultConfig()
+	eventSchemaPath string
+)
+
+// runtimeConfig is used to configure the mongo runtime and its cleanup job,
+// see validateFlags
+type runtimeConfig struct {
+	address     string
+	database    string
+	collection  string
+	gcInterval  time.Duration
+	gcDisabled  bool
+	dedupWindow time.Duration
+}
+
 // defines how long a record stored in this hourlyLog actually lives,
 // before it gets wiped off by the garbage collector
 const recordTTL = time.Hour
 
+// suffix of the collection used to store the IDs of processed events
+const processedCollectionSuffix = "_processed"
+
+// processed is the document stored for each processed event,
+// identified by the tenant and ID of the event,
+// it gets removed by MongoDB itself once it's older than the dedup window
+type processed struct {
+	ID          string    `bson:"_id"`
+	ProcessedAt time.Time `bson:"processedAt"`
+}
+
 var cleanupSelector = bson.M{
 	pkg.EventTimestampID: bson.M{
 		// event is older than 1 hour (thus less than now - 1h)
@@ -35,8 +78,8 @@ var cleanupSelector = bson.M{
 	},
 }
 
-func newRuntime() (*runtime, error) {
-	session, err := mgo.Dial(mgoAddress)
+func newRuntime(cfg *runtimeConfig) (*runtime, error) {
+	session, err := mgo.Dial(cfg.address)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open mongo session: %q", err)
 	}
@@ -46,26 +89,72 @@ func newRuntime() (*runtime, error) {
 		return nil, fmt.Errorf("couldn't ping mongo server: %q", err)
 	}
 
-	return &runtime{
+	rt := &runtime{
+		cfg:     cfg,
 		session: session,
-	}, nil
+		store:   metrics.NewStore("mongo"),
+	}
+
+	// hourly logs are always queried per tenant
+	collection, err := rt.getCollection()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("couldn't find collection: %q", err)
+	}
+	err = collection.EnsureIndex(mgo.Index{
+		Key: []string{pkg.EventTenantID, pkg.EventMetricID},
+	})
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("couldn't ensure collection index: %q", err)
+	}
+
+	// processed event IDs expire automatically, once older than the dedup window
+	collection, err = rt.getProcessedCollection()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("couldn't find processed collection: %q", err)
+	}
+	err = collection.EnsureIndex(mgo.Index{
+		Key:         []string{"processedAt"},
+		ExpireAfter: cfg.dedupWindow,
+	})
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("couldn't ensure processed collection index: %q", err)
+	}
+
+	return rt, nil
 }
 
 type runtime struct {
+	cfg     *runtimeConfig
 	session *mgo.Session
+	store   *metrics.Store
 }
 
 // Consume raw event data and store it as an anonymous object into mongodb
 // Validation of the actual data is not done in this worker
-func (rt *runtime) Consume(event *pkg.Event) *rpc.ConsumeError {
-	if err := rt.record(event); err != nil {
+func (rt *runtime) Consume(ctx context.Context, event *pkg.Event) *rpc.ConsumeError {
+	_, span := trace.Start(ctx, "mongo.insert")
+	start := time.Now()
+	recorded, err := rt.record(event)
+	rt.store.Observe("insert", start, err)
+	span.SetAttribute("recorded", recorded)
+	span.Finish(err)
+	if err != nil {
 		// requeue is required as this is a mistake on our part
 		// perhaps another accountName worker can handle this
 		// or we can try again later
 		return rpc.NewConsumeError(err, true)
 	}
 
-	log.Infof("recorded event for up to 1 hour")
+	if !recorded {
+		log.Debugf("skipped already processed event %q", *event.ID)
+		return nil
+	}
+
+	log.Debugf("recorded event of tenant %q for up to 1 hour", event.TenantName())
 	return nil
 }
 
@@ -76,7 +165,9 @@ func (rt *runtime) RemoveOldLogs() error {
 		return fmt.Errorf("couldn't find collection: %q", err)
 	}
 
+	start := time.Now()
 	resp, err := collection.RemoveAll(cleanupSelector)
+	rt.store.Observe("cleanup", start, err)
 	if err != nil {
 		return err
 	}
@@ -90,98 +181,238 @@ func (rt *runtime) Close() error {
 	return nil
 }
 
-// record event for 1 hour in MongoDB
-func (rt *runtime) record(event *pkg.Event) error {
+// record event for 1 hour in MongoDB,
+// events with an ID are only recorded once (per tenant) within the dedup window,
+// the returned boolean is false in case the event was already recorded before
+func (rt *runtime) record(event *pkg.Event) (bool, error) {
 	collection, err := rt.getCollection()
 	if err != nil {
-		return fmt.Errorf("couldn't find collection: %q", err)
+		return false, fmt.Errorf("couldn't find collection: %q", err)
+	}
+
+	// always store the tenant, such that the logs can be queried per tenant,
+	// even for events dispatched prior to tenants being introduced
+	tenant := event.TenantName()
+	event.Tenant = &tenant
+
+	// events without an ID can't be deduplicated
+	if event.ID == nil {
+		return true, collection.Insert(event)
+	}
+
+	processedCollection, err := rt.getProcessedCollection()
+	if err != nil {
+		return false, fmt.Errorf("couldn't find processed collection: %q", err)
+	}
+
+	// mark event as processed, failing if it was already processed before
+	processedID := tenant + ":" + *event.ID
+	err = processedCollection.Insert(&processed{
+		ID:          processedID,
+		ProcessedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		if mgo.IsDup(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// insert event into collection,
+	// unmarking it as processed if that fails, so it can be retried
+	if err = collection.Insert(event); err != nil {
+		if rmErr := processedCollection.RemoveId(processedID); rmErr != nil {
+			log.Warningf("couldn't unmark event %q as processed: %q", *event.ID, rmErr)
+		}
+		return false, err
 	}
 
-	// insert event into collection
-	return collection.Insert(event)
+	return true, nil
 }
 
 func (rt *runtime) getCollection() (*mgo.Collection, error) {
-	db := rt.session.DB(mgoDatabase)
+	return rt.getCollectionByName(rt.cfg.collection)
+}
+
+func (rt *runtime) getProcessedCollection() (*mgo.Collection, error) {
+	return rt.getCollectionByName(rt.cfg.collection + processedCollectionSuffix)
+}
+
+func (rt *runtime) getCollectionByName(name string) (*mgo.Collection, error) {
+	db := rt.session.DB(rt.cfg.database)
 	if db == nil {
-		return nil, fmt.Errorf("no mongo database could be found for %q", mgoDatabase)
+		return nil, fmt.Errorf("no mongo database could be found for %q", rt.cfg.database)
 	}
-	collection := db.C(mgoCollection)
+	collection := db.C(name)
 	if collection == nil {
 		return nil, fmt.Errorf("no collection named %q could be found in %q",
-			mgoCollection, mgoDatabase)
+			name, rt.cfg.database)
 	}
 
 	return collection, nil
 }
 
-// ensure given flags make sense
-func validateFlags() error {
+// ensure given flags make sense,
+// returning the runtime config they result in
+func validateFlags() (*runtimeConfig, error) {
+	// configure the loggers first, as they're used from here on
+	if err := log.Configure(logConfig); err != nil {
+		return nil, err
+	}
 	if mgoAddress == "" {
-		return errors.New("mongo instance's address not given, while this is required")
+		return nil, errors.New("mongo instance's address not given, while this is required")
 	}
 	if mgoDatabase == "" {
-		return errors.New("mongo database's name not given, while this is required")
+		return nil, errors.New("mongo database's name not given, while this is required")
 	}
 	if mgoCollection == "" {
-		return errors.New("mongodb collection's name not given, while this is required")
+		return nil, errors.New("mongodb collection's name not given, while this is required")
 	}
 	if gcInterval <= 0 {
-		return errors.New("garbage collector's interval has to be positive and non-zero")
+		return nil, errors.New("garbage collector's interval has to be positive and non-zero")
 	}
-	return nil
+	if dedupWindow < time.Second {
+		return nil, errors.New("dedup window has to be at least 1 second")
+	}
+
+	if err := amqpConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := adminConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := traceConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := shutdownConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &runtimeConfig{
+		address:     mgoAddress,
+		database:    mgoDatabase,
+		collection:  mgoCollection,
+		gcInterval:  gcInterval,
+		gcDisabled:  gcDisabled,
+		dedupWindow: dedupWindow,
+	}, nil
 }
 
-// cleanupJob is a seperate coroutine, running just a cleanup job
+// cleanupJob is a seperate coroutine, running just a cleanup job,
+// until the given stop channel is closed
 //
 // NOTE: another cleanup approach that has been considered is cleaning while inserting,
 // and thus piggy-backing on the existing program flow,
 // while this does make the program slightly simpler, it did seem like
 // it would make the program more expensive, without much simplicity to be gained
-func cleanupJob(rt *runtime) {
-	log.Infof("clean up job up and running, removing old logs every %v", gcInterval)
+func cleanupJob(rt *runtime, stop <-chan struct{}) {
+	log.Infof("clean up job up and running, removing old logs every %v", rt.cfg.gcInterval)
 	var gcError error
 
 	for {
 		if gcError = rt.RemoveOldLogs(); gcError != nil {
 			log.Warningf("couldn't cleanup old hourly logs: %q", gcError)
 		}
-		time.Sleep(gcInterval)
+
+		select {
+		case <-stop:
+			log.Infof("clean up job stopped")
+			return
+		case <-time.After(rt.cfg.gcInterval):
+		}
 	}
 }
 
 func main() {
-	flag.Parse() // parse all (non-)specific flags
-	err := validateFlags()
+	// parse all (non-)specific flags, layered with the environment and config file
+	loader := config.NewLoader(flag.CommandLine)
+	if err := loader.Parse(os.Args[1:]); err != nil {
+		flag.Usage()
+		log.Fatalf("invalid config: %q", err)
+	}
+	rtConfig, err := validateFlags()
 	if err != nil {
 		flag.Usage()
-		log.Errorf("invalid flag: %q", err)
+		log.Fatalf("invalid flag: %q", err)
+	}
+	if loader.PrintRequested() {
+		loader.Print(os.Stdout)
+		return
+	}
+
+	// load the schema used to validate consumed events
+	if err = pkg.LoadEventSchema(eventSchemaPath); err != nil {
+		log.Fatalf("couldn't load event schema: %q", err)
 	}
 
 	// create runtime that we'll use as a consumer
-	rt, err := newRuntime()
+	// export the spans of consumed events (if configured)
+	if err = trace.Open(traceConfig); err != nil {
+		log.Fatalf("couldn't open trace exporter: %q", err)
+	}
+	defer trace.Close()
+
+	rt, err := newRuntime(rtConfig)
 	if err != nil {
-		log.Errorf("couldn't create mongo runtime: %q", err)
+		log.Fatalf("couldn't create mongo runtime: %q", err)
 	}
 	defer rt.Close()
 
+	// serve the admin endpoints (metrics, health) in the background
+	health.Register("mongo", rt.session.Ping)
+	if err = admin.Serve(adminConfig, shutdownConfig); err != nil {
+		log.Fatalf("couldn't start admin listener: %q", err)
+	}
+
+	// background jobs are stopped, and waited for, prior to closing the runtime
+	var jobs sync.WaitGroup
+	stopJobs := make(chan struct{})
+	defer jobs.Wait()
+	defer close(stopJobs)
+
 	// cleanup job
-	if !gcDisabled {
-		go cleanupJob(rt)
+	if !rtConfig.gcDisabled {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			cleanupJob(rt, stopJobs)
+		}()
 	}
 
-	cfg := rpc.NewAMQPConsConfig().WithName("hourlyLog")
+	cfg := rpc.NewAMQPConsConfig(amqpConfig).WithName("hourlyLog")
 	consumer, err := rpc.NewAMQPConsumer(cfg)
 	if err != nil {
-		log.Errorf("couldn't create consumer: %q", err)
+		log.Fatalf("couldn't create consumer: %q", err)
 	}
 	defer consumer.Close()
+	health.Register("amqp", consumer.Ping)
+
+	// cancel consumption on SIGINT/SIGTERM, such that the deliveries
+	// received so far are processed and acknowledged before we exit
+	go func() {
+		<-shutdown.Signal()
+		if err := consumer.Cancel(); err != nil {
+			log.Warningf("couldn't cancel consumer: %q", err)
+		}
+		// stop waiting for remaining deliveries once the shutdown timeout passed,
+		// unacknowledged deliveries are requeued by the broker
+		time.AfterFunc(shutdownConfig.Timeout, func() { consumer.Close() })
+	}()
 
 	// Listen & Consume Loop
 	consumer.ListenAndConsume(rt.Consume)
 }
 
 func init() {
+	// register the flags of the packages used by this worker
+	logConfig.RegisterFlags(flag.CommandLine)
+	amqpConfig.RegisterFlags(flag.CommandLine)
+	adminConfig.RegisterFlags(flag.CommandLine)
+	traceConfig.RegisterFlags(flag.CommandLine)
+	shutdownConfig.RegisterFlags(flag.CommandLine)
+	pkg.RegisterEventSchemaFlag(flag.CommandLine, &eventSchemaPath)
+
+	// register worker specific flag(s)
 	flag.StringVar(&mgoAddress, "address", "localhost:27017", "mongo instance address")
 	flag.StringVar(&mgoDatabase, "db", "events", "mongo database")
 	flag.StringVar(&mgoCollection, "collection", "hourly", "mongo db collection")
@@ -189,4 +420,6 @@ func init() {
 		"Garbage Collector interval on which it deletes old logs")
 	flag.BoolVar(&gcDisabled, "disable-gc", false,
 		"disable the async worker responsible for cleaning up logs older than 1 hour")
+	flag.DurationVar(&dedupWindow, "dedup-window", time.Hour*24,
+		"how long processed event IDs are remembered, to prevent recording an event twice")
 }
@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/health"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+	"github.com/glendc/data-ingestion-challenge/pkg/metrics"
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+)
+
+// Config is used to configure the admin endpoints
+type Config struct {
+	// port on which the admin endpoints are served, disabled if 0
+	Port int
+	// config of the readiness checks served by /readyz
+	Health *health.Config
+}
+
+// DefaultConfig creates an admin config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{Health: health.DefaultConfig()}
+}
+
+// RegisterFlags binds the properties of this config (and its health config)
+// to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.Port, "admin-port", cfg.Port,
+		"port on which the admin endpoints (/metrics, /debug/vars, /healthz, /readyz, /log/level) are served "+
+			"(disabled if not given)")
+	cfg.Health.RegisterFlags(fs)
+}
+
+// Validate the Config properties
+func (cfg *Config) Validate() error {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("%d is an invalid admin port", cfg.Port)
+	}
+	return cfg.Health.Validate()
+}
+
+// mux serving all admin endpoints,
+// serving the metrics in the Prometheus (/metrics) and expvar (/debug/vars) format,
+// the liveness (/healthz) and readiness (/readyz) endpoints,
+// as well as the log level (/log/level), which can be changed at runtime, by default
+var mux = http.NewServeMux()
+
+// Handle registers an additional admin endpoint,
+// should be called prior to Serve
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Serve the admin endpoints in the background, on the port given by the config,
+// until a shutdown signal is received. Nothing is served if no port was given.
+// The listener is opened right away, returning an error in case it can't be,
+// while errors serving the endpoints are only logged, as they're not essential.
+func Serve(cfg *Config, shutdownCfg *shutdown.Config) error {
+	if cfg.Port == 0 {
+		log.Infof("no admin port given, admin endpoints are disabled")
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		return fmt.Errorf("couldn't listen to admin port %d: %q", cfg.Port, err)
+	}
+	health.Handle(mux, cfg.Health)
+	server := &http.Server{Handler: mux}
+	go func() {
+		log.Infof("admin endpoints listening to port %d", cfg.Port)
+		if err := shutdown.Serve(server, listener, shutdownCfg); err != nil {
+			log.Errorf("couldn't serve admin endpoints: %q", err)
+		}
+	}()
+	return nil
+}
+
+func init() {
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/log/level", log.LevelHandler())
+}
@@ -0,0 +1,330 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// Authorization schemes supported by Keys.Authenticate
+const (
+	// SchemeBearer sends the secret of a key as-is:
+	//   Authorization: Bearer <secret>
+	SchemeBearer = "Bearer"
+	// SchemeHMAC signs the request using the secret of a key:
+	//   Authorization: HMAC-SHA256 keyId=<id>,timestamp=<unix seconds>,signature=<hex>
+	// where the signature is the HMAC-SHA256 of "<timestamp>\n<method>\n<path>\n<body>"
+	SchemeHMAC = "HMAC-SHA256"
+)
+
+// Authentication errors
+var (
+	ErrMissingCredentials = errors.New("no API key given")
+	ErrInvalidKey         = errors.New("invalid API key")
+	ErrInvalidSignature   = errors.New("invalid request signature")
+	ErrExpiredSignature   = errors.New("request signature expired")
+	ErrReplayedSignature  = errors.New("request signature was used before")
+)
+
+// Key is an API key, allowed to post events for a set of usernames and metrics.
+// An empty set (or a set containing "*") allows all usernames or metrics.
+// All events posted (or metrics queried) with a key belong to its tenant,
+// which is the default tenant in case none is given.
+type Key struct {
+	ID        string   `json:"id"`
+	Secret    string   `json:"secret"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Usernames []string `json:"usernames,omitempty"`
+	Metrics   []string `json:"metrics,omitempty"`
+}
+
+// TenantName returns the tenant this key belongs to
+func (k *Key) TenantName() string {
+	if k.Tenant == "" {
+		return pkg.DefaultTenant
+	}
+	return k.Tenant
+}
+
+// Allows returns an error in case this key
+// isn't allowed to post events for the given username and metric
+func (k *Key) Allows(username, metric string) error {
+	if !contains(k.Usernames, username) {
+		return fmt.Errorf("API key %q isn't allowed to post events for username %q", k.ID, username)
+	}
+	if !contains(k.Metrics, metric) {
+		return fmt.Errorf("API key %q isn't allowed to post events for metric %q", k.ID, metric)
+	}
+	return nil
+}
+
+// contains returns true if the set allows the given value
+func contains(set []string, value string) bool {
+	if len(set) == 0 {
+		return true
+	}
+	for _, allowed := range set {
+		if allowed == "*" || allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// tenants are used as part of storage keys and names by the workers,
+// hence they're restricted to the same pattern as the tenant property of the event schema
+const reTenant = `^[a-z][a-z0-9_]{0,31}$`
+
+var rexTenant = regexp.MustCompile(reTenant)
+
+// keysFile is the structure of a keys file
+type keysFile struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Load the API keys from the JSON file found at the given path.
+// Signed requests are only accepted within the given maximum skew of their timestamp.
+func Load(path string, maxSkew time.Duration) (*Keys, error) {
+	keys := &Keys{
+		path:    path,
+		maxSkew: maxSkew,
+		used:    make(map[string]time.Time),
+	}
+	if err := keys.load(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Keys is a set of API keys, loaded from a keys file
+type Keys struct {
+	path    string
+	maxSkew time.Duration
+
+	mtx      sync.RWMutex
+	byID     map[string]*Key
+	bySecret map[string]*Key // keyed by the SHA-256 hash of the secret
+	modTime  time.Time
+
+	// signatures used within the skew window, to prevent replays
+	usedMtx   sync.Mutex
+	used      map[string]time.Time
+	lastSweep time.Time
+}
+
+// load (or reload) the keys file
+func (keys *Keys) load() error {
+	info, err := os.Stat(keys.path)
+	if err != nil {
+		return fmt.Errorf("couldn't stat keys file: %q", err)
+	}
+	data, err := ioutil.ReadFile(keys.path)
+	if err != nil {
+		return fmt.Errorf("couldn't read keys file: %q", err)
+	}
+
+	var file keysFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("couldn't decode keys file: %q", err)
+	}
+
+	byID := make(map[string]*Key, len(file.Keys))
+	bySecret := make(map[string]*Key, len(file.Keys))
+	for index, key := range file.Keys {
+		if key == nil || key.ID == "" || key.Secret == "" {
+			return fmt.Errorf("key %d of keys file has no ID or secret", index)
+		}
+		if key.Tenant != "" && !rexTenant.MatchString(key.Tenant) {
+			return fmt.Errorf("key %q has an invalid tenant %q, expected it to match regexp(%q)",
+				key.ID, key.Tenant, reTenant)
+		}
+		if _, ok := byID[key.ID]; ok {
+			return fmt.Errorf("key %q is defined more than once", key.ID)
+		}
+		byID[key.ID] = key
+		bySecret[hashSecret(key.Secret)] = key
+	}
+
+	keys.mtx.Lock()
+	keys.byID, keys.bySecret, keys.modTime = byID, bySecret, info.ModTime()
+	keys.mtx.Unlock()
+
+	log.Infof("loaded %d API keys from %s", len(byID), keys.path)
+	return nil
+}
+
+// Reload the keys file, in case it was modified since it was last loaded.
+// The previously loaded keys are kept in case the file is invalid.
+func (keys *Keys) Reload() error {
+	info, err := os.Stat(keys.path)
+	if err != nil {
+		return fmt.Errorf("couldn't stat keys file: %q", err)
+	}
+
+	keys.mtx.RLock()
+	modified := !info.ModTime().Equal(keys.modTime)
+	keys.mtx.RUnlock()
+	if !modified {
+		return nil
+	}
+	return keys.load()
+}
+
+// Watch the keys file, reloading it every interval in case it was modified,
+// until the given stop channel is closed
+func (keys *Keys) Watch(interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if err := keys.Reload(); err != nil {
+			log.Warningf("couldn't reload API keys: %q", err)
+		}
+	}
+}
+
+// IsSigned returns true if the request is authenticated using a signature,
+// in which case the body is required to authenticate it
+func IsSigned(r *http.Request) bool {
+	scheme, _ := splitAuthorization(r)
+	return scheme == SchemeHMAC
+}
+
+// Authenticate a request, returning the key it was made with.
+// The (raw) body is only required for signed requests.
+func (keys *Keys) Authenticate(r *http.Request, body []byte) (*Key, error) {
+	scheme, credentials := splitAuthorization(r)
+	switch scheme {
+	case "":
+		return nil, ErrMissingCredentials
+
+	case SchemeBearer:
+		keys.mtx.RLock()
+		key, ok := keys.bySecret[hashSecret(credentials)]
+		keys.mtx.RUnlock()
+		if !ok {
+			return nil, ErrInvalidKey
+		}
+		return key, nil
+
+	case SchemeHMAC:
+		return keys.authenticateSignature(r, credentials, body)
+	}
+
+	return nil, fmt.Errorf("unsupported authorization scheme %q, expected %s or %s",
+		scheme, SchemeBearer, SchemeHMAC)
+}
+
+// authenticateSignature authenticates a signed request
+func (keys *Keys) authenticateSignature(r *http.Request, credentials string, body []byte) (*Key, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Split(credentials, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			return nil, ErrInvalidSignature
+		}
+		params[parts[0]] = parts[1]
+	}
+
+	keys.mtx.RLock()
+	key, ok := keys.byID[params["keyId"]]
+	keys.mtx.RUnlock()
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	signature, err := hex.DecodeString(params["signature"])
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	if !hmac.Equal(signature, Sign(key.Secret, timestamp, r.Method, r.URL.Path, body)) {
+		return nil, ErrInvalidSignature
+	}
+
+	// only check the timestamp once the signature is verified,
+	// as it can't be trusted before that
+	now := time.Now()
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-keys.maxSkew)) || signedAt.After(now.Add(keys.maxSkew)) {
+		return nil, ErrExpiredSignature
+	}
+	// remember the decoded signature, as its hex encoding isn't unique (e.g. upper case)
+	if !keys.use(hex.EncodeToString(signature), signedAt) {
+		return nil, ErrReplayedSignature
+	}
+
+	return key, nil
+}
+
+// use a signature, returning false in case it was used before.
+// Signatures are remembered as long as their timestamp is within the skew window.
+func (keys *Keys) use(signature string, signedAt time.Time) bool {
+	keys.usedMtx.Lock()
+	defer keys.usedMtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(keys.lastSweep) >= keys.maxSkew {
+		for used, at := range keys.used {
+			if now.Sub(at) > keys.maxSkew {
+				delete(keys.used, used)
+			}
+		}
+		keys.lastSweep = now
+	}
+
+	if _, ok := keys.used[signature]; ok {
+		return false
+	}
+	keys.used[signature] = signedAt
+	return true
+}
+
+// Sign a request, returning the HMAC-SHA256 signature
+// of its timestamp, method, path and (raw) body
+func Sign(secret string, timestamp int64, method, path string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, path)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// splitAuthorization splits the authorization header in its scheme and credentials
+func splitAuthorization(r *http.Request) (string, string) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// hashSecret hashes a secret, such that secrets can be looked up
+// without comparing them directly, which would leak timing information
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
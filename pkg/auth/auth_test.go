@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKeys = `{
+  "keys": [
+    {"id": "koding", "secret": "s3cret", "tenant": "koding"},
+    {"id": "other", "secret": "0ther"}
+  ]
+}`
+
+// loadTestKeys loads the test keys from a temporary keys file
+func loadTestKeys(t *testing.T) *Keys {
+	file, err := ioutil.TempFile("", "keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.WriteString(testKeys); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	keys, err := Load(file.Name(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func newRequest(authorization string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://localhost:3000/events", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func signature(secret string, timestamp int64, body []byte) string {
+	return hex.EncodeToString(Sign(secret, timestamp, "POST", "/events", body))
+}
+
+func hmacAuthorization(id string, timestamp int64, signature string) string {
+	return fmt.Sprintf("%s keyId=%s,timestamp=%d,signature=%s", SchemeHMAC, id, timestamp, signature)
+}
+
+func TestSign(t *testing.T) {
+	testCases := []struct {
+		method, path, body string
+		expected           string
+	}{
+		{"POST", "/events", `{"metric":"kite_call"}`,
+			"093eb0d7e87f067dc92d89d58d5fbc27299056032ff497017ef88291cd5c8a16"},
+		{"GET", "/metrics/hourly_logs/total", "",
+			"5e29bc5186829ca261e848254db2dfd34ada0d58daea10c77e4cabd69ea0ada8"},
+	}
+	for _, tc := range testCases {
+		signature := hex.EncodeToString(Sign("s3cret", 1500000000, tc.method, tc.path, []byte(tc.body)))
+		if signature != tc.expected {
+			t.Errorf("%s %s: expected signature %s, got %s", tc.method, tc.path, tc.expected, signature)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := loadTestKeys(t)
+	body := []byte(`{"metric":"kite_call"}`)
+	now := time.Now().Unix()
+
+	testCases := []struct {
+		name          string
+		authorization string
+		body          []byte
+		key           string
+		err           error
+	}{
+		{"missing", "", nil, "", ErrMissingCredentials},
+		{"bearer", "Bearer s3cret", nil, "koding", nil},
+		{"bearer invalid", "Bearer secret", nil, "", ErrInvalidKey},
+		{"hmac", hmacAuthorization("koding", now, signature("s3cret", now, body)), body, "koding", nil},
+		{"hmac unknown key", hmacAuthorization("unknown", now, signature("s3cret", now, body)), body, "", ErrInvalidKey},
+		{"hmac other secret", hmacAuthorization("koding", now, signature("0ther", now, body)),
+			body, "", ErrInvalidSignature},
+		{"hmac other body", hmacAuthorization("koding", now, signature("s3cret", now, body)),
+			[]byte(`{}`), "", ErrInvalidSignature},
+		{"hmac invalid hex", hmacAuthorization("koding", now, "xyz"), body, "", ErrInvalidSignature},
+		{"hmac invalid timestamp", "HMAC-SHA256 keyId=koding,timestamp=now,signature=00", body, "", ErrInvalidSignature},
+		{"hmac malformed", "HMAC-SHA256 keyId=koding,signature", body, "", ErrInvalidSignature},
+		{"hmac expired", hmacAuthorization("koding", now-3600, signature("s3cret", now-3600, body)),
+			body, "", ErrExpiredSignature},
+		{"hmac future", hmacAuthorization("koding", now+3600, signature("s3cret", now+3600, body)),
+			body, "", ErrExpiredSignature},
+	}
+	for _, tc := range testCases {
+		key, err := keys.Authenticate(newRequest(tc.authorization), tc.body)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if tc.key == "" {
+			if key != nil {
+				t.Errorf("%s: expected no key, got %q", tc.name, key.ID)
+			}
+			continue
+		}
+		if key == nil || key.ID != tc.key {
+			t.Errorf("%s: expected key %q, got %v", tc.name, tc.key, key)
+		}
+	}
+
+	_, err := keys.Authenticate(newRequest("Basic a29kaW5nOnMzY3JldA=="), nil)
+	if err == nil {
+		t.Error("expected an unsupported scheme to be refused")
+	}
+}
+
+func TestAuthenticateReplay(t *testing.T) {
+	keys := loadTestKeys(t)
+	body := []byte(`{"metric":"kite_call"}`)
+	now := time.Now().Unix()
+	sig := signature("s3cret", now, body)
+
+	testCases := []struct {
+		name      string
+		signature string
+		err       error
+	}{
+		{"first use", sig, nil},
+		{"replay", sig, ErrReplayedSignature},
+		{"replay upper case", strings.ToUpper(sig), ErrReplayedSignature},
+		{"replay mixed case", strings.ToUpper(sig[:8]) + sig[8:], ErrReplayedSignature},
+	}
+	for _, tc := range testCases {
+		_, err := keys.Authenticate(newRequest(hmacAuthorization("koding", now, tc.signature)), body)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// the same body signed at another time is a different request
+	other := signature("s3cret", now-1, body)
+	if _, err := keys.Authenticate(newRequest(hmacAuthorization("koding", now-1, other)), body); err != nil {
+		t.Errorf("expected a request with another timestamp to be accepted, got %v", err)
+	}
+}
+
+func TestKeyAllows(t *testing.T) {
+	testCases := []struct {
+		key              Key
+		username, metric string
+		allowed          bool
+	}{
+		{Key{ID: "all"}, "kodingbot", "kite_call", true},
+		{Key{ID: "wildcard", Usernames: []string{"*"}, Metrics: []string{"*"}}, "kodingbot", "kite_call", true},
+		{Key{ID: "user", Usernames: []string{"kodingbot"}}, "kodingbot", "kite_call", true},
+		{Key{ID: "user", Usernames: []string{"kodingbot"}}, "glendc", "kite_call", false},
+		{Key{ID: "metric", Metrics: []string{"kite_call"}}, "kodingbot", "kite_call", true},
+		{Key{ID: "metric", Metrics: []string{"kite_call"}}, "kodingbot", "kite_exit", false},
+	}
+	for _, tc := range testCases {
+		err := tc.key.Allows(tc.username, tc.metric)
+		if allowed := err == nil; allowed != tc.allowed {
+			t.Errorf("key %q, %s/%s: expected allowed=%v, got %v", tc.key.ID, tc.username, tc.metric,
+				tc.allowed, err)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	testCases := []string{
+		`{"keys": [{"id": "koding"}]}`,
+		`{"keys": [{"id": "koding", "secret": "a"}, {"id": "koding", "secret": "b"}]}`,
+		`{"keys": [{"id": "koding", "secret": "a", "tenant": "Koding"}]}`,
+		`{"keys": `,
+	}
+	for _, data := range testCases {
+		file, err := ioutil.TempFile("", "keys-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(data)
+		file.Close()
+		if _, err = Load(file.Name(), time.Minute); err == nil {
+			t.Errorf("expected keys file %s to be invalid", data)
+		}
+		os.Remove(file.Name())
+	}
+}
@@ -0,0 +1,257 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fileValue is a single value of a configuration file,
+// a list in case it was given as an array
+type fileValue struct {
+	values []string
+	list   bool
+	line   int
+}
+
+// parseTOML parses the subset of TOML used by configuration files:
+// tables, (dotted) keys, strings, integers, floats, booleans and arrays of those.
+// Keys are flattened into flag names, prefixed by the table they're defined in,
+// e.g. "file" within the "[trace]" table becomes "trace-file".
+// More information: https://toml.io/en/v1.0.0
+func parseTOML(data string) (map[string]fileValue, error) {
+	p := &tomlParser{data: data, line: 1}
+	values := make(map[string]fileValue)
+	var table []string
+
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return values, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			if !p.eof() && p.peek() == '[' {
+				return nil, p.errorf("arrays of tables aren't supported")
+			}
+			var err error
+			if table, err = p.parseKey(); err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !p.consume(']') {
+				return nil, p.errorf("expected ] to close the table header")
+			}
+		} else {
+			key, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace(false)
+			if !p.consume('=') {
+				return nil, p.errorf("expected = after key %q", strings.Join(key, "."))
+			}
+			line := p.line
+			p.skipSpace(false)
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			value.line = line
+
+			name := strings.Join(append(append([]string{}, table...), key...), "-")
+			if _, ok := values[name]; ok {
+				return nil, p.errorf("%q is defined more than once", name)
+			}
+			values[name] = value
+		}
+
+		// only a comment can follow on the same line
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' {
+			return nil, p.errorf("unexpected %q, expected a new line", p.peek())
+		}
+	}
+}
+
+// tomlParser keeps track of the position within the parsed data
+type tomlParser struct {
+	data string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.data[p.pos]
+}
+
+// consume the given character, returning false in case it's not the next one
+func (p *tomlParser) consume(c byte) bool {
+	if p.eof() || p.peek() != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips whitespace and comments, as well as new lines if allowed
+func (p *tomlParser) skipSpace(newLines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newLines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// parseKey parses a (dotted) key, consisting of bare and/or quoted parts
+func (p *tomlParser) parseKey() ([]string, error) {
+	var parts []string
+	for {
+		p.skipSpace(false)
+		if p.eof() {
+			return nil, p.errorf("expected a key")
+		}
+
+		var part string
+		switch p.peek() {
+		case '"', '\'':
+			var err error
+			if part, err = p.parseString(); err != nil {
+				return nil, err
+			}
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if part = p.data[start:p.pos]; part == "" {
+				return nil, p.errorf("unexpected %q, expected a key", p.peek())
+			}
+		}
+		parts = append(parts, part)
+
+		p.skipSpace(false)
+		if !p.consume('.') {
+			return parts, nil
+		}
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseValue parses a single value, or an array of values
+func (p *tomlParser) parseValue() (fileValue, error) {
+	if p.eof() {
+		return fileValue{}, p.errorf("expected a value")
+	}
+
+	switch p.peek() {
+	case '[':
+		p.pos++
+		value := fileValue{list: true}
+		for {
+			p.skipSpace(true)
+			if p.consume(']') {
+				return value, nil
+			}
+			if p.eof() {
+				return fileValue{}, p.errorf("expected ] to close the array")
+			}
+			if p.peek() == '[' {
+				return fileValue{}, p.errorf("nested arrays aren't supported")
+			}
+			item, err := p.parseValue()
+			if err != nil {
+				return fileValue{}, err
+			}
+			value.values = append(value.values, item.values...)
+
+			p.skipSpace(true)
+			if !p.consume(',') && (p.eof() || p.peek() != ']') {
+				return fileValue{}, p.errorf("expected , or ] within the array")
+			}
+		}
+	case '{':
+		return fileValue{}, p.errorf("inline tables aren't supported")
+	case '"', '\'':
+		s, err := p.parseString()
+		if err != nil {
+			return fileValue{}, err
+		}
+		return fileValue{values: []string{s}}, nil
+	}
+
+	// bare values: booleans and numbers
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]#", rune(p.peek())) {
+		p.pos++
+	}
+	raw := p.data[start:p.pos]
+	if raw == "true" || raw == "false" {
+		return fileValue{values: []string{raw}}, nil
+	}
+	number := strings.Replace(raw, "_", "", -1)
+	if _, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return fileValue{values: []string{number}}, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return fileValue{values: []string{number}}, nil
+	}
+	return fileValue{}, p.errorf("invalid value %q, strings have to be quoted", raw)
+}
+
+// parseString parses a basic ("...") or literal ('...') single-line string
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.data[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings aren't supported")
+	}
+
+	start := p.pos
+	p.pos++
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		if c == '\\' && quote == '"' {
+			p.pos++ // skip the escaped character
+			continue
+		}
+		if c == quote {
+			break
+		}
+	}
+
+	raw := p.data[start:p.pos]
+	if quote == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	s, err := strconv.Unquote(raw)
+	if err != nil {
+		return "", p.errorf("invalid string %s", raw)
+	}
+	return s, nil
+}
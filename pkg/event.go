@@ -1,24 +1,92 @@
 package pkg
 
-import "errors"
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+)
+
+//go:generate go run gen_event_schema.go
+
+// schema used to validate events,
+// set by LoadEventSchema, using the default schema until then
+var eventSchema = schema.MustParse([]byte(DefaultEventSchema))
+
+// RegisterEventSchemaFlag binds the given path to the event-schema flag of the given flag set,
+// the path of the schema file loaded by LoadEventSchema
+func RegisterEventSchemaFlag(fs *flag.FlagSet, path *string) {
+	fs.StringVar(path, "event-schema", "",
+		"JSON Schema file used to validate events (uses the builtin schema if not given)")
+}
+
+// LoadEventSchema loads the JSON Schema used to validate events,
+// from the given file, if one was given (see RegisterEventSchemaFlag).
+// Should be called once at startup, prior to validating any event.
+func LoadEventSchema(path string) error {
+	if path == "" {
+		return nil // keep using the default schema
+	}
+	s, err := schema.Load(path)
+	if err != nil {
+		return err
+	}
+	eventSchema = s
+	return nil
+}
+
+// EventSchema returns the JSON Schema used to validate events
+func EventSchema() *schema.Schema {
+	return eventSchema
+}
 
 // Properties of event as used in their serialized form
 const (
+	EventIDID        = "id"
 	EventUsernameID  = "username"
 	EventTimestampID = "timestamp"
 	EventMetricID    = "metric"
 	EventCountID     = "count"
+	// time (in seconds) the event was received by the metric collector,
+	// which can differ from the timestamp, as the latter can be client-supplied
+	EventReceivedAtID = "receivedAt"
+	// tenant owning the event, derived from the API key it was posted with
+	EventTenantID = "tenant"
 )
 
+// DefaultTenant owns all events posted without authentication
+// (or with an API key that isn't bound to a tenant),
+// as well as events that were dispatched prior to tenants being introduced
+const DefaultTenant = "default"
+
 // Event represents the data as passed through the metric collector-service
 type Event struct {
+	// unique identifier of the event, used to process an event only once,
+	// optional, as it wasn't always part of the event
+	ID        *string `json:"id,omitempty" bson:"id,omitempty"`
 	Username  *string `json:"username" bson:"username"`
 	Timestamp *int64  `json:"timestamp" bson:"timestamp"`
 	Metric    *string `json:"metric" bson:"metric"`
 	Count     *int64  `json:"count" bson:"count"`
+	// optional, as it wasn't always part of the event
+	ReceivedAt *int64 `json:"receivedAt,omitempty" bson:"receivedAt,omitempty"`
+	// set by the metric collector, never by the client,
+	// optional, as it wasn't always part of the event
+	Tenant *string `json:"tenant,omitempty" bson:"tenant,omitempty"`
 }
 
-// Validate if all required properties are present in this event
+// TenantName returns the tenant owning this event,
+// which is the default tenant in case none is set
+func (e *Event) TenantName() string {
+	if e.Tenant == nil || *e.Tenant == "" {
+		return DefaultTenant
+	}
+	return *e.Tenant
+}
+
+// Validate if all required properties are present in this event,
+// and if all its properties are valid according to the event schema
 func (e *Event) Validate() error {
 	if e.Username == nil {
 		return errors.New(`required username property is not present`)
@@ -33,5 +101,93 @@ func (e *Event) Validate() error {
 		return errors.New(`required count property is not present`)
 	}
 
+	return eventSchema.Validate(e.Fields())
+}
+
+// Fields returns all properties present in this event,
+// mapped by the name they use in their serialized form
+func (e *Event) Fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	if e.ID != nil {
+		fields[EventIDID] = *e.ID
+	}
+	if e.Username != nil {
+		fields[EventUsernameID] = *e.Username
+	}
+	if e.Timestamp != nil {
+		fields[EventTimestampID] = *e.Timestamp
+	}
+	if e.Metric != nil {
+		fields[EventMetricID] = *e.Metric
+	}
+	if e.Count != nil {
+		fields[EventCountID] = *e.Count
+	}
+	if e.ReceivedAt != nil {
+		fields[EventReceivedAtID] = *e.ReceivedAt
+	}
+	if e.Tenant != nil {
+		fields[EventTenantID] = *e.Tenant
+	}
+	return fields
+}
+
+// SetFields sets the properties of this event from the given fields,
+// mapped by the name they use in their serialized form.
+// Integer properties can be given as any signed or unsigned integer type,
+// unknown fields are ignored.
+func (e *Event) SetFields(fields map[string]interface{}) error {
+	for name, value := range fields {
+		var err error
+		switch name {
+		case EventIDID:
+			e.ID, err = stringField(name, value)
+		case EventUsernameID:
+			e.Username, err = stringField(name, value)
+		case EventMetricID:
+			e.Metric, err = stringField(name, value)
+		case EventTimestampID:
+			e.Timestamp, err = intField(name, value)
+		case EventCountID:
+			e.Count, err = intField(name, value)
+		case EventReceivedAtID:
+			e.ReceivedAt, err = intField(name, value)
+		case EventTenantID:
+			e.Tenant, err = stringField(name, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+func stringField(name string, value interface{}) (*string, error) {
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s property has to be a string, got %T", name, value)
+	}
+	return &str, nil
+}
+
+func intField(name string, value interface{}) (*int64, error) {
+	var i int64
+	switch v := value.(type) {
+	case int64:
+		i = v
+	case int:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case uint64:
+		if v > 1<<63-1 {
+			return nil, fmt.Errorf("%s property overflows a 64-bit integer", name)
+		}
+		i = int64(v)
+	default:
+		return nil, fmt.Errorf("%s property has to be an integer, got %T", name, value)
+	}
+	return &i, nil
+}
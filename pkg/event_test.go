@@ -0,0 +1,22 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/schema"
+)
+
+func TestDefaultEventSchemaIsGenerated(t *testing.T) {
+	data, err := ioutil.ReadFile("../schema/event.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(data), []byte(DefaultEventSchema)) {
+		t.Fatal("DefaultEventSchema differs from schema/event.json, run go generate ./pkg")
+	}
+	if _, err = schema.Load("../schema/event.json"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+//go:build ignore
+// +build ignore
+
+// Generates event_schema.go from ../schema/event.json,
+// such that the builtin event schema is always identical to the schema file.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+)
+
+func main() {
+	data, err := ioutil.ReadFile("../schema/event.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if bytes.ContainsRune(data, '`') {
+		log.Fatal("event schema can't contain backquotes")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "// Code generated by gen_event_schema.go from schema/event.json; DO NOT EDIT.")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "package pkg")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "// DefaultEventSchema is the JSON Schema used to validate events,")
+	fmt.Fprintln(&buf, "// in case no schema file was given, generated from schema/event.json")
+	fmt.Fprintf(&buf, "const DefaultEventSchema = `%s`\n", bytes.TrimSpace(data))
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile("event_schema.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package health
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/shutdown"
+)
+
+// Config is used to configure the readiness checks
+type Config struct {
+	// maximum time a single check is allowed to take
+	Timeout time.Duration
+}
+
+// DefaultConfig creates a health config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{Timeout: time.Second * 2}
+}
+
+// RegisterFlags binds the properties of this config to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&cfg.Timeout, "health-timeout", cfg.Timeout,
+		"maximum time a single readiness check (of AMQP or a backing store) is allowed to take")
+}
+
+// Validate the Config properties
+func (cfg *Config) Validate() error {
+	if cfg.Timeout <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid health timeout, should be a positive duration", cfg.Timeout)
+	}
+	return nil
+}
+
+// Check the health of a single dependency (e.g. AMQP or a backing store),
+// returning an error in case it can't be used
+type Check func() error
+
+// registered checks, run (concurrently) on each readiness request
+var checks struct {
+	mtx    sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+// Register a check of a dependency, using the name it is reported by,
+// replacing any check registered earlier using that same name
+func Register(name string, check Check) {
+	checks.mtx.Lock()
+	defer checks.mtx.Unlock()
+	if checks.checks == nil {
+		checks.checks = make(map[string]Check)
+	}
+	if _, ok := checks.checks[name]; !ok {
+		checks.names = append(checks.names, name)
+	}
+	checks.checks[name] = check
+}
+
+// Handle registers the liveness (/healthz) and readiness (/readyz) endpoints on the given mux,
+// running the readiness checks using the given config
+func Handle(mux *http.ServeMux, cfg *Config) {
+	mux.HandleFunc("/healthz", serveLiveness)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadiness(w, r, cfg)
+	})
+}
+
+// Check statuses
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+	StatusTimeout = "timeout"
+)
+
+// Result of a single check
+type Result struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency"` // in seconds
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report of all checks, as served by the readiness endpoint
+type Report struct {
+	Ready        bool              `json:"ready"`
+	ShuttingDown bool              `json:"shuttingDown"`
+	Checks       map[string]Result `json:"checks"`
+}
+
+// Run all registered checks concurrently, each limited by the health timeout.
+// Not ready while shutting down, in which case the checks aren't run at all.
+func Run(cfg *Config) *Report {
+	select {
+	case <-shutdown.Signal():
+		return &Report{ShuttingDown: true, Checks: map[string]Result{}}
+	default:
+	}
+
+	checks.mtx.Lock()
+	names := make([]string, len(checks.names))
+	copy(names, checks.names)
+	fns := make([]Check, len(names))
+	for index, name := range names {
+		fns[index] = checks.checks[name]
+	}
+	checks.mtx.Unlock()
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	for index := range fns {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			results[index] = run(fns[index], cfg.Timeout)
+		}(index)
+	}
+	wg.Wait()
+
+	report := &Report{Ready: true, Checks: make(map[string]Result, len(names))}
+	for index, name := range names {
+		report.Checks[name] = results[index]
+		if results[index].Status != StatusOK {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+// run a single check, giving up on it once the given timeout has passed,
+// the check itself keeps running in the background until it returns
+func run(check Check, timeout time.Duration) Result {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		result := Result{Status: StatusOK, Latency: time.Since(start).Seconds()}
+		if err != nil {
+			result.Status, result.Error = StatusFailing, err.Error()
+		}
+		return result
+	case <-timer.C:
+		return Result{
+			Status:  StatusTimeout,
+			Latency: time.Since(start).Seconds(),
+			Error:   fmt.Sprintf("check didn't finish within %v", timeout),
+		}
+	}
+}
+
+// serveLiveness reports that the process is up and able to serve requests,
+// dependencies aren't checked, as a restart wouldn't fix them
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// serveReadiness runs all checks, responding with a 503 in case
+// any of them failed or the process is shutting down
+func serveReadiness(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	report := Run(cfg)
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
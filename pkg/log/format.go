@@ -0,0 +1,114 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry is a single message, as it is encoded
+type entry struct {
+	time    time.Time
+	level   Level
+	caller  string
+	message string
+	fields  []field
+}
+
+// encoder encodes an entry as a single line
+type encoder func(e *entry) []byte
+
+// encoders of all supported formats
+var encoders = map[string]encoder{
+	"logfmt": encodeLogfmt,
+	"json":   encodeJSON,
+}
+
+// encodeLogfmt encodes an entry as key=value pairs,
+// e.g. time=2017-04-01T12:00:00Z level=info caller=rpc/amqp.go:42 msg="dialing AMQP" component=merger
+func encodeLogfmt(e *entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("time=")
+	buf.WriteString(e.time.Format(time.RFC3339Nano))
+	buf.WriteString(" level=")
+	buf.WriteString(e.level.String())
+	if e.caller != "" {
+		buf.WriteString(" caller=")
+		buf.WriteString(logfmtValue(e.caller))
+	}
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(e.message))
+	for _, f := range e.fields {
+		buf.WriteByte(' ')
+		buf.WriteString(logfmtKey(f.key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(f.value)))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// logfmtKey strips all characters that aren't allowed in a key
+func logfmtKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+	if key == "" {
+		return "_"
+	}
+	return key
+}
+
+// logfmtValue quotes a value in case it is empty or contains spaces, quotes or equal signs
+func logfmtValue(value string) string {
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"'
+	}) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// encodeJSON encodes an entry as a JSON object,
+// e.g. {"time":"2017-04-01T12:00:00Z","level":"info","caller":"rpc/amqp.go:42","msg":"dialing AMQP"}
+func encodeJSON(e *entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, e.time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, e.level.String())
+	if e.caller != "" {
+		buf.WriteString(`,"caller":`)
+		writeJSON(&buf, e.caller)
+	}
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, e.message)
+	for _, f := range e.fields {
+		buf.WriteByte(',')
+		writeJSON(&buf, f.key)
+		buf.WriteByte(':')
+		value := f.value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJSON(&buf, value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// writeJSON writes a value as JSON, falling back to its string representation
+// in case it can't be marshalled
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		bytes, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(bytes)
+}
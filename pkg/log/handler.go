@@ -0,0 +1,35 @@
+package log
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LevelHandler reports the current level (GET),
+// and changes it at runtime (PUT or POST, e.g. ?level=debug)
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			lvl, err := ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if lvl == LevelFatal {
+				http.Error(w, "fatal messages can't be the minimum level", http.StatusBadRequest)
+				return
+			}
+			SetLevel(lvl)
+			Warningf("log level changed to %s", lvl)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"level":%q}`, GetLevel())
+	})
+}
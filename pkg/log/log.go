@@ -3,49 +3,257 @@ package log
 import (
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Logger specific flags
-// see: init function for more information about each flag
-var (
-	debug bool
+// Config is used to configure the level and format of all loggers
+type Config struct {
+	// log debug messages, regardless of the level
+	Debug  bool
+	Level  string
+	Format string
+}
+
+// DefaultConfig creates a logger config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{
+		Debug:  os.Getenv("DEBUG") != "",
+		Level:  "info",
+		Format: "logfmt",
+	}
+}
+
+// RegisterFlags binds the properties of this config to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug,
+		"allow for verbose logging, same as --log-level debug (DEBUG env can be used as well)")
+	fs.StringVar(&cfg.Level, "log-level", cfg.Level,
+		"minimum level of logged messages (debug, info, warning or error), can be changed at runtime")
+	fs.StringVar(&cfg.Format, "log-format", cfg.Format,
+		"format of logged messages (logfmt or json)")
+}
+
+// Level of a log message, messages below the current level are discarded
+type Level int32
+
+// All supported levels, from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
 )
 
-// Infof logs info messages in verbose mode (debug-only)
-func Infof(format string, args ...interface{}) {
-	if !debug {
-		return // only in debug mode
+// levelNames are the names levels are parsed from and reported as
+var levelNames = []string{"debug", "info", "warning", "error", "fatal"}
+
+// String returns the name of the level
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return fmt.Sprintf("level(%d)", int32(l))
 	}
+	return levelNames[l]
+}
 
-	log.Printf(message("INFO", format), args...)
+// ParseLevel parses a level from its name (e.g. "warning")
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "warn" {
+		return LevelWarning, nil
+	}
+	for index, levelName := range levelNames {
+		if name == levelName {
+			return Level(index), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %v", name, levelNames)
 }
 
-// Warningf logs an error that can be recovered from (debug-only)
-func Warningf(format string, args ...interface{}) {
-	if !debug {
-		return // only in debug mode
+// current level, accessed atomically as it can be changed at runtime
+var currentLevel = int32(LevelInfo)
+
+// SetLevel changes the level of all loggers at runtime
+func SetLevel(l Level) {
+	atomic.StoreInt32(&currentLevel, int32(l))
+}
+
+// GetLevel returns the current level of all loggers
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&currentLevel))
+}
+
+// Enabled returns true if messages of the given level are logged
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// Logger logs leveled messages, annotated with its key/value fields.
+// Child loggers can be created using With, the zero value logs without fields.
+type Logger struct {
+	fields []field
+}
+
+// field is a single key/value pair of a logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+// std is the root logger, used by the package-level functions
+var std = new(Logger)
+
+// With creates a child logger of the root logger, annotated with the given key/value pairs
+// e.g. log.With("component", "merger")
+func With(keyvals ...interface{}) *Logger {
+	return std.With(keyvals...)
+}
+
+// With creates a child logger, annotated with the fields of this logger,
+// as well as the given key/value pairs
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+(len(keyvals)+1)/2)
+	copy(fields, l.fields)
+	for index := 0; index < len(keyvals); index += 2 {
+		key := fmt.Sprint(keyvals[index])
+		var value interface{} = "(missing)"
+		if index+1 < len(keyvals) {
+			value = keyvals[index+1]
+		}
+		fields = append(fields, field{key: key, value: value})
 	}
+	return &Logger{fields: fields}
+}
+
+// Debugf logs verbose messages, only useful when debugging
+func Debugf(format string, args ...interface{}) {
+	std.logf(LevelDebug, format, args...)
+}
+
+// Infof logs informational messages
+func Infof(format string, args ...interface{}) {
+	std.logf(LevelInfo, format, args...)
+}
 
-	log.Printf(message("WARNING", format), args...)
+// Warningf logs an error that can be recovered from
+func Warningf(format string, args ...interface{}) {
+	std.logf(LevelWarning, format, args...)
 }
 
-// Errorf logs an error that can't be recovered from and thus is fatal
+// Errorf logs an error that couldn't be recovered from,
+// without exiting the process (see Fatalf)
 func Errorf(format string, args ...interface{}) {
-	log.Fatalf(message("ERROR", format), args...)
+	std.logf(LevelError, format, args...)
+}
+
+// Fatalf logs an error that is fatal, and exits the process
+func Fatalf(format string, args ...interface{}) {
+	std.logf(LevelFatal, format, args...)
+	os.Exit(1)
+}
+
+// Debugf logs verbose messages, only useful when debugging
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs informational messages
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warningf logs an error that can be recovered from
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.logf(LevelWarning, format, args...)
+}
+
+// Errorf logs an error that couldn't be recovered from,
+// without exiting the process (see Fatalf)
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Fatalf logs an error that is fatal, and exits the process
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(LevelFatal, format, args...)
+	os.Exit(1)
+}
+
+// output to which all messages are written, using the configured format
+var output struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	encoder encoder
+}
+
+// logf formats and writes a message, in case its level is enabled,
+// should only be called by the exported log functions, as it reports their caller
+func (l *Logger) logf(lvl Level, format string, args ...interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+
+	// collect fileName and lineNumber of the caller of the log function
+	var caller string
+	if _, fn, ln, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Join(filepath.Base(filepath.Dir(fn)), filepath.Base(fn)), ln)
+	}
+
+	entry := &entry{
+		time:    time.Now().UTC(),
+		level:   lvl,
+		caller:  caller,
+		message: fmt.Sprintf(format, args...),
+		fields:  l.fields,
+	}
+
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	output.w.Write(output.encoder(entry))
+}
+
+// SetOutput changes the writer messages are written to (os.Stderr by default)
+func SetOutput(w io.Writer) {
+	output.mtx.Lock()
+	output.w = w
+	output.mtx.Unlock()
+}
+
+// SetFormat changes the format messages are written in ("logfmt" or "json")
+func SetFormat(name string) error {
+	encoder, ok := encoders[name]
+	if !ok {
+		return fmt.Errorf("unknown log format %q, expected logfmt or json", name)
+	}
+	output.mtx.Lock()
+	output.encoder = encoder
+	output.mtx.Unlock()
+	return nil
 }
 
-// message creates a informational log message
-func message(level, message string) string {
-	// collect fileName and lineNumber of callee
-	_, fn, ln, _ := runtime.Caller(2)
-	// return formatted format string
-	return fmt.Sprintf("[%s] {%s:%d} %s", level, fn, ln, message)
+// Configure the level and format of all loggers using the given config,
+// should be called once its flags are parsed
+func Configure(cfg *Config) error {
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if cfg.Debug {
+		lvl = LevelDebug
+	}
+	SetLevel(lvl)
+	return SetFormat(cfg.Format)
 }
 
 func init() {
-	flag.BoolVar(&debug, "debug", os.Getenv("DEBUG") != "",
-		"allow for verbose logging (DEBUG env can be used as well)")
+	output.w = os.Stderr
+	output.encoder = encodeLogfmt
 }
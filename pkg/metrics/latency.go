@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// DefaultLatencyWindows are the rolling windows over which
+// latency percentiles and request rates are reported by default
+var DefaultLatencyWindows = []time.Duration{time.Minute, time.Minute * 5, time.Minute * 15}
+
+// Limits of the rolling latency windows
+const (
+	// windows are made up of slots of this duration,
+	// of which the current slot only covers the time passed since it started
+	windowResolution = time.Second * 10
+	// longest window that can be tracked,
+	// limited as every slot of a window takes up memory
+	maxLatencyWindow = time.Hour
+)
+
+// latency buckets grow exponentially from the minimum latency,
+// such that a percentile is reported within 5% of the actual latency
+const (
+	minLatency        = time.Microsecond
+	latencyGrowth     = 1.05
+	latencyBucketSize = 380 // covers latencies up to about 100 seconds
+)
+
+// reported percentiles, and the name they're reported as
+var latencyPercentiles = []struct {
+	name     string
+	quantile float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+	{"p999", 0.999},
+}
+
+// ParseLatencyWindows parses a comma-separated list of windows (e.g. "1m,5m,15m")
+func ParseLatencyWindows(s string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		window, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency window %q: %q", raw, err)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// validateLatencyWindows ensures the given windows can be tracked
+func validateLatencyWindows(windows []time.Duration) error {
+	if len(windows) == 0 {
+		return fmt.Errorf("at least one latency window is required")
+	}
+	for _, window := range windows {
+		if window < windowResolution || window > maxLatencyWindow {
+			return fmt.Errorf("%v is an invalid latency window, should be in the range [%v, %v]",
+				window, windowResolution, maxLatencyWindow)
+		}
+	}
+	return nil
+}
+
+// rollingHistogram tracks latencies over a rolling window,
+// as a ring of histograms, each covering windowResolution of time
+type rollingHistogram struct {
+	slots []latencySlot
+}
+
+// latencySlot is the histogram of a single slot of time
+type latencySlot struct {
+	index  int64 // index of the slot since the unix epoch
+	counts [latencyBucketSize]uint32
+	count  uint64
+}
+
+// newRollingHistogram creates a rolling histogram, covering at least the given window
+func newRollingHistogram(window time.Duration) *rollingHistogram {
+	return &rollingHistogram{
+		slots: make([]latencySlot, slotsOf(window)+1),
+	}
+}
+
+// slotsOf returns the amount of slots a window covers
+func slotsOf(window time.Duration) int64 {
+	return int64((window + windowResolution - 1) / windowResolution)
+}
+
+// Observe a latency, observed at the given time
+func (h *rollingHistogram) Observe(now time.Time, latency time.Duration) {
+	index := now.UnixNano() / int64(windowResolution)
+	slot := &h.slots[index%int64(len(h.slots))]
+	if slot.index > index {
+		// observed too late, its slot already covers a more recent time
+		return
+	}
+	if slot.index != index {
+		// slot last covered a time that is no longer part of any window
+		*slot = latencySlot{index: index}
+	}
+	slot.counts[latencyBucket(latency)]++
+	slot.count++
+}
+
+// latencySnapshot summarizes a rolling histogram over a window
+type latencySnapshot struct {
+	count       uint64
+	rate        float64 // per second
+	percentiles map[string]time.Duration
+}
+
+// Snapshot summarizes the latencies observed within the given window, prior to the given time
+func (h *rollingHistogram) Snapshot(now time.Time, window time.Duration) latencySnapshot {
+	current := now.UnixNano() / int64(windowResolution)
+	oldest := current - slotsOf(window) + 1
+
+	var counts [latencyBucketSize]uint64
+	var snapshot latencySnapshot
+	for i := range h.slots {
+		slot := &h.slots[i]
+		if slot.count == 0 || slot.index < oldest || slot.index > current {
+			continue
+		}
+		for bucket, count := range slot.counts {
+			counts[bucket] += uint64(count)
+		}
+		snapshot.count += slot.count
+	}
+
+	// the current slot only covers the time that passed since it started
+	covered := time.Duration(current-oldest)*windowResolution +
+		time.Duration(now.UnixNano()%int64(windowResolution))
+	if covered > 0 {
+		snapshot.rate = float64(snapshot.count) / covered.Seconds()
+	}
+
+	snapshot.percentiles = make(map[string]time.Duration, len(latencyPercentiles))
+	for _, p := range latencyPercentiles {
+		snapshot.percentiles[p.name] = percentile(counts[:], snapshot.count, p.quantile)
+	}
+	return snapshot
+}
+
+// percentile returns the (upper bound of the) latency bucket
+// in which the given quantile of all counted latencies falls
+func percentile(counts []uint64, total uint64, quantile float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	// the rank of the latency in the quantile, the lowest latency having rank 1
+	rank := uint64(math.Ceil(quantile * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var cumulative uint64
+	for bucket, count := range counts {
+		cumulative += count
+		if cumulative >= rank {
+			return latencyUpperBound(bucket)
+		}
+	}
+	return latencyUpperBound(len(counts) - 1)
+}
+
+// latencyBucket returns the bucket of a latency
+func latencyBucket(latency time.Duration) int {
+	if latency <= minLatency {
+		return 0
+	}
+	bucket := int(math.Ceil(math.Log(float64(latency)/float64(minLatency)) / math.Log(latencyGrowth)))
+	if bucket >= latencyBucketSize {
+		return latencyBucketSize - 1
+	}
+	return bucket
+}
+
+// latencyUpperBound returns the largest latency of a bucket
+func latencyUpperBound(bucket int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Pow(latencyGrowth, float64(bucket)))
+}
+
+// formatWindow formats a window as the name it is reported as (e.g. "5m")
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	}
+	return fmt.Sprintf("%ds", window/time.Second)
+}
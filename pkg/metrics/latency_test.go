@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testEpoch is aligned to the start of a slot
+var testEpoch = time.Unix(1500000000, 0)
+
+// at returns the time the given duration after testEpoch
+func at(d time.Duration) time.Time {
+	return testEpoch.Add(d)
+}
+
+func TestLatencyBucket(t *testing.T) {
+	if bucket := latencyBucket(0); bucket != 0 {
+		t.Errorf("expected bucket 0 for no latency, got %d", bucket)
+	}
+	if bucket := latencyBucket(minLatency); bucket != 0 {
+		t.Errorf("expected bucket 0 for the minimum latency, got %d", bucket)
+	}
+	if bucket := latencyBucket(time.Hour); bucket != latencyBucketSize-1 {
+		t.Errorf("expected the last bucket for a latency beyond the last bucket, got %d", bucket)
+	}
+	if upper := latencyUpperBound(latencyBucketSize - 1); upper < time.Second*90 {
+		t.Errorf("expected the last bucket to cover latencies up to about 100s, got %v", upper)
+	}
+
+	// a latency falls within its bucket, whose upper bound is within 5% of it
+	previous := 0
+	for latency := minLatency + 1; latency < time.Second*90; latency = latency*21/20 + 7 {
+		bucket := latencyBucket(latency)
+		if bucket < previous {
+			t.Fatalf("%v: bucket %d is lower than the bucket %d of a lower latency", latency, bucket, previous)
+		}
+		previous = bucket
+		upper := latencyUpperBound(bucket)
+		if float64(upper) < float64(latency)*(1-1e-9) {
+			t.Errorf("%v: upper bound %v of bucket %d is lower than the latency", latency, upper, bucket)
+		}
+		if float64(upper) > float64(latency)*latencyGrowth*(1+1e-9) {
+			t.Errorf("%v: upper bound %v of bucket %d is more than 5%% off", latency, upper, bucket)
+		}
+		if lower := latencyUpperBound(bucket - 1); bucket > 0 && float64(lower) >= float64(latency)*(1+1e-9) {
+			t.Errorf("%v: upper bound %v of the previous bucket covers the latency", latency, lower)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	counts := make([]uint64, latencyBucketSize)
+	counts[10], counts[20], counts[30], counts[40] = 50, 40, 9, 1
+
+	testCases := []struct {
+		quantile float64
+		bucket   int
+	}{
+		{0, 10},
+		{0.01, 10},
+		{0.5, 10},
+		{0.51, 20},
+		{0.9, 20},
+		{0.91, 30},
+		{0.99, 30},
+		{0.999, 40},
+		{1, 40},
+	}
+	for _, tc := range testCases {
+		if got, expected := percentile(counts, 100, tc.quantile), latencyUpperBound(tc.bucket); got != expected {
+			t.Errorf("quantile %v: expected %v (bucket %d), got %v", tc.quantile, expected, tc.bucket, got)
+		}
+	}
+	if got := percentile(make([]uint64, latencyBucketSize), 0, 0.5); got != 0 {
+		t.Errorf("expected no latency without counts, got %v", got)
+	}
+	// a total exceeding the counts reports the last bucket
+	if got := percentile(counts, 200, 0.99); got != latencyUpperBound(latencyBucketSize-1) {
+		t.Errorf("expected the last bucket, got %v", got)
+	}
+}
+
+func TestRollingHistogramSlotReuse(t *testing.T) {
+	h := newRollingHistogram(time.Minute)
+	ring := time.Duration(len(h.slots)) * windowResolution
+
+	h.Observe(at(0), time.Millisecond)
+	h.Observe(at(time.Second*9), time.Millisecond)
+	if snapshot := h.Snapshot(at(time.Second*9), time.Minute); snapshot.count != 2 {
+		t.Fatalf("expected 2 latencies within the first slot, got %d", snapshot.count)
+	}
+
+	// a full ring later the same slot is reused, dropping its earlier latencies
+	h.Observe(at(ring), time.Millisecond)
+	if snapshot := h.Snapshot(at(ring), time.Minute); snapshot.count != 1 {
+		t.Errorf("expected 1 latency once the slot is reused, got %d", snapshot.count)
+	}
+	// latencies observed too late for their slot are dropped,
+	// rather than resetting the slot that covers a more recent time
+	h.Observe(at(time.Second), time.Millisecond)
+	if snapshot := h.Snapshot(at(ring), time.Minute); snapshot.count != 1 {
+		t.Errorf("expected the late latency to be dropped, got %d latencies", snapshot.count)
+	}
+}
+
+func TestRollingHistogramSnapshot(t *testing.T) {
+	h := newRollingHistogram(time.Minute * 5)
+	// a single latency at the start of each of the first 6 slots
+	for i := 0; i < 6; i++ {
+		h.Observe(at(time.Duration(i)*windowResolution), time.Millisecond)
+	}
+	// a latency in the future is never part of a window
+	h.Observe(at(time.Hour), time.Millisecond)
+
+	testCases := []struct {
+		now    time.Duration
+		window time.Duration
+		count  uint64
+		// time covered by the window, over which the rate is computed
+		covered time.Duration
+	}{
+		// the window ends with the current slot, covering the time passed since it started
+		{time.Second * 55, time.Minute, 6, time.Second * 55},
+		{time.Second * 50, time.Minute, 6, time.Second * 50},
+		{time.Second * 59, time.Minute, 6, time.Second * 59},
+		// the first slot is no longer part of the window once a new slot started
+		{time.Second * 60, time.Minute, 5, time.Second * 50},
+		{time.Second * 65, time.Minute, 5, time.Second * 55},
+		// windows that aren't a multiple of the resolution are rounded up
+		{time.Second * 55, time.Second * 30, 3, time.Second * 25},
+		{time.Second * 55, time.Second * 25, 3, time.Second * 25},
+		{time.Second * 55, time.Second * 10, 1, time.Second * 5},
+		// longer windows include all slots
+		{time.Second * 55, time.Minute * 5, 6, time.Second * 295},
+		// the last slot is no longer part of any window
+		{time.Second*50 + time.Minute*5, time.Minute * 5, 0, time.Second * 290},
+	}
+	for _, tc := range testCases {
+		snapshot := h.Snapshot(at(tc.now), tc.window)
+		if snapshot.count != tc.count {
+			t.Errorf("%v within %v: expected %d latencies, got %d", tc.window, tc.now, tc.count, snapshot.count)
+		}
+		expected := float64(tc.count) / tc.covered.Seconds()
+		if math.Abs(snapshot.rate-expected) > 1e-9 {
+			t.Errorf("%v within %v: expected a rate of %v/s, got %v/s", tc.window, tc.now, expected, snapshot.rate)
+		}
+	}
+
+	// no time is covered at the very start of a window of a single slot
+	if snapshot := h.Snapshot(at(0), time.Second*10); snapshot.count != 1 || snapshot.rate != 0 {
+		t.Errorf("expected 1 latency and no rate, got %d latencies at %v/s", snapshot.count, snapshot.rate)
+	}
+}
+
+func TestRollingHistogramPercentiles(t *testing.T) {
+	h := newRollingHistogram(time.Minute)
+	for i := 0; i < 990; i++ {
+		h.Observe(at(time.Second), time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.Observe(at(time.Second*11), time.Millisecond*10)
+	}
+	h.Observe(at(time.Second*21), time.Second)
+
+	within := func(name string, got, expected time.Duration) {
+		if got < expected || float64(got) > float64(expected)*latencyGrowth {
+			t.Errorf("%s: expected %v (within 5%%), got %v", name, expected, got)
+		}
+	}
+	snapshot := h.Snapshot(at(time.Second*25), time.Minute)
+	within("p50", snapshot.percentiles["p50"], time.Millisecond)
+	within("p90", snapshot.percentiles["p90"], time.Millisecond)
+	within("p99", snapshot.percentiles["p99"], time.Millisecond)
+	within("p999", snapshot.percentiles["p999"], time.Millisecond*10)
+
+	// once the slot of the fast latencies left the window, only the slow ones remain
+	snapshot = h.Snapshot(at(time.Second*65), time.Minute)
+	within("p50", snapshot.percentiles["p50"], time.Millisecond*10)
+	within("p999", snapshot.percentiles["p999"], time.Second)
+
+	snapshot = h.Snapshot(at(time.Minute*5), time.Minute)
+	for name, latency := range snapshot.percentiles {
+		if latency != 0 {
+			t.Errorf("%s: expected no latency for an empty window, got %v", name, latency)
+		}
+	}
+}
+
+func TestParseLatencyWindows(t *testing.T) {
+	windows, err := ParseLatencyWindows(" 1m, 5m,,15m ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := DefaultLatencyWindows; !reflect.DeepEqual(windows, expected) {
+		t.Errorf("expected windows %v, got %v", expected, windows)
+	}
+	if _, err = ParseLatencyWindows("1m,5x"); err == nil {
+		t.Error("expected an error for an invalid window")
+	}
+
+	testCases := []struct {
+		windows []time.Duration
+		valid   bool
+	}{
+		{DefaultLatencyWindows, true},
+		{[]time.Duration{windowResolution, maxLatencyWindow}, true},
+		{nil, false},
+		{[]time.Duration{windowResolution - 1}, false},
+		{[]time.Duration{time.Minute, maxLatencyWindow + 1}, false},
+	}
+	for _, tc := range testCases {
+		if err := validateLatencyWindows(tc.windows); (err == nil) != tc.valid {
+			t.Errorf("%v: expected valid to be %v, got error %v", tc.windows, tc.valid, err)
+		}
+	}
+}
+
+func TestFormatWindow(t *testing.T) {
+	testCases := map[time.Duration]string{
+		time.Second * 10:  "10s",
+		time.Second * 90:  "90s",
+		time.Minute:       "1m",
+		time.Minute * 15:  "15m",
+		time.Hour:         "1h",
+		time.Minute * 120: "2h",
+	}
+	for window, expected := range testCases {
+		if got := formatWindow(window); got != expected {
+			t.Errorf("%v: expected %q, got %q", window, expected, got)
+		}
+	}
+}
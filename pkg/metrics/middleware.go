@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// Middleware wraps a handler, such that each request it handles is tracked by this Server,
+// using the given route template (e.g. "/metrics/hourly_logs/total"),
+// as well as the method of the request and the status code of its response.
+// Responses with a status code of 400 or above are tracked as failed requests.
+func (s *Server) Middleware(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			// nothing was written, which net/http responds to with a 200
+			status = http.StatusOK
+		}
+		s.track(serverInput{
+			At:        time.Now(),
+			RespTime:  time.Since(start),
+			Route:     route,
+			Method:    normalizeMethod(r.Method),
+			Status:    status,
+			Success:   status < http.StatusBadRequest,
+			Batch:     recorder.batch,
+			BatchSize: recorder.batchSize,
+		})
+	})
+}
+
+// SetBatchSize marks the request, whose response is written to the given writer,
+// as a batch request containing the given amount of items.
+// Only has an effect on requests tracked using a Server's Middleware.
+func SetBatchSize(w http.ResponseWriter, size int) {
+	if recorder, ok := w.(*statusRecorder); ok {
+		recorder.batch, recorder.batchSize = true, size
+	}
+}
+
+// statusRecorder records the status code of a response,
+// as well as any other information reported by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+
+	batch     bool
+	batchSize int
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.Write
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// normalizeMethod returns the method as it is tracked,
+// such that unknown methods don't result in an unbounded amount of breakdowns
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
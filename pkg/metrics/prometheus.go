@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector writes its metrics in the Prometheus text exposition format
+// More information: https://prometheus.io/docs/instrumenting/exposition_formats/
+type Collector interface {
+	WritePrometheus(w io.Writer)
+}
+
+// DefaultBuckets are the upper bounds (in seconds) used by latency histograms
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// registry of all collectors exposed by Handler
+var registry struct {
+	mtx        sync.Mutex
+	collectors []Collector
+}
+
+// Register a collector, such that it is exposed by Handler
+func Register(c Collector) {
+	registry.mtx.Lock()
+	registry.collectors = append(registry.collectors, c)
+	registry.mtx.Unlock()
+}
+
+// Handler serves all registered collectors in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.mtx.Lock()
+		collectors := make([]Collector, len(registry.collectors))
+		copy(collectors, registry.collectors)
+		registry.mtx.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		buf := bufio.NewWriter(w)
+		for _, c := range collectors {
+			c.WritePrometheus(buf)
+		}
+		buf.Flush()
+	})
+}
+
+// CounterVec is a set of counters, partitioned by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mtx    sync.Mutex
+	values map[string]*labeledValue
+}
+
+// labeledValue is the value of a single series
+type labeledValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec creates a counter partitioned by the given labels,
+// and registers it, such that it is exposed by Handler
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*labeledValue),
+	}
+	Register(c)
+	return c
+}
+
+// Inc increments the counter with the given label values by one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add the given (non-negative) delta to the counter with the given label values
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := seriesKey(values)
+	c.mtx.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &labeledValue{labels: values}
+		c.values[key] = v
+	}
+	v.value += delta
+	c.mtx.Unlock()
+}
+
+// WritePrometheus implements Collector.WritePrometheus
+func (c *CounterVec) WritePrometheus(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, v.labels), formatFloat(v.value))
+	}
+}
+
+// String returns the counters as a JSON object, nested by label values,
+// implementing the expvar.Var interface
+func (c *CounterVec) String() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var root interface{}
+	for _, v := range c.values {
+		root = nestValue(root, v.labels, v.value)
+	}
+	return marshalJSON(root)
+}
+
+// FuncMetric is a gauge or counter whose value is read when it is collected,
+// used to expose values that are already tracked elsewhere
+type FuncMetric struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// NewGaugeFunc creates a gauge returning the value of the given function,
+// and registers it, such that it is exposed by Handler
+func NewGaugeFunc(name, help string, fn func() float64) *FuncMetric {
+	return newFuncMetric(name, help, "gauge", fn)
+}
+
+// NewCounterFunc creates a counter returning the value of the given function,
+// which should only ever increase, and registers it, such that it is exposed by Handler
+func NewCounterFunc(name, help string, fn func() float64) *FuncMetric {
+	return newFuncMetric(name, help, "counter", fn)
+}
+
+func newFuncMetric(name, help, kind string, fn func() float64) *FuncMetric {
+	m := &FuncMetric{name: name, help: help, kind: kind, fn: fn}
+	Register(m)
+	return m
+}
+
+// WritePrometheus implements Collector.WritePrometheus
+func (m *FuncMetric) WritePrometheus(w io.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatFloat(m.fn()))
+}
+
+// HistogramVec is a set of histograms, partitioned by label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mtx        sync.Mutex
+	histograms map[string]*histogram
+}
+
+// histogram of a single series
+type histogram struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram partitioned by the given labels,
+// using the given (sorted) bucket upper bounds (DefaultBuckets if nil),
+// and registers it, such that it is exposed by Handler
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+	Register(h)
+	return h
+}
+
+// Observe a value in the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := seriesKey(values)
+	index := sort.SearchFloat64s(h.buckets, value)
+
+	h.mtx.Lock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+	if index < len(h.buckets) {
+		hist.counts[index]++
+	}
+	hist.count++
+	hist.sum += value
+	h.mtx.Unlock()
+}
+
+// ObserveDuration observes the time passed since the given start, in seconds
+func (h *HistogramVec) ObserveDuration(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// WritePrometheus implements Collector.WritePrometheus
+func (h *HistogramVec) WritePrometheus(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedHistogramKeys(h.histograms) {
+		hist := h.histograms[key]
+		var cumulative uint64
+		for index, upper := range h.buckets {
+			cumulative += hist.counts[index]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(bucketLabels, append(append([]string(nil), hist.labels...), formatFloat(upper))),
+				cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(bucketLabels, append(append([]string(nil), hist.labels...), "+Inf")), hist.count)
+		labels := formatLabels(h.labels, hist.labels)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hist.count)
+	}
+}
+
+// String returns the histograms as a JSON object, nested by label values,
+// where the buckets are cumulative and keyed by their upper bound (in seconds),
+// implementing the expvar.Var interface
+func (h *HistogramVec) String() string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var root interface{}
+	for _, hist := range h.histograms {
+		buckets := make(map[string]uint64, len(h.buckets))
+		var cumulative uint64
+		for index, upper := range h.buckets {
+			cumulative += hist.counts[index]
+			buckets[formatFloat(upper)] = cumulative
+		}
+		var average float64
+		if hist.count > 0 {
+			average = hist.sum / float64(hist.count)
+		}
+		root = nestValue(root, hist.labels, map[string]interface{}{
+			"count":   hist.count,
+			"sum":     hist.sum,
+			"average": average,
+			"buckets": buckets,
+		})
+	}
+	return marshalJSON(root)
+}
+
+// nestValue stores a value in a tree of JSON objects, nested by the given label values,
+// returning the (new) root of that tree, which is the value itself if there are no labels
+func nestValue(root interface{}, labels []string, value interface{}) interface{} {
+	if len(labels) == 0 {
+		return value
+	}
+	node, ok := root.(map[string]interface{})
+	if !ok {
+		node = make(map[string]interface{})
+	}
+	node[labels[0]] = nestValue(node[labels[0]], labels[1:], value)
+	return node
+}
+
+// marshalJSON marshals a tree of values, returning an empty object if it is empty
+func marshalJSON(root interface{}) string {
+	if root == nil {
+		return "{}"
+	}
+	bytes, err := json.Marshal(root)
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(bytes)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels formats label pairs as {name="value",...}, empty if there are no labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for index, name := range names {
+		var value string
+		if index < len(values) {
+			value = values[index]
+		}
+		pairs[index] = name + `="` + labelValueEscaper.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper escapes label values, as expected by Prometheus
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat formats a sample value, as expected by Prometheus
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey identifies the series of the given label values
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m map[string]*labeledValue) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistogramKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
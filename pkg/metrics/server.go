@@ -1,10 +1,13 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/glendc/data-ingestion-challenge/pkg/log"
@@ -15,13 +18,18 @@ func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
 		ResponseBufferSize: 256,
 		RequestBufferSize:  1024,
+		LatencyWindows:     DefaultLatencyWindows,
 	}
 }
 
 // ServerConfig is used to configure a server metrics worker
 type ServerConfig struct {
 	ResponseBufferSize int
-	RequestBufferSize  int
+	// amount of requests that can wait in line to be tracked,
+	// requests are dropped (not tracked) once it is full
+	RequestBufferSize int
+	// rolling windows over which latency percentiles and request rates are reported
+	LatencyWindows []time.Duration
 }
 
 // WithResponseBufferSize sets the response buffer size configuration
@@ -38,6 +46,13 @@ func (cfg *ServerConfig) WithRequestBufferSize(size int) *ServerConfig {
 	return cfg
 }
 
+// WithLatencyWindows sets the latency windows configuration
+// and returns the updated version of itself
+func (cfg *ServerConfig) WithLatencyWindows(windows []time.Duration) *ServerConfig {
+	cfg.LatencyWindows = windows
+	return cfg
+}
+
 // validate the ServerConfig properties
 func (cfg *ServerConfig) validate() error {
 	if cfg.ResponseBufferSize < 16 {
@@ -50,15 +65,31 @@ func (cfg *ServerConfig) validate() error {
 			"%d is an invalid RequestBufferSize, should be at least 1",
 			cfg.RequestBufferSize)
 	}
-	return nil
+	return validateLatencyWindows(cfg.LatencyWindows)
 }
 
 // Server collect all metrics we want to track about a server
 type Server struct {
+	// requests that couldn't be tracked, as the request buffer was full,
+	// first field as it is accessed atomically (requires 64-bit alignment)
+	droppedSamples uint64
+
 	// request counters
 	requests       uint64
 	failedRequests uint64
 
+	// authentication (401) and authorization (403) failures
+	unauthorizedRequests uint64
+	forbiddenRequests    uint64
+
+	// requests per route, method and status code
+	breakdown map[routeBreakdown]uint64
+
+	// batch counters
+	batches      uint64
+	batchEvents  uint64
+	maxBatchSize int
+
 	// min, max, avg response times
 	minRespTime         time.Duration
 	maxRespTime         time.Duration
@@ -66,6 +97,11 @@ type Server struct {
 	respTimeBufferIndex int
 	respStartTime       time.Time
 
+	// latencies of successfull and failed requests,
+	// tracked separately over rolling windows
+	successLatencies *rollingHistogram
+	failureLatencies *rollingHistogram
+
 	// mutex to ensure that we're not modifying data, while outputting it,
 	// and vice versa.
 	mtx sync.Mutex
@@ -74,12 +110,31 @@ type Server struct {
 	ch chan serverInput
 	// constants given by user
 	cfg *ServerConfig
+
+	// exposed in the Prometheus format, see Handler
+	promRequests     *CounterVec
+	promRespTimes    *HistogramVec
+	promAuthFailures *CounterVec
+	promBatchEvents  *CounterVec
 }
 
 // server metric input (used internally only)
 type serverInput struct {
-	RespTime time.Duration
-	Success  bool
+	At        time.Time // time the response was sent
+	RespTime  time.Duration
+	Route     string
+	Method    string
+	Status    int
+	Success   bool
+	Batch     bool
+	BatchSize int
+}
+
+// breakdown of the requests of a route, per method and status code
+type routeBreakdown struct {
+	route  string
+	method string
+	status int
 }
 
 // NewServer creates a metrics worker that is meant
@@ -91,13 +146,40 @@ func NewServer(cfg *ServerConfig) (*Server, error) {
 		return nil, fmt.Errorf("can't create server as config is invalid: %q", err)
 	}
 
-	return &Server{
+	var maxWindow time.Duration
+	for _, window := range cfg.LatencyWindows {
+		if window > maxWindow {
+			maxWindow = window
+		}
+	}
+
+	s := &Server{
+		breakdown:        make(map[routeBreakdown]uint64),
+		successLatencies: newRollingHistogram(maxWindow),
+		failureLatencies: newRollingHistogram(maxWindow),
+
 		minRespTime:    time.Duration(math.MaxInt64),
 		maxRespTime:    time.Duration(math.MinInt64),
 		respTimeBuffer: make([]time.Duration, cfg.ResponseBufferSize),
 		ch:             make(chan serverInput, cfg.RequestBufferSize),
 		cfg:            cfg,
-	}, nil
+
+		promRequests: NewCounterVec("http_requests_total",
+			"Total number of handled HTTP requests, by route, method and status code.",
+			"route", "method", "status"),
+		promRespTimes: NewHistogramVec("http_request_duration_seconds",
+			"Response times of handled HTTP requests, by route, method and result (success or failure).",
+			nil, "route", "method", "result"),
+		promAuthFailures: NewCounterVec("http_auth_failures_total",
+			"Total number of HTTP requests that failed to authenticate (401) or were forbidden (403).",
+			"status"),
+		promBatchEvents: NewCounterVec("http_batch_events_total",
+			"Total number of events received as part of a batch."),
+	}
+	NewCounterFunc("http_metrics_dropped_samples_total",
+		"Total number of HTTP requests that weren't tracked, as the request buffer was full.",
+		func() float64 { return float64(s.DroppedSamples()) })
+	return s, nil
 }
 
 // ListenAndCompute listens for incoming track requests,
@@ -112,15 +194,24 @@ func (s *Server) ListenAndCompute() {
 	}
 }
 
-// Request notifies the Server Metrics worker
-// about a new request, which info it will track ASAP
-func (s *Server) Request(r *http.Request, start time.Time, success bool) {
-	s.ch <- serverInput{
-		RespTime: time.Now().Sub(start),
-		Success:  success,
+// track notifies the Server Metrics worker
+// about a handled request, which info it will track ASAP.
+// It never blocks, such that a worker that falls behind can't stall the server,
+// instead the request is dropped (and counted as such) in case the buffer is full.
+func (s *Server) track(in serverInput) {
+	select {
+	case s.ch <- in:
+	default:
+		atomic.AddUint64(&s.droppedSamples, 1)
 	}
 }
 
+// DroppedSamples returns the amount of requests that weren't tracked,
+// as the request buffer was full at the time
+func (s *Server) DroppedSamples() uint64 {
+	return atomic.LoadUint64(&s.droppedSamples)
+}
+
 // String returns the server metrics as a valid JSON Object,
 // implementing the expvar.Var interface
 func (s *Server) String() string {
@@ -130,35 +221,51 @@ func (s *Server) String() string {
 	// early return in case no requests have been progressed yet,
 	// as all the other data is pretty useless if so
 	if s.requests == 0 {
-		return `{
-			"requests": {
-				"total": 0
-			}
-		}`
+		return fmt.Sprintf(`{"requests":{"total":0},"droppedSamples":%d}`, s.DroppedSamples())
 	}
 
 	successRequests := s.requests - s.failedRequests
-	avgRespTime := s.computeAverageRespTime(successRequests)
+	var minRespTime, maxRespTime, avgRespTime time.Duration
+	if successRequests > 0 {
+		minRespTime, maxRespTime = s.minRespTime, s.maxRespTime
+		avgRespTime = s.computeAverageRespTime(successRequests)
+	}
+
+	var avgBatchSize float64
+	if s.batches > 0 {
+		avgBatchSize = float64(s.batchEvents) / float64(s.batches)
+	}
 
-	return fmt.Sprintf(`{
-		"requests": {
-			"total": %d,
-			"failed": %d,
-			"successfull": %d,
+	bytes, err := json.Marshal(map[string]interface{}{
+		"requests": map[string]interface{}{
+			"total":       s.requests,
+			"failed":      s.failedRequests,
+			"successfull": successRequests,
 		},
-		"responseTimes": {
-			"minimum": %f,
-			"maximum": %f,
-			"average": %f,
+		"responseTimes": map[string]interface{}{
+			"minimum": minRespTime.Seconds(),
+			"maximum": maxRespTime.Seconds(),
+			"average": avgRespTime.Seconds(),
 		},
-	}`,
-		s.requests,
-		s.failedRequests,
-		successRequests,
-		s.minRespTime.Seconds(),
-		s.maxRespTime.Seconds(),
-		avgRespTime.Seconds(),
-	)
+		"batches": map[string]interface{}{
+			"total":       s.batches,
+			"events":      s.batchEvents,
+			"maximumSize": s.maxBatchSize,
+			"averageSize": avgBatchSize,
+		},
+		"auth": map[string]interface{}{
+			"unauthorized": s.unauthorizedRequests,
+			"forbidden":    s.forbiddenRequests,
+		},
+		"windows": s.windows(time.Now()),
+		"routes":  s.routes(),
+
+		"droppedSamples": s.DroppedSamples(),
+	})
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(bytes)
 }
 
 // track a request, for most data we only care about successfull requests
@@ -167,6 +274,25 @@ func (s *Server) trackRequest(in *serverInput) {
 	defer s.mtx.Unlock()
 
 	s.requests++
+	s.breakdown[routeBreakdown{route: in.Route, method: in.Method, status: in.Status}]++
+	s.trackPrometheus(in)
+
+	// latencies are tracked for all requests, separately for failed requests
+	if in.Success {
+		s.successLatencies.Observe(in.At, in.RespTime)
+	} else {
+		s.failureLatencies.Observe(in.At, in.RespTime)
+	}
+
+	// batch sizes are tracked for all batches that could be split into items,
+	// regardless of how many of those items were accepted
+	if in.Batch && in.BatchSize > 0 {
+		s.batches++
+		s.batchEvents += uint64(in.BatchSize)
+		if in.BatchSize > s.maxBatchSize {
+			s.maxBatchSize = in.BatchSize
+		}
+	}
 
 	// if the request was not successfull we don't compute response times
 	// as this would skew the data, knowing that failed requests
@@ -174,6 +300,12 @@ func (s *Server) trackRequest(in *serverInput) {
 	// (only when RabbitMQ fails this wouldn't be the case)
 	if !in.Success {
 		s.failedRequests++
+		switch in.Status {
+		case http.StatusUnauthorized:
+			s.unauthorizedRequests++
+		case http.StatusForbidden:
+			s.forbiddenRequests++
+		}
 		return
 	}
 
@@ -191,6 +323,71 @@ func (s *Server) trackRequest(in *serverInput) {
 	s.respTimeBufferIndex++
 }
 
+// routes reports the amount of requests per route, method and status code
+func (s *Server) routes() map[string]map[string]map[string]uint64 {
+	routes := make(map[string]map[string]map[string]uint64)
+	for b, count := range s.breakdown {
+		methods, ok := routes[b.route]
+		if !ok {
+			methods = make(map[string]map[string]uint64)
+			routes[b.route] = methods
+		}
+		statuses, ok := methods[b.method]
+		if !ok {
+			statuses = make(map[string]uint64)
+			methods[b.method] = statuses
+		}
+		statuses[strconv.Itoa(b.status)] = count
+	}
+	return routes
+}
+
+// windows reports the latency percentiles (in seconds) and request rates (per second)
+// of successfull and failed requests, over each of the configured rolling windows
+func (s *Server) windows(now time.Time) map[string]interface{} {
+	windows := make(map[string]interface{}, len(s.cfg.LatencyWindows))
+	for _, window := range s.cfg.LatencyWindows {
+		success := s.successLatencies.Snapshot(now, window)
+		failure := s.failureLatencies.Snapshot(now, window)
+		windows[formatWindow(window)] = map[string]interface{}{
+			"requestRate": success.rate + failure.rate,
+			"successfull": snapshotJSON(success),
+			"failed":      snapshotJSON(failure),
+		}
+	}
+	return windows
+}
+
+// snapshotJSON returns a latency snapshot in the format it is reported in
+func snapshotJSON(snapshot latencySnapshot) map[string]interface{} {
+	result := map[string]interface{}{
+		"count": snapshot.count,
+		"rate":  snapshot.rate,
+	}
+	for name, latency := range snapshot.percentiles {
+		result[name] = latency.Seconds()
+	}
+	return result
+}
+
+// trackPrometheus tracks a request in the metrics exposed in the Prometheus format,
+// unlike the other metrics these include the response times of failed requests
+func (s *Server) trackPrometheus(in *serverInput) {
+	result := "success"
+	if !in.Success {
+		result = "failure"
+	}
+	if in.Batch {
+		s.promBatchEvents.Add(float64(in.BatchSize))
+	}
+	status := strconv.Itoa(in.Status)
+	s.promRequests.Inc(in.Route, in.Method, status)
+	s.promRespTimes.Observe(in.RespTime.Seconds(), in.Route, in.Method, result)
+	if in.Status == http.StatusUnauthorized || in.Status == http.StatusForbidden {
+		s.promAuthFailures.Inc(status)
+	}
+}
+
 // computeAverageRespTime computes the average response time
 // it does so by taking into account all last N response times
 // where N is the number equal to the size of the buffer, capped at a maximum.
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// store metrics, shared by all stores of a process,
+// created (and published as the "stores" expvar) once the first store is created
+var (
+	storeMetricsOnce sync.Once
+	storeDurations   *HistogramVec
+	storeErrors      *CounterVec
+)
+
+// Store tracks the latency and errors of the operations on a backing store
+// (e.g. Postgres, Redis or MongoDB), exposed in the Prometheus and expvar format
+type Store struct {
+	name string
+}
+
+// NewStore creates the metrics of the store with the given name
+func NewStore(name string) *Store {
+	storeMetricsOnce.Do(func() {
+		storeDurations = NewHistogramVec("store_operation_duration_seconds",
+			"Latency of operations on a backing store, by store and operation.",
+			nil, "store", "operation")
+		storeErrors = NewCounterVec("store_operation_errors_total",
+			"Total number of failed operations on a backing store, by store and operation.",
+			"store", "operation")
+
+		stores := expvar.NewMap("stores")
+		stores.Set("durations", storeDurations)
+		stores.Set("errors", storeErrors)
+	})
+	return &Store{name: name}
+}
+
+// Observe an operation that started at the given time,
+// and failed in case the given error is not nil
+func (s *Store) Observe(operation string, start time.Time, err error) {
+	storeDurations.ObserveDuration(start, s.name, operation)
+	if err != nil {
+		storeErrors.Inc(s.name, operation)
+	}
+}
@@ -0,0 +1,209 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+// What a rule limits by
+const (
+	ByAPIKey   = "apiKey"
+	ByUsername = "username"
+	ByIP       = "ip"
+)
+
+// Limit of a token bucket, which is refilled at a given rate (tokens per second),
+// and can hold at most burst tokens
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// validate the Limit properties
+func (l Limit) validate() error {
+	if l.Rate <= 0 {
+		return fmt.Errorf("%v is an invalid rate, should be positive", l.Rate)
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("%d is an invalid burst, should be at least 1", l.Burst)
+	}
+	return nil
+}
+
+// Rule limits all requests (or events) sharing the same API key, username or client IP,
+// using a separate bucket for each value. Overrides define the limit of specific values.
+type Rule struct {
+	By string `json:"by"`
+	Limit
+	Overrides map[string]Limit `json:"overrides,omitempty"`
+}
+
+// LimitFor returns the limit of the bucket of the given value
+func (r *Rule) LimitFor(value string) Limit {
+	if limit, ok := r.Overrides[value]; ok {
+		return limit
+	}
+	return r.Limit
+}
+
+// Config lists all rate limiting rules
+type Config struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// LoadConfig loads a rate limiting config from the JSON file found at the given path
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read rate limits: %q", err)
+	}
+
+	var cfg Config
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("couldn't decode rate limits: %q", err)
+	}
+	for index, rule := range cfg.Rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d is empty", index)
+		}
+		switch rule.By {
+		case ByAPIKey, ByUsername, ByIP:
+		default:
+			return nil, fmt.Errorf("rule %d limits by unknown property %q, expected %s, %s or %s",
+				index, rule.By, ByAPIKey, ByUsername, ByIP)
+		}
+		if err = rule.Limit.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %q", index, err)
+		}
+		for value, limit := range rule.Overrides {
+			if err = limit.validate(); err != nil {
+				return nil, fmt.Errorf("rule %d, override %q: %q", index, value, err)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// Result of taking tokens from a bucket
+type Result struct {
+	Allowed bool
+	Limit   Limit
+	// tokens left in the bucket
+	Remaining int
+	// time to wait until the tokens can be taken, zero if allowed
+	RetryAfter time.Duration
+	// time until the bucket is full again
+	Reset time.Duration
+}
+
+// Limiter takes tokens from token buckets
+type Limiter interface {
+	// Take n tokens from the bucket identified by the given key,
+	// creating a full bucket with the given limit if it doesn't exist yet
+	Take(key string, limit Limit, n int) (Result, error)
+	// Refund n previously taken tokens to the bucket identified by the given key,
+	// without exceeding the burst of the given limit
+	Refund(key string, limit Limit, n int) error
+}
+
+// NewMemoryLimiter creates a Limiter keeping its buckets in memory,
+// only limiting the requests handled by this process
+func NewMemoryLimiter() Limiter {
+	return &memoryLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// interval on which full buckets are removed from memory
+const sweepInterval = time.Minute
+
+type memoryLimiter struct {
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// Take implements Limiter.Take
+func (l *memoryLimiter) Take(key string, limit Limit, n int) (Result, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, limit, now.Sub(b.last))
+	b.limit, b.last = limit, now
+
+	var allowed bool
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		allowed = true
+	}
+	return newResult(allowed, limit, b.tokens, n), nil
+}
+
+// Refund implements Limiter.Refund
+func (l *memoryLimiter) Refund(key string, limit Limit, n int) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	// a bucket that no longer exists was full, and thus is still full
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(b.tokens+float64(n), float64(limit.Burst))
+	}
+	return nil
+}
+
+// sweep removes all buckets that are full, as they're identical to new buckets
+func (l *memoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if refill(b.tokens, b.limit, now.Sub(b.last)) >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// refill the tokens of a bucket, for the time that passed since it was last refilled
+func refill(tokens float64, limit Limit, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * limit.Rate
+	}
+	return math.Min(tokens, float64(limit.Burst))
+}
+
+// newResult creates the result of taking n tokens,
+// given the tokens that are left in the bucket
+func newResult(allowed bool, limit Limit, tokens float64, n int) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(tokens),
+		Reset:     seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = seconds((float64(n) - tokens) / limit.Rate)
+	}
+	return result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// a rate low enough for buckets not to be refilled while testing
+const testRate = 0.001
+
+func TestMemoryLimiterTake(t *testing.T) {
+	testCases := []struct {
+		name     string
+		limit    Limit
+		takes    []int
+		allowed  []bool
+		remains  []int
+		lastWait time.Duration // retry after of the last take, if not allowed
+	}{
+		{"single", Limit{testRate, 5}, []int{1}, []bool{true}, []int{4}, 0},
+		{"until empty", Limit{testRate, 3}, []int{1, 1, 1, 1},
+			[]bool{true, true, true, false}, []int{2, 1, 0, 0}, time.Duration(1 / testRate * float64(time.Second))},
+		{"batch", Limit{testRate, 10}, []int{6, 6, 4}, []bool{true, false, true}, []int{4, 4, 0}, 0},
+		{"exceeds burst", Limit{testRate, 5}, []int{6}, []bool{false}, []int{5},
+			time.Duration(1 / testRate * float64(time.Second))},
+		{"retry after", Limit{1, 2}, []int{2, 2}, []bool{true, false}, []int{0, 0}, time.Second * 2},
+	}
+
+	for _, tc := range testCases {
+		l := NewMemoryLimiter()
+		var result Result
+		for i, n := range tc.takes {
+			var err error
+			if result, err = l.Take("key", tc.limit, n); err != nil {
+				t.Fatalf("%s: take %d: %v", tc.name, i, err)
+			}
+			if result.Allowed != tc.allowed[i] {
+				t.Errorf("%s: take %d: expected allowed=%v, got %v", tc.name, i, tc.allowed[i], result.Allowed)
+			}
+			if result.Remaining != tc.remains[i] {
+				t.Errorf("%s: take %d: expected %d remaining, got %d", tc.name, i, tc.remains[i], result.Remaining)
+			}
+		}
+		// allow some slack, as the bucket is refilled in between takes
+		if diff := result.RetryAfter - tc.lastWait; diff > time.Millisecond*50 || diff < -time.Millisecond*50 {
+			t.Errorf("%s: expected to retry after %v, got %v", tc.name, tc.lastWait, result.RetryAfter)
+		}
+	}
+}
+
+func TestMemoryLimiterRefill(t *testing.T) {
+	l := NewMemoryLimiter()
+	limit := Limit{Rate: 100, Burst: 2}
+	for i := 0; i < 2; i++ {
+		l.Take("key", limit, 1)
+	}
+	if result, _ := l.Take("key", limit, 1); result.Allowed {
+		t.Fatal("expected the bucket to be empty")
+	}
+	time.Sleep(time.Millisecond * 30)
+	if result, _ := l.Take("key", limit, 1); !result.Allowed {
+		t.Error("expected the bucket to be refilled")
+	}
+}
+
+func TestMemoryLimiterRefund(t *testing.T) {
+	testCases := []struct {
+		name      string
+		take      int
+		refund    int
+		remaining int
+	}{
+		{"partial", 4, 2, 3},
+		{"all", 4, 4, 5},
+		{"capped at burst", 4, 10, 5},
+	}
+
+	limit := Limit{Rate: testRate, Burst: 5}
+	for _, tc := range testCases {
+		l := NewMemoryLimiter()
+		l.Take("key", limit, tc.take)
+		if err := l.Refund("key", limit, tc.refund); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		result, _ := l.Take("key", limit, 0)
+		if result.Remaining != tc.remaining {
+			t.Errorf("%s: expected %d remaining, got %d", tc.name, tc.remaining, result.Remaining)
+		}
+	}
+
+	// refunding a bucket that doesn't exist leaves it full
+	l := NewMemoryLimiter()
+	if err := l.Refund("unknown", limit, 3); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := l.Take("unknown", limit, 0); result.Remaining != limit.Burst {
+		t.Errorf("expected a full bucket, got %d remaining", result.Remaining)
+	}
+}
+
+func TestMemoryLimiterKeys(t *testing.T) {
+	l := NewMemoryLimiter()
+	limit := Limit{Rate: testRate, Burst: 1}
+	if result, _ := l.Take("a", limit, 1); !result.Allowed {
+		t.Fatal("expected bucket a to allow the first take")
+	}
+	if result, _ := l.Take("b", limit, 1); !result.Allowed {
+		t.Error("expected bucket b not to share its tokens with bucket a")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	testCases := []struct {
+		data  string
+		valid bool
+	}{
+		{`{"rules": [{"by": "apiKey", "rate": 10, "burst": 100}]}`, true},
+		{`{"rules": [{"by": "ip", "rate": 0.5, "burst": 1, "overrides": {"10.0.0.1": {"rate": 1, "burst": 2}}}]}`, true},
+		{`{"rules": []}`, true},
+		{`{"rules": [{"by": "tenant", "rate": 10, "burst": 100}]}`, false},
+		{`{"rules": [{"by": "username", "rate": 0, "burst": 100}]}`, false},
+		{`{"rules": [{"by": "username", "rate": 10, "burst": 0}]}`, false},
+		{`{"rules": [{"by": "ip", "rate": 1, "burst": 1, "overrides": {"10.0.0.1": {"rate": 1}}}]}`, false},
+		{`{"rules": [null]}`, false},
+		{`{"rules": `, false},
+	}
+
+	for _, tc := range testCases {
+		file, err := ioutil.TempFile("", "ratelimits-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(tc.data)
+		file.Close()
+
+		_, err = LoadConfig(file.Name())
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tc.data, tc.valid, err)
+		}
+		os.Remove(file.Name())
+	}
+}
+
+func TestRuleLimitFor(t *testing.T) {
+	rule := &Rule{
+		By:        ByAPIKey,
+		Limit:     Limit{Rate: 10, Burst: 100},
+		Overrides: map[string]Limit{"koding": {Rate: 1000, Burst: 5000}},
+	}
+	if limit := rule.LimitFor("koding"); limit.Burst != 5000 {
+		t.Errorf("expected the override of koding, got %v", limit)
+	}
+	if limit := rule.LimitFor("other"); limit.Burst != 100 {
+		t.Errorf("expected the default limit, got %v", limit)
+	}
+}
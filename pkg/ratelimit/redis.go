@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// takeScript atomically refills a token bucket and takes tokens from it,
+// such that multiple processes can share the same bucket.
+// The bucket expires once it would be full again, as it's identical to a new bucket by then.
+//
+//	KEYS[1]: bucket
+//	ARGV[1]: rate (tokens per second)
+//	ARGV[2]: burst
+//	ARGV[3]: current time (in milliseconds)
+//	ARGV[4]: amount of tokens to take
+//	returns: {1 if taken 0 otherwise, tokens left}
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+
+local taken = 0
+if tokens >= n then
+	tokens = tokens - n
+	taken = 1
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", ts)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {taken, tostring(tokens)}
+`)
+
+// refundScript atomically returns tokens to a token bucket,
+// a bucket that expired was full and thus stays full.
+//
+//	KEYS[1]: bucket
+//	ARGV[1]: burst
+//	ARGV[2]: amount of tokens to return
+var refundScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+if tokens then
+	redis.call("HSET", KEYS[1], "tokens", math.min(burst, tokens + n))
+end
+return 0
+`)
+
+// NewRedisLimiter creates a Limiter keeping its buckets in Redis,
+// such that all processes sharing the same Redis instance enforce a global limit
+func NewRedisLimiter(client *redis.Client) Limiter {
+	return &redisLimiter{client: client}
+}
+
+type redisLimiter struct {
+	client *redis.Client
+}
+
+// prefix of all bucket keys stored in Redis
+const redisKeyPrefix = "ratelimit:"
+
+// Take implements Limiter.Take
+func (l *redisLimiter) Take(key string, limit Limit, n int) (Result, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	reply, err := takeScript.Run(l.client, []string{redisKeyPrefix + key},
+		strconv.FormatFloat(limit.Rate, 'f', -1, 64), limit.Burst, now, n).Result()
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected take result %v", reply)
+	}
+	taken, ok := values[0].(int64)
+	if !ok {
+		return Result{}, fmt.Errorf("unexpected take result %v", reply)
+	}
+	rawTokens, ok := values[1].(string)
+	if !ok {
+		return Result{}, fmt.Errorf("unexpected take result %v", reply)
+	}
+	tokens, err := strconv.ParseFloat(rawTokens, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("unexpected take result %v: %q", reply, err)
+	}
+
+	return newResult(taken == 1, limit, tokens, n), nil
+}
+
+// Refund implements Limiter.Refund
+func (l *redisLimiter) Refund(key string, limit Limit, n int) error {
+	return refundScript.Run(l.client, []string{redisKeyPrefix + key}, limit.Burst, n).Err()
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"sync"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+)
+
+// Content types of the builtin codecs
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec defines an interface to encode and decode data in a specific wire format
+type Codec interface {
+	// ContentType returns the content type of the encoded data
+	ContentType() string
+	// Marshal returns the encoded form of the given value
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes the given data into the given value
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// FieldsUnmarshaler is implemented by codecs that only support events,
+// decoding the properties of an encoded event as is, including unknown properties,
+// such that they can be validated against the event schema prior to decoding the event
+type FieldsUnmarshaler interface {
+	// UnmarshalFields decodes the properties of the event encoded in the given data,
+	// mapped by the name they use in their serialized form
+	UnmarshalFields(data []byte) (map[string]interface{}, error)
+}
+
+// registry of all codecs, keyed by content type
+var (
+	codecs    = make(map[string]Codec)
+	codecsMtx sync.RWMutex
+)
+
+// RegisterCodec registers a codec for the given content type,
+// overwriting any codec previously registered for that content type.
+// A codec can be registered for multiple (alias) content types.
+func RegisterCodec(contentType string, codec Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[contentType] = codec
+}
+
+// CodecFor returns the codec registered for the given content type,
+// any parameters (e.g. charset) of the content type are ignored
+func CodecFor(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %q", contentType, err)
+	}
+
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	codec, ok := codecs[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", mediaType)
+	}
+	return codec, nil
+}
+
+// ContentTypes returns all content types a codec is registered for
+func ContentTypes() []string {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	contentTypes := make([]string, 0, len(codecs))
+	for contentType := range codecs {
+		contentTypes = append(contentTypes, contentType)
+	}
+	sort.Strings(contentTypes)
+	return contentTypes
+}
+
+// jsonCodec encodes data as JSON, supporting any value encoding/json supports
+type jsonCodec struct{}
+
+// ContentType implements Codec.ContentType
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+// Marshal implements Codec.Marshal
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements Codec.Unmarshal
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// order in which event properties are encoded by the binary codecs
+var eventFieldOrder = []string{
+	pkg.EventIDID,
+	pkg.EventUsernameID,
+	pkg.EventTimestampID,
+	pkg.EventMetricID,
+	pkg.EventCountID,
+	pkg.EventReceivedAtID,
+	pkg.EventTenantID,
+}
+
+// eventOf returns the given value as an event,
+// used by codecs that only support events
+func eventOf(v interface{}) (*pkg.Event, error) {
+	switch event := v.(type) {
+	case *pkg.Event:
+		return event, nil
+	case pkg.Event:
+		return &event, nil
+	}
+	return nil, fmt.Errorf("can't encode %T, only events are supported", v)
+}
+
+func init() {
+	RegisterCodec(ContentTypeJSON, jsonCodec{})
+	RegisterCodec(ContentTypeMsgpack, msgpackCodec{})
+	RegisterCodec("application/x-msgpack", msgpackCodec{})
+	RegisterCodec(ContentTypeProtobuf, protobufCodec{})
+	RegisterCodec("application/protobuf", protobufCodec{})
+}
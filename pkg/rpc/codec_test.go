@@ -0,0 +1,271 @@
+package rpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+)
+
+func strPtr(s string) *string { return &s }
+func intPtr(i int64) *int64   { return &i }
+
+// testEvents covers all properties, as well as the boundaries of the integer encodings
+var testEvents = []pkg.Event{
+	{
+		ID:         strPtr("4f7c0a2e"),
+		Username:   strPtr("kodingbot"),
+		Timestamp:  intPtr(1500000000),
+		Metric:     strPtr("kite_call"),
+		Count:      intPtr(12412414),
+		ReceivedAt: intPtr(1500000001),
+		Tenant:     strPtr("koding"),
+	},
+	{
+		Username:  strPtr(""),
+		Timestamp: intPtr(0),
+		Metric:    strPtr(string(bytes.Repeat([]byte{'m'}, 300))),
+		Count:     intPtr(-1),
+	},
+	{Username: strPtr("a"), Timestamp: intPtr(-33), Metric: strPtr("b"), Count: intPtr(1<<63 - 1)},
+	{Username: strPtr("a"), Timestamp: intPtr(-1 << 63), Metric: strPtr("b"), Count: intPtr(255)},
+	{Username: strPtr("a"), Timestamp: intPtr(-129), Metric: strPtr("b"), Count: intPtr(65536)},
+	{Count: intPtr(1 << 32)},
+	{},
+}
+
+func TestCodecFor(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    string
+	}{
+		{"application/json", ContentTypeJSON},
+		{"application/json; charset=utf-8", ContentTypeJSON},
+		{"application/msgpack", ContentTypeMsgpack},
+		{"application/x-msgpack", ContentTypeMsgpack},
+		{"application/x-protobuf", ContentTypeProtobuf},
+		{"application/protobuf", ContentTypeProtobuf},
+	}
+	for _, tc := range testCases {
+		codec, err := CodecFor(tc.contentType)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.contentType, err)
+			continue
+		}
+		if codec.ContentType() != tc.expected {
+			t.Errorf("%s: expected codec of %s, got %s", tc.contentType, tc.expected, codec.ContentType())
+		}
+	}
+	for _, contentType := range []string{"", "text/plain", "application/"} {
+		if _, err := CodecFor(contentType); err == nil {
+			t.Errorf("%q: expected an error", contentType)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgpack, ContentTypeProtobuf} {
+		codec, err := CodecFor(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index, event := range testEvents {
+			data, err := codec.Marshal(&event)
+			if err != nil {
+				t.Errorf("%s: couldn't marshal event #%d: %v", contentType, index, err)
+				continue
+			}
+			var decoded pkg.Event
+			if err = codec.Unmarshal(data, &decoded); err != nil {
+				t.Errorf("%s: couldn't unmarshal event #%d: %v", contentType, index, err)
+				continue
+			}
+			if !reflect.DeepEqual(decoded.Fields(), event.Fields()) {
+				t.Errorf("%s: event #%d: expected %v, got %v", contentType, index, event.Fields(), decoded.Fields())
+			}
+		}
+	}
+}
+
+func TestBinaryCodecsOnlySupportEvents(t *testing.T) {
+	for _, codec := range []Codec{msgpackCodec{}, protobufCodec{}} {
+		if _, err := codec.Marshal(map[string]interface{}{"metric": "kite_call"}); err == nil {
+			t.Errorf("%s: expected an error marshaling a map", codec.ContentType())
+		}
+		if data, err := codec.Marshal(testEvents[0]); err != nil || len(data) == 0 {
+			t.Errorf("%s: expected an event value to be marshaled, got %v", codec.ContentType(), err)
+		}
+		var fields map[string]interface{}
+		if err := codec.Unmarshal(nil, &fields); err == nil {
+			t.Errorf("%s: expected an error unmarshaling into a map", codec.ContentType())
+		}
+	}
+}
+
+// encodeTestEvent encodes the first test event using the given codec
+func encodeTestEvent(t *testing.T, codec Codec) []byte {
+	data, err := codec.Marshal(&testEvents[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	data := encodeTestEvent(t, msgpackCodec{})
+	for n := 0; n < len(data); n++ {
+		var event pkg.Event
+		if err := (msgpackCodec{}).Unmarshal(data[:n], &event); err == nil {
+			t.Errorf("expected an error for an event truncated to %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+func TestProtobufTruncated(t *testing.T) {
+	data := encodeTestEvent(t, protobufCodec{})
+	// truncating protobuf data at a field boundary results in a valid message,
+	// so only truncate within the last (tenant) field
+	tenant := len(data) - len("koding") - 2
+	for n := tenant + 1; n < len(data); n++ {
+		var event pkg.Event
+		if err := (protobufCodec{}).Unmarshal(data[:n], &event); err == nil {
+			t.Errorf("expected an error for an event truncated to %d of %d bytes", n, len(data))
+		}
+	}
+	// a varint without its last byte is invalid as well
+	var event pkg.Event
+	if err := (protobufCodec{}).Unmarshal([]byte{5<<3 | protobufVarint, 0x80}, &event); err == nil {
+		t.Error("expected an error for a truncated varint")
+	}
+}
+
+func TestTrailingBytes(t *testing.T) {
+	testCases := []struct {
+		codec    Codec
+		trailing []byte
+	}{
+		// a second value
+		{msgpackCodec{}, []byte{0xc0}},
+		{msgpackCodec{}, encodeTestEvent(t, msgpackCodec{})},
+		// an incomplete field key
+		{protobufCodec{}, []byte{0xff}},
+		// a field without value
+		{protobufCodec{}, []byte{2<<3 | protobufBytes}},
+	}
+	for _, tc := range testCases {
+		data := append(encodeTestEvent(t, tc.codec), tc.trailing...)
+		var event pkg.Event
+		if err := tc.codec.Unmarshal(data, &event); err == nil {
+			t.Errorf("%s: expected an error for trailing bytes %x", tc.codec.ContentType(), tc.trailing)
+		}
+	}
+}
+
+func TestMsgpackNesting(t *testing.T) {
+	// nest arrays in the value of an (unknown) property of the event
+	nested := func(depth int) []byte {
+		data := []byte{0x81, 0xa1, 'x'}
+		data = append(data, bytes.Repeat([]byte{0x91}, depth)...)
+		return append(data, 0xc0)
+	}
+
+	var event pkg.Event
+	if err := (msgpackCodec{}).Unmarshal(nested(msgpackMaxDepth-1), &event); err != nil {
+		t.Errorf("unexpected error for nesting up to the maximum depth: %v", err)
+	}
+	if err := (msgpackCodec{}).Unmarshal(nested(msgpackMaxDepth), &event); err == nil {
+		t.Error("expected an error for nesting beyond the maximum depth")
+	}
+	if err := (msgpackCodec{}).Unmarshal(nested(100000), &event); err == nil {
+		t.Error("expected an error for deep nesting")
+	}
+}
+
+func TestProtobufGroups(t *testing.T) {
+	// groups (wire types 3 and 4) are the only nested encoding without a length,
+	// which are never used by events and thus rejected
+	for _, data := range [][]byte{{8<<3 | 3}, {8<<3 | 4}, {8<<3 | 3, 8<<3 | 4}} {
+		var event pkg.Event
+		if err := (protobufCodec{}).Unmarshal(data, &event); err == nil {
+			t.Errorf("expected an error for group %x", data)
+		}
+	}
+}
+
+func TestOversizedHeaders(t *testing.T) {
+	testCases := []struct {
+		codec Codec
+		data  []byte
+	}{
+		// array32 and map32 with a length of 2^32-1
+		{msgpackCodec{}, []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0}},
+		{msgpackCodec{}, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'x', 0xc0}},
+		// array16 and map16 longer than the remaining data
+		{msgpackCodec{}, []byte{0xdc, 0x00, 0x03, 0xc0, 0xc0}},
+		{msgpackCodec{}, []byte{0xde, 0x00, 0x02, 0xa1, 'x', 0xc0}},
+		// array and map nested within the event
+		{msgpackCodec{}, []byte{0x81, 0xa1, 'x', 0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{msgpackCodec{}, []byte{0x81, 0xa1, 'x', 0xdf, 0x7f, 0xff, 0xff, 0xff}},
+		// str32 and bin32 with a length of 2^32-1
+		{msgpackCodec{}, []byte{0x81, 0xa1, 'x', 0xdb, 0xff, 0xff, 0xff, 0xff, 'y'}},
+		{msgpackCodec{}, []byte{0x81, 0xa1, 'x', 0xc6, 0xff, 0xff, 0xff, 0xff, 'y'}},
+		// length-delimited fields longer than the remaining data
+		{protobufCodec{}, []byte{2<<3 | protobufBytes, 0xff, 0xff, 0xff, 0xff, 0x0f, 'x'}},
+		{protobufCodec{}, []byte{8<<3 | protobufBytes, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{protobufCodec{}, []byte{2<<3 | protobufBytes, 0x02, 'x'}},
+	}
+	for _, tc := range testCases {
+		var event pkg.Event
+		if err := tc.codec.Unmarshal(tc.data, &event); err == nil {
+			t.Errorf("%s: expected an error for %x", tc.codec.ContentType(), tc.data)
+		}
+	}
+}
+
+func TestMalformedProperties(t *testing.T) {
+	testCases := []struct {
+		codec Codec
+		data  []byte
+	}{
+		// not a map
+		{msgpackCodec{}, []byte{0x90}},
+		// non-string key
+		{msgpackCodec{}, []byte{0x81, 0x01, 0x01}},
+		// username as integer, count as string
+		{msgpackCodec{}, []byte{0x81, 0xa8, 'u', 's', 'e', 'r', 'n', 'a', 'm', 'e', 0x01}},
+		{msgpackCodec{}, []byte{0x81, 0xa5, 'c', 'o', 'u', 'n', 't', 0xa1, '1'}},
+		// count overflowing an int64
+		{msgpackCodec{}, []byte{0x81, 0xa5, 'c', 'o', 'u', 'n', 't', 0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		// unsupported (extension) type
+		{msgpackCodec{}, []byte{0x81, 0xa1, 'x', 0xd4, 0x01, 0x01}},
+		// username as varint, count as string
+		{protobufCodec{}, []byte{2<<3 | protobufVarint, 0x01}},
+		{protobufCodec{}, []byte{5<<3 | protobufBytes, 0x01, '1'}},
+		// fixed-size field without its data
+		{protobufCodec{}, []byte{8<<3 | protobufFixed64, 0x01, 0x02}},
+	}
+	for _, tc := range testCases {
+		var event pkg.Event
+		if err := tc.codec.Unmarshal(tc.data, &event); err == nil {
+			t.Errorf("%s: expected an error for %x", tc.codec.ContentType(), tc.data)
+		}
+	}
+}
+
+func TestProtobufSkipsUnknownFields(t *testing.T) {
+	data := []byte{
+		8<<3 | protobufVarint, 0x96, 0x01,
+		9<<3 | protobufBytes, 0x02, 'x', 'y',
+		10<<3 | protobufFixed32, 0x01, 0x02, 0x03, 0x04,
+		11<<3 | protobufFixed64, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		5<<3 | protobufVarint, 0x2a,
+	}
+	var event pkg.Event
+	if err := (protobufCodec{}).Unmarshal(data, &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.Count == nil || *event.Count != 42 {
+		t.Errorf("expected count 42, got %v", event.Count)
+	}
+}
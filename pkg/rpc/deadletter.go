@@ -0,0 +1,465 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// Headers recording why a delivery was dead-lettered by a consumer,
+// next to the headers it was originally published with
+const (
+	HeaderRejectionReason    = "x-rejection-reason"
+	HeaderRejectionError     = "x-rejection-error"
+	HeaderRejectedBy         = "x-rejected-by"
+	HeaderRejectedAt         = "x-rejected-at"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	// added by the broker to messages it dead-letters itself
+	// More information: https://www.rabbitmq.com/dlx.html
+	headerDeath = "x-death"
+)
+
+// Reasons a delivery is dead-lettered by a consumer
+const (
+	// its content type isn't supported by any codec
+	ReasonInvalidContentType = "invalid_content_type"
+	// it couldn't be decoded using the codec of its content type
+	ReasonInvalidPayload = "invalid_payload"
+	// it was decoded, but isn't a valid event
+	ReasonInvalidEvent = "invalid_event"
+	// it was rejected by the consumer callback, without requeue
+	ReasonRejectedByConsumer = "rejected_by_consumer"
+)
+
+// Dead-letter queue constants
+const (
+	// suffix of the dead-letter queue of a consumer queue
+	deadLetterQueueSuffix = ".dead-letter"
+	// dead letters are routed by the name of the queue that rejected them
+	deadLetterExchangeType = amqp.ExchangeDirect
+)
+
+// DeadLetterQueueName returns the name of the dead-letter queue of a consumer queue
+func DeadLetterQueueName(queue string) string {
+	return queue + deadLetterQueueSuffix
+}
+
+// declareDeadLetterQueue declares the dead-letter exchange, as well as the dead-letter queue
+// of the given consumer queue, bound to the exchange using the name of the consumer queue.
+// The dead-letter queue is bounded, dropping dead letters which aren't replayed in time,
+// and the oldest ones when it is full.
+func declareDeadLetterQueue(channel *amqp.Channel, cfg *Config, queue string) error {
+	exchange := cfg.DeadLetterExchange
+	err := channel.ExchangeDeclare(
+		exchange,               // name
+		deadLetterExchangeType, // type
+		exchangeDurable,        // durable
+		exchangeAutoDeleted,    // auto-deleted
+		false,                  // internal
+		false,                  // no-wait
+		nil,                    // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't declare dead-letter exchange: %q", err)
+	}
+
+	q, err := channel.QueueDeclare(
+		DeadLetterQueueName(queue), // name
+		queueDurable,               // durable
+		queueAutoDeleted,           // delete when unused
+		queueExclusive,             // exclusive
+		false,                      // no-wait
+		amqp.Table{ // arguments
+			// more information: https://www.rabbitmq.com/ttl.html and https://www.rabbitmq.com/maxlength.html
+			"x-message-ttl": cfg.DeadLetterTTL.Nanoseconds() / 1000000,
+			"x-max-length":  int64(cfg.DeadLetterMaxLength),
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("couldn't declare dead-letter queue: %q", err)
+	}
+	if err = channel.QueueBind(q.Name, queue, exchange, false, nil); err != nil {
+		return fmt.Errorf("couldn't bind dead-letter queue: %q", err)
+	}
+	return nil
+}
+
+// confirmChannel publishes messages on a channel in confirm mode,
+// waiting for each of them to be confirmed by the broker. Confirmations are matched
+// to the messages by their delivery tag, such that a confirmation which comes in
+// after its message timed out isn't mistaken for the confirmation of a later message.
+type confirmChannel struct {
+	channel *amqp.Channel
+
+	mtx sync.Mutex
+	// delivery tag of the last published message
+	published uint64
+	// messages waiting for confirmation, by delivery tag
+	pending map[uint64]chan bool
+	// set once the channel is closed, and thus no more confirmations will come in
+	closed bool
+}
+
+// newConfirmChannel puts the given channel in confirm mode,
+// and listens for its confirmations until it is closed
+func newConfirmChannel(channel *amqp.Channel) (*confirmChannel, error) {
+	if err := channel.Confirm(false); err != nil {
+		return nil, fmt.Errorf("couldn't put channel in confirm mode: %q", err)
+	}
+	cc := &confirmChannel{
+		channel: channel,
+		pending: make(map[uint64]chan bool),
+	}
+	go cc.listenConfirms(channel.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	return cc, nil
+}
+
+// publish a (persistent) message, and wait until the broker confirmed it,
+// returns ErrNacked or ErrDispatchTimeout in case it didn't (in time)
+func (cc *confirmChannel) publish(exchange, key string, msg amqp.Publishing, timeout time.Duration) error {
+	confirmed := make(chan bool, 1)
+
+	cc.mtx.Lock()
+	if cc.closed {
+		cc.mtx.Unlock()
+		return ErrProducerClosed
+	}
+	// delivery tags are assigned by the broker, starting at 1,
+	// incremented for each message published on this channel
+	tag := cc.published + 1
+	cc.pending[tag] = confirmed
+	err := cc.channel.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg)
+	if err != nil {
+		delete(cc.pending, tag)
+		cc.mtx.Unlock()
+		return err
+	}
+	cc.published = tag
+	cc.mtx.Unlock()
+
+	select {
+	case ack, ok := <-confirmed:
+		if !ok {
+			return ErrProducerClosed
+		}
+		if !ack {
+			return ErrNacked
+		}
+		return nil
+	case <-time.After(timeout):
+		// its confirmation is ignored, should it still come in
+		cc.mtx.Lock()
+		delete(cc.pending, tag)
+		cc.mtx.Unlock()
+		return ErrDispatchTimeout
+	}
+}
+
+// listenConfirms passes the confirmations to the messages waiting for them,
+// until the channel is closed
+func (cc *confirmChannel) listenConfirms(confirms <-chan amqp.Confirmation) {
+	for confirmation := range confirms {
+		cc.mtx.Lock()
+		confirmed, ok := cc.pending[confirmation.DeliveryTag]
+		delete(cc.pending, confirmation.DeliveryTag)
+		cc.mtx.Unlock()
+		if ok {
+			confirmed <- confirmation.Ack
+		}
+	}
+
+	// it's unknown whether or not the broker received the pending messages
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	cc.closed = true
+	for tag, confirmed := range cc.pending {
+		delete(cc.pending, tag)
+		close(confirmed)
+	}
+}
+
+// deadLetter rejects a delivery without requeueing it, such that it ends up in the dead-letter queue.
+// The consumer publishes it to the dead-letter exchange itself, such that the reason it was rejected
+// is recorded in its headers, and only acknowledges it once the broker confirmed the dead letter.
+// In case that fails it is rejected, dead-lettering it by the broker (without a reason).
+// NOTE: a dead letter which is confirmed too late ends up twice in the dead-letter queue.
+func (cons *AMQPConsumer) deadLetter(data *amqp.Delivery, reason string, cause error) {
+	exchange := cons.cfg.AMQP.DeadLetterExchange
+	cons.mtx.Lock()
+	confirms := cons.confirms
+	cons.mtx.Unlock()
+	if exchange == "" || confirms == nil {
+		// dead-lettering is disabled, the broker discards it
+		consumerDiscarded.Inc(cons.cfg.Name, reason)
+		data.Reject(false)
+		return
+	}
+
+	headers := make(amqp.Table, len(data.Headers)+6)
+	for key, value := range data.Headers {
+		headers[key] = value
+	}
+	headers[HeaderRejectionReason] = reason
+	headers[HeaderRejectionError] = cause.Error()
+	headers[HeaderRejectedBy] = cons.cfg.Name
+	headers[HeaderRejectedAt] = time.Now().UTC()
+	// replayed dead letters are published directly to the queue (see Replay),
+	// and thus keep the exchange and routing key they were originally published with
+	if _, ok := headers[HeaderOriginalExchange]; !ok {
+		headers[HeaderOriginalExchange] = data.Exchange
+		headers[HeaderOriginalRoutingKey] = data.RoutingKey
+	}
+
+	// routed by the name of the dead-letter queue without suffix
+	err := confirms.publish(exchange, cons.cfg.Name, amqp.Publishing{
+		ContentType:     data.ContentType,
+		ContentEncoding: data.ContentEncoding,
+		MessageId:       data.MessageId,
+		Timestamp:       data.Timestamp,
+		Headers:         headers,
+		DeliveryMode:    amqp.Persistent,
+		Body:            data.Body,
+	}, cons.cfg.AMQP.ConfirmTimeout)
+	if err != nil {
+		log.Warningf("couldn't publish dead letter, rejecting it instead: %q", err)
+		consumerDeadLetterFailures.Inc(cons.cfg.Name, reason)
+		data.Reject(false)
+		return
+	}
+	consumerDeadLetters.Inc(cons.cfg.Name, reason)
+	data.Ack(false)
+}
+
+// DeadLetter is a message dead-lettered by a consumer (or the broker),
+// fetched from a dead-letter queue (see DeadLetters)
+type DeadLetter struct {
+	// position within the fetched dead letters, starting at 1
+	Index       int
+	MessageID   string
+	ContentType string
+	Body        []byte
+	// all headers, including the ones recording why it was dead-lettered
+	Headers map[string]interface{}
+
+	// the consumer queue that rejected it, why it did so and when
+	Queue      string
+	Reason     string
+	Error      string
+	RejectedAt time.Time
+
+	// exchange and routing key it was originally published with
+	Exchange   string
+	RoutingKey string
+
+	delivery amqp.Delivery
+}
+
+// newDeadLetter creates a dead letter from a delivery of a dead-letter queue,
+// falling back to the x-death header in case it was dead-lettered by the broker
+// (e.g. because it expired, or the consumer couldn't publish it itself)
+func newDeadLetter(index int, delivery amqp.Delivery) *DeadLetter {
+	letter := &DeadLetter{
+		Index:       index,
+		MessageID:   delivery.MessageId,
+		ContentType: delivery.ContentType,
+		Body:        delivery.Body,
+		Headers:     delivery.Headers,
+		delivery:    delivery,
+	}
+
+	if reason, ok := delivery.Headers[HeaderRejectionReason].(string); ok {
+		letter.Reason = reason
+		letter.Error, _ = delivery.Headers[HeaderRejectionError].(string)
+		letter.Queue, _ = delivery.Headers[HeaderRejectedBy].(string)
+		letter.RejectedAt, _ = delivery.Headers[HeaderRejectedAt].(time.Time)
+		letter.Exchange, _ = delivery.Headers[HeaderOriginalExchange].(string)
+		letter.RoutingKey, _ = delivery.Headers[HeaderOriginalRoutingKey].(string)
+		return letter
+	}
+
+	// the most recent death is listed first
+	deaths, _ := delivery.Headers[headerDeath].([]interface{})
+	if len(deaths) == 0 {
+		return letter
+	}
+	death, ok := deaths[0].(amqp.Table)
+	if !ok {
+		return letter
+	}
+	letter.Reason, _ = death["reason"].(string)
+	letter.Queue, _ = death["queue"].(string)
+	letter.RejectedAt, _ = death["time"].(time.Time)
+	letter.Exchange, _ = death["exchange"].(string)
+	if keys, _ := death["routing-keys"].([]interface{}); len(keys) > 0 {
+		letter.RoutingKey, _ = keys[0].(string)
+	}
+	return letter
+}
+
+// replayHeaders returns the headers a dead letter is replayed with,
+// which are the headers it was originally published with,
+// as well as the exchange and routing key it was originally published with
+func (letter *DeadLetter) replayHeaders() amqp.Table {
+	headers := make(amqp.Table, len(letter.Headers))
+	for key, value := range letter.Headers {
+		switch {
+		case key == HeaderRejectionReason, key == HeaderRejectionError,
+			key == HeaderRejectedBy, key == HeaderRejectedAt,
+			key == headerDeath, strings.HasPrefix(key, "x-first-death-"),
+			strings.HasPrefix(key, "x-last-death-"):
+			continue
+		}
+		headers[key] = value
+	}
+	if letter.Exchange != "" || letter.RoutingKey != "" {
+		headers[HeaderOriginalExchange] = letter.Exchange
+		headers[HeaderOriginalRoutingKey] = letter.RoutingKey
+	}
+	return headers
+}
+
+// ErrDeadLetteringDisabled is returned when opening the dead letters,
+// while no dead-letter exchange is configured
+var ErrDeadLetteringDisabled = errors.New("dead-lettering is disabled, as no dead-letter exchange is given")
+
+// OpenDeadLetters opens the dead-letter queue of the given consumer queue,
+// such that its dead letters can be inspected and replayed.
+// NOTE: Always make sure to Close the opened DeadLetters!
+func OpenDeadLetters(cfg *Config, queue string) (*DeadLetters, error) {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	} else if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("can't open dead letters as config is invalid: %q", err)
+	}
+	if cfg.DeadLetterExchange == "" {
+		return nil, ErrDeadLetteringDisabled
+	}
+
+	dl := &DeadLetters{consumerQueue: queue, queue: DeadLetterQueueName(queue)}
+	var err error
+	if dl.ch, err = NewAMQPChannel(cfg, dl.setup); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// DeadLetters gives access to the dead letters of a single consumer queue.
+// Fetched dead letters stay in the queue (unacknowledged) until they are replayed,
+// those which aren't are returned to the queue once the DeadLetters is closed.
+type DeadLetters struct {
+	ch            *AMQPChannel
+	consumerQueue string
+	queue         string
+
+	mtx sync.Mutex
+	// publishes the replayed dead letters of the current channel
+	confirms *confirmChannel
+}
+
+// setup a new channel, in confirm mode,
+// ensuring the dead-letter queue exists (as it is declared by its consumer),
+// dead letters are replayed on it once activated
+func (dl *DeadLetters) setup(channel *amqp.Channel) (func(), error) {
+	_, err := channel.QueueDeclarePassive(
+		dl.queue,         // name
+		queueDurable,     // durable
+		queueAutoDeleted, // delete when unused
+		queueExclusive,   // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find dead-letter queue %q: %q", dl.queue, err)
+	}
+	confirms, err := newConfirmChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		dl.mtx.Lock()
+		dl.confirms = confirms
+		dl.mtx.Unlock()
+	}, nil
+}
+
+// Queue returns the name of the dead-letter queue
+func (dl *DeadLetters) Queue() string {
+	return dl.queue
+}
+
+// Fetch up to limit dead letters, in the order they were dead-lettered
+func (dl *DeadLetters) Fetch(limit int) ([]*DeadLetter, error) {
+	channel := dl.ch.current()
+	if channel == nil {
+		return nil, ErrChannelLost
+	}
+
+	var letters []*DeadLetter
+	for len(letters) < limit {
+		delivery, ok, err := channel.Get(dl.queue, false)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get dead letter: %q", err)
+		}
+		if !ok {
+			break // queue is empty
+		}
+		letters = append(letters, newDeadLetter(len(letters)+1, delivery))
+	}
+	return letters, nil
+}
+
+// replayRoute returns the exchange and routing key a dead letter of the given consumer queue is replayed with,
+// which is the consumer queue that rejected it, using the default exchange (which routes by queue name),
+// such that it isn't delivered again to the other consumer queues bound to the exchange
+func (letter *DeadLetter) replayRoute(consumerQueue string) (exchange, key string) {
+	// dead letters without headers (if any) can only have been rejected by the consumer queue
+	if letter.Queue != "" {
+		return "", letter.Queue
+	}
+	return "", consumerQueue
+}
+
+// Replay a dead letter, publishing it directly to the consumer queue that rejected it (see replayRoute),
+// using its current content type and body (which can be edited) and its original headers.
+// Once the broker confirmed it, it is removed from the dead-letter queue.
+// NOTE: Dead letters can only be replayed one at a time.
+func (dl *DeadLetters) Replay(letter *DeadLetter) error {
+	if dl.ch.current() == nil {
+		return ErrChannelLost
+	}
+	dl.mtx.Lock()
+	confirms := dl.confirms
+	dl.mtx.Unlock()
+
+	exchange, key := letter.replayRoute(dl.consumerQueue)
+	err := confirms.publish(exchange, key, amqp.Publishing{
+		ContentType:  letter.ContentType,
+		MessageId:    letter.MessageID,
+		Headers:      letter.replayHeaders(),
+		DeliveryMode: amqp.Persistent,
+		Body:         letter.Body,
+	}, dl.ch.cfg.ConfirmTimeout)
+	if err != nil {
+		return err
+	}
+	return letter.delivery.Ack(false)
+}
+
+// Close the channel and connection,
+// returning all fetched dead letters that weren't replayed to the dead-letter queue
+func (dl *DeadLetters) Close() error {
+	return dl.ch.Close()
+}
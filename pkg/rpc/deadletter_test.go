@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestReplayRoute(t *testing.T) {
+	rejectedAt := time.Unix(1500000000, 0).UTC()
+	testCases := []struct {
+		name     string
+		delivery amqp.Delivery
+		queue    string
+	}{
+		{
+			name: "dead-lettered by consumer",
+			delivery: amqp.Delivery{Headers: amqp.Table{
+				HeaderRejectionReason:    ReasonInvalidEvent,
+				HeaderRejectionError:     "metric: has to match pattern",
+				HeaderRejectedBy:         "accountName",
+				HeaderRejectedAt:         rejectedAt,
+				HeaderOriginalExchange:   "metric-collector",
+				HeaderOriginalRoutingKey: "kite.call.1b2c3d4e",
+			}},
+			queue: "accountName",
+		},
+		{
+			name: "dead-lettered by broker",
+			delivery: amqp.Delivery{Headers: amqp.Table{
+				headerDeath: []interface{}{amqp.Table{
+					"reason":       "expired",
+					"queue":        "hourlyLog",
+					"time":         rejectedAt,
+					"exchange":     "metric-collector",
+					"routing-keys": []interface{}{"kite.call.1b2c3d4e"},
+				}},
+			}},
+			queue: "hourlyLog",
+		},
+		{
+			name:     "without headers",
+			delivery: amqp.Delivery{},
+			queue:    "distinctName",
+		},
+	}
+	for _, tc := range testCases {
+		letter := newDeadLetter(1, tc.delivery)
+		exchange, key := letter.replayRoute("distinctName")
+		// the default exchange routes a message only to the queue named by its routing key,
+		// such that the other queues bound to the original exchange don't receive it again
+		if exchange != "" || key != tc.queue {
+			t.Errorf("%s: expected to be replayed to queue %q using the default exchange, got exchange %q and key %q",
+				tc.name, tc.queue, exchange, key)
+		}
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	letter := newDeadLetter(1, amqp.Delivery{Headers: amqp.Table{
+		"traceparent":            "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		HeaderRejectionReason:    ReasonInvalidEvent,
+		HeaderRejectionError:     "invalid",
+		HeaderRejectedBy:         "accountName",
+		HeaderRejectedAt:         time.Now(),
+		HeaderOriginalExchange:   "metric-collector",
+		HeaderOriginalRoutingKey: "kite.call.1b2c3d4e",
+		"x-first-death-reason":   "rejected",
+	}})
+	headers := letter.replayHeaders()
+	for _, key := range []string{HeaderRejectionReason, HeaderRejectionError, HeaderRejectedBy,
+		HeaderRejectedAt, "x-first-death-reason"} {
+		if _, ok := headers[key]; ok {
+			t.Errorf("expected header %s to be dropped", key)
+		}
+	}
+	expected := map[string]string{
+		"traceparent":            "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		HeaderOriginalExchange:   "metric-collector",
+		HeaderOriginalRoutingKey: "kite.call.1b2c3d4e",
+	}
+	for key, value := range expected {
+		if headers[key] != value {
+			t.Errorf("expected header %s to be %q, got %v", key, value, headers[key])
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+)
+
+// msgpackCodec encodes events as a MessagePack map,
+// using the same property names as the JSON form of an event.
+// More information: https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackCodec struct{}
+
+// maximum nesting depth of decoded MessagePack values
+const msgpackMaxDepth = 32
+
+// ContentType implements Codec.ContentType
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+// Marshal implements Codec.Marshal, only events are supported
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	event, err := eventOf(v)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := event.Fields()
+	buf := msgpackAppendMapHeader(nil, len(fields))
+	for _, name := range eventFieldOrder {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		buf = msgpackAppendString(buf, name)
+		switch v := value.(type) {
+		case string:
+			buf = msgpackAppendString(buf, v)
+		case int64:
+			buf = msgpackAppendInt(buf, v)
+		}
+	}
+	return buf, nil
+}
+
+// Unmarshal implements Codec.Unmarshal, only events are supported
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	event, ok := v.(*pkg.Event)
+	if !ok {
+		return fmt.Errorf("msgpack codec can't decode into %T, only *pkg.Event is supported", v)
+	}
+	fields, err := msgpackCodec{}.UnmarshalFields(data)
+	if err != nil {
+		return err
+	}
+	return event.SetFields(fields)
+}
+
+// UnmarshalFields implements FieldsUnmarshaler.UnmarshalFields
+func (msgpackCodec) UnmarshalFields(data []byte) (map[string]interface{}, error) {
+	dec := msgpackDecoder{data: data}
+	value, err := dec.readValue(0)
+	if err != nil {
+		return nil, err
+	}
+	if dec.offset != len(data) {
+		return nil, errors.New("msgpack: unexpected data after event")
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("msgpack: expected event to be a map, got %T", value)
+	}
+	return fields, nil
+}
+
+func msgpackAppendMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(buf, 0xde, byte(n>>8), byte(n))
+	}
+	return append(buf, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func msgpackAppendString(buf []byte, str string) []byte {
+	n := len(str)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, str...)
+}
+
+// msgpackAppendInt appends an integer, using the smallest representation possible
+func msgpackAppendInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		return append(buf, byte(i)) // positive fixint
+	case i >= -32 && i < 0:
+		return append(buf, byte(i)) // negative fixint
+	case i >= 0 && i <= math.MaxUint8:
+		return append(buf, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		return append(buf, 0xcd, byte(i>>8), byte(i))
+	case i >= 0 && i <= math.MaxUint32:
+		return append(buf, 0xce, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	case i >= 0:
+		buf = append(buf, 0xcf)
+	case i >= math.MinInt8:
+		return append(buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return append(buf, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		return append(buf, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	default:
+		buf = append(buf, 0xd3)
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	return append(buf, b[:]...)
+}
+
+// msgpackDecoder decodes MessagePack values into their generic Go form,
+// extension types are not supported
+type msgpackDecoder struct {
+	data   []byte
+	offset int
+}
+
+// errMsgpackShort is returned when the data ends in the middle of a value
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.offset < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) readValue(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: maximum nesting depth exceeded")
+	}
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.readMap(int(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.readArray(int(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		return d.readString(int(c & 0x1f))
+	}
+
+	switch b[0] {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (b[0] - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), bin...), nil
+	case 0xca:
+		u, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (b[0] - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	case 0xd0:
+		u, err := d.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return int64(u), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (b[0] - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (b[0] - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (b[0] - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(n), depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", b[0])
+}
+
+func (d *msgpackDecoder) readString(n int) (interface{}, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) readArray(n int, depth int) (interface{}, error) {
+	// each element requires at least one byte,
+	// which prevents allocating huge arrays for invalid lengths
+	if n > len(d.data)-d.offset {
+		return nil, errMsgpackShort
+	}
+	array := make([]interface{}, n)
+	for i := range array {
+		value, err := d.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		array[i] = value
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) readMap(n int, depth int) (interface{}, error) {
+	if n > len(d.data)-d.offset {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.readValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: expected map key to be a string, got %T", key)
+		}
+		if m[name], err = d.readValue(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
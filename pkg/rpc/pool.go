@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// NewAMQPProducerPool creates a goroutine-safe Producer,
+// dispatching data using a pool of producers, each with their own channel.
+// The channels are spread evenly over the given amount of connections.
+// NOTE: Always make sure to Close a created producer pool!
+func NewAMQPProducerPool(cfg *Config, size, connections int) (*AMQPProducerPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("%d is an invalid pool size, should be at least 1", size)
+	}
+	if connections < 1 || connections > size {
+		return nil, fmt.Errorf(
+			"%d is an invalid amount of connections, should be in the range [1, %d]",
+			connections, size)
+	}
+
+	if cfg == nil {
+		cfg = DefaultConfig()
+	} else if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("can't create producer pool as config is invalid: %q", err)
+	}
+
+	conns := make([]*amqpConnection, connections)
+	for index := range conns {
+		conns[index] = newAMQPConnection(cfg.URI)
+	}
+
+	pool := &AMQPProducerPool{
+		producers: make([]*AMQPProducer, 0, size),
+		free:      make(chan *AMQPProducer, size),
+	}
+	for index := 0; index < size; index++ {
+		prod, err := newAMQPProducer(cfg, conns[index%connections])
+		if err != nil {
+			pool.Close() // ensure already created producers are closed
+			return nil, err
+		}
+		pool.producers = append(pool.producers, prod)
+		pool.free <- prod
+	}
+
+	log.Infof("created pool of %d producers over %d connection(s)", size, connections)
+	return pool, nil
+}
+
+// ErrPoolClosed is returned when dispatching using a closed producer pool
+var ErrPoolClosed = errors.New("producer pool was closed")
+
+// AMQPProducerPool is a goroutine-safe Producer, which hands each dispatch
+// to a free producer of its pool, such that dispatches can be published concurrently.
+// A producer is only taken from the pool while publishing,
+// not while waiting for the broker to confirm the dispatch.
+type AMQPProducerPool struct {
+	producers []*AMQPProducer
+	free      chan *AMQPProducer
+
+	mtx    sync.Mutex
+	closed bool
+	// pool metrics
+	busy       int
+	maxBusy    int
+	dispatches int64
+	waits      int64
+	totalWait  time.Duration
+	maxWait    time.Duration
+}
+
+// Dispatch data using a free producer of the pool,
+// and wait until the broker has confirmed it
+func (pool *AMQPProducerPool) Dispatch(ctx context.Context, data interface{}) error {
+	return pool.DispatchAsync(ctx, data).Wait()
+}
+
+// DispatchAsync dispatches data using a free producer of the pool,
+// blocking until a producer is available
+func (pool *AMQPProducerPool) DispatchAsync(ctx context.Context, data interface{}) *Future {
+	prod, err := pool.acquire()
+	if err != nil {
+		return newResolvedFuture(err)
+	}
+	defer pool.release(prod)
+	return prod.DispatchAsync(ctx, data)
+}
+
+// Ping ensures all producers of the pool are connected,
+// pinging the broker only once per connection
+func (pool *AMQPProducerPool) Ping() error {
+	pinged := make(map[*amqpConnection]bool)
+	for _, prod := range pool.producers {
+		if err := prod.ch.status(); err != nil {
+			return err
+		}
+		if pinged[prod.ch.conn] {
+			continue
+		}
+		if err := prod.ch.conn.ping(); err != nil {
+			return err
+		}
+		pinged[prod.ch.conn] = true
+	}
+	return nil
+}
+
+// acquire a free producer, waiting for one in case all of them are busy
+func (pool *AMQPProducerPool) acquire() (*AMQPProducer, error) {
+	var prod *AMQPProducer
+	var wait time.Duration
+
+	select {
+	case prod = <-pool.free:
+	default:
+		start := time.Now()
+		prod = <-pool.free
+		wait = time.Since(start)
+	}
+
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	if pool.closed {
+		pool.free <- prod
+		return nil, ErrPoolClosed
+	}
+
+	pool.busy++
+	if pool.busy > pool.maxBusy {
+		pool.maxBusy = pool.busy
+	}
+	pool.dispatches++
+	if wait > 0 {
+		pool.waits++
+		pool.totalWait += wait
+		if wait > pool.maxWait {
+			pool.maxWait = wait
+		}
+	}
+	return prod, nil
+}
+
+// release a producer, returning it to the pool
+func (pool *AMQPProducerPool) release(prod *AMQPProducer) {
+	pool.mtx.Lock()
+	pool.busy--
+	pool.mtx.Unlock()
+	pool.free <- prod
+}
+
+// Close all producers of the pool, and the connections they use
+func (pool *AMQPProducerPool) Close() (err error) {
+	pool.mtx.Lock()
+	pool.closed = true
+	pool.mtx.Unlock()
+
+	for _, prod := range pool.producers {
+		if closeErr := prod.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// String returns the pool metrics as a valid JSON Object,
+// implementing the expvar.Var interface
+func (pool *AMQPProducerPool) String() string {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	size := len(pool.producers)
+	var avgWait time.Duration
+	if pool.waits > 0 {
+		avgWait = pool.totalWait / time.Duration(pool.waits)
+	}
+
+	return fmt.Sprintf(`{"size": %d, "busy": %d, "maxBusy": %d, "utilization": %f, `+
+		`"dispatches": %d, "waits": %d, "avgWait": %f, "maxWait": %f}`,
+		size, pool.busy, pool.maxBusy, float64(pool.busy)/float64(size),
+		pool.dispatches, pool.waits, avgWait.Seconds(), pool.maxWait.Seconds())
+}
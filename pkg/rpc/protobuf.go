@@ -0,0 +1,131 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+)
+
+// protobufCodec encodes events as the Event message defined in event.proto,
+// the field number of each property is its position in eventFieldOrder (starting at 1).
+// More information: https://developers.google.com/protocol-buffers/docs/encoding
+type protobufCodec struct{}
+
+// protobuf wire types
+const (
+	protobufVarint  = 0
+	protobufFixed64 = 1
+	protobufBytes   = 2
+	protobufFixed32 = 5
+)
+
+// ContentType implements Codec.ContentType
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+// Marshal implements Codec.Marshal, only events are supported
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	event, err := eventOf(v)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := event.Fields()
+	var buf []byte
+	for index, name := range eventFieldOrder {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		number := uint64(index + 1)
+		switch v := value.(type) {
+		case string:
+			buf = protobufAppendVarint(buf, number<<3|protobufBytes)
+			buf = protobufAppendVarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		case int64:
+			// int64 fields are encoded as two's complement varints
+			buf = protobufAppendVarint(buf, number<<3|protobufVarint)
+			buf = protobufAppendVarint(buf, uint64(v))
+		}
+	}
+	return buf, nil
+}
+
+// Unmarshal implements Codec.Unmarshal, only events are supported,
+// unknown fields are skipped
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	event, ok := v.(*pkg.Event)
+	if !ok {
+		return fmt.Errorf("protobuf codec can't decode into %T, only *pkg.Event is supported", v)
+	}
+	fields, err := protobufCodec{}.UnmarshalFields(data)
+	if err != nil {
+		return err
+	}
+	return event.SetFields(fields)
+}
+
+// UnmarshalFields implements FieldsUnmarshaler.UnmarshalFields,
+// unknown fields are named after their field number, as their name isn't encoded
+func (protobufCodec) UnmarshalFields(data []byte) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("protobuf: invalid field key")
+		}
+		data = data[n:]
+		number, wireType := key>>3, key&0x7
+
+		name := strconv.FormatUint(number, 10)
+		if number >= 1 && number <= uint64(len(eventFieldOrder)) {
+			name = eventFieldOrder[number-1]
+		}
+
+		switch wireType {
+		case protobufVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("protobuf: invalid varint for field %d", number)
+			}
+			data = data[n:]
+			fields[name] = int64(value)
+
+		case protobufBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, fmt.Errorf("protobuf: invalid length for field %d", number)
+			}
+			fields[name] = string(data[n : n+int(length)])
+			data = data[n+int(length):]
+
+		case protobufFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("protobuf: unexpected end of data for field %d", number)
+			}
+			fields[name] = binary.LittleEndian.Uint64(data) // no event property uses a fixed size type
+			data = data[8:]
+
+		case protobufFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("protobuf: unexpected end of data for field %d", number)
+			}
+			fields[name] = binary.LittleEndian.Uint32(data)
+			data = data[4:]
+
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported wire type %d for field %d", wireType, number)
+		}
+	}
+	return fields, nil
+}
+
+// protobufAppendVarint appends an unsigned integer as a varint
+func protobufAppendVarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
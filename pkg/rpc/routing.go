@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/streadway/amqp"
+
+	"github.com/glendc/data-ingestion-challenge/pkg"
+)
+
+// Exchange types supported by the -exchange-type flag
+const (
+	// ExchangeFanout delivers every message to every bound queue,
+	// bindings are ignored
+	ExchangeFanout = "fanout"
+	// ExchangeTopic routes messages using their routing key (see RoutingKey),
+	// bindings are topic patterns such as "kite.#"
+	ExchangeTopic = "topic"
+	// ExchangeHeaders routes messages using their headers (see routingHeaders),
+	// bindings are header matches such as "metric=kite_call,tenant=koding"
+	ExchangeHeaders = "headers"
+)
+
+// exchangeTypes lists all supported exchange types
+var exchangeTypes = []string{ExchangeFanout, ExchangeTopic, ExchangeHeaders}
+
+// validateExchangeType ensures the given exchange type is supported
+func validateExchangeType(kind string) error {
+	for _, supported := range exchangeTypes {
+		if kind == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported exchange type %q, expected one of %v", kind, exchangeTypes)
+}
+
+// Headers of a dispatched event, matched by the bindings of a headers exchange
+const (
+	HeaderMetric       = "metric"
+	HeaderUsernameHash = "username-hash"
+	HeaderTenant       = "tenant"
+)
+
+// RoutingKey returns the routing key an event is published with:
+// the words of its metric (split on underscores), followed by the hash of its username,
+// e.g. "kite.call.1b2c3d4e" for metric "kite_call".
+// Topic patterns can thus match a metric prefix ("kite.#"),
+// an exact metric ("kite.call.*") or all events ("#").
+func RoutingKey(event *pkg.Event) string {
+	var metric, username string
+	if event.Metric != nil {
+		metric = *event.Metric
+	}
+	if event.Username != nil {
+		username = *event.Username
+	}
+	return strings.Replace(metric, "_", ".", -1) + "." + usernameHash(username)
+}
+
+// usernameHash returns the (hex encoded) FNV-1a hash of a username,
+// which keeps routing keys short, while still allowing to shard by username
+func usernameHash(username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// routingHeaders returns the headers an event is published with
+func routingHeaders(event *pkg.Event) amqp.Table {
+	headers := amqp.Table{
+		HeaderTenant: event.TenantName(),
+	}
+	if event.Metric != nil {
+		headers[HeaderMetric] = *event.Metric
+	}
+	if event.Username != nil {
+		headers[HeaderUsernameHash] = usernameHash(*event.Username)
+	}
+	return headers
+}
+
+// binding of a queue to the exchange
+type binding struct {
+	key  string
+	args amqp.Table
+}
+
+// parseBindings parses the binding patterns of a consumer,
+// for the given exchange type. A queue without patterns receives all messages.
+func parseBindings(kind string, patterns []string) ([]binding, error) {
+	switch kind {
+	case ExchangeFanout:
+		// routing keys are ignored by a fanout exchange
+		return []binding{{}}, nil
+
+	case ExchangeTopic:
+		if len(patterns) == 0 {
+			return []binding{{key: "#"}}, nil
+		}
+		bindings := make([]binding, 0, len(patterns))
+		for _, pattern := range patterns {
+			if pattern == "" {
+				return nil, fmt.Errorf("topic binding pattern can't be empty")
+			}
+			bindings = append(bindings, binding{key: pattern})
+		}
+		return bindings, nil
+
+	case ExchangeHeaders:
+		if len(patterns) == 0 {
+			// no headers to match, thus matching all messages
+			return []binding{{args: amqp.Table{"x-match": "all"}}}, nil
+		}
+		bindings := make([]binding, 0, len(patterns))
+		for _, pattern := range patterns {
+			args := amqp.Table{"x-match": "all"}
+			for _, match := range strings.Split(pattern, ",") {
+				parts := strings.SplitN(strings.TrimSpace(match), "=", 2)
+				if len(parts) != 2 || parts[0] == "" {
+					return nil, fmt.Errorf(
+						"invalid headers binding %q, expected header=value[,header=value...]", pattern)
+				}
+				args[parts[0]] = parts[1]
+			}
+			bindings = append(bindings, binding{args: args})
+		}
+		return bindings, nil
+	}
+
+	return nil, validateExchangeType(kind)
+}
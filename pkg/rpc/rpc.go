@@ -1,6 +1,10 @@
 package rpc
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/glendc/data-ingestion-challenge/pkg"
 )
 
@@ -9,8 +13,89 @@ import (
 type Producer interface {
 	// Close any open connections and clean up
 	Close() error
-	// Dispatch data over an open connection
-	Dispatch(data interface{}) error
+	// Dispatch data over an open connection,
+	// propagating the trace of the span carried by the given context
+	Dispatch(ctx context.Context, data interface{}) error
+	// Ping ensures the connection is open and usable
+	Ping() error
+}
+
+// AsyncProducer defines an interface for a producer
+// that can dispatch data without waiting for it to be confirmed,
+// allowing many dispatches to be in-flight at the same time
+type AsyncProducer interface {
+	Producer
+	// DispatchAsync dispatches data over an open connection,
+	// returning a future that is resolved once the dispatch is confirmed
+	DispatchAsync(ctx context.Context, data interface{}) *Future
+}
+
+// ErrDispatchTimeout is returned when a dispatch wasn't confirmed in time
+var ErrDispatchTimeout = errors.New("dispatch wasn't confirmed in time")
+
+// newFuture creates an unresolved future,
+// which times out after the given timeout (if positive)
+func newFuture(timeout time.Duration) *Future {
+	f := &Future{done: make(chan struct{})}
+	if timeout > 0 {
+		f.deadline = time.Now().Add(timeout)
+	}
+	return f
+}
+
+// newResolvedFuture creates a future that is resolved already
+func newResolvedFuture(err error) *Future {
+	f := newFuture(0)
+	f.resolve(err)
+	return f
+}
+
+// Future is the pending result of an asynchronous dispatch
+type Future struct {
+	done     chan struct{}
+	err      error
+	deadline time.Time
+}
+
+// Done returns a channel that is closed once the future is resolved
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait until the dispatch is confirmed, returning the error if it failed.
+// ErrDispatchTimeout is returned in case it wasn't confirmed before the deadline,
+// in which case it is unknown if the dispatch failed or not.
+func (f *Future) Wait() error {
+	if f.deadline.IsZero() {
+		<-f.done
+		return f.err
+	}
+
+	timer := time.NewTimer(f.deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return f.err
+	case <-timer.C:
+		return ErrDispatchTimeout
+	}
+}
+
+// resolvedError returns the error of a resolved future,
+// nil in case it failed or isn't resolved yet
+func (f *Future) resolvedError() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// resolve the future, should be called only once
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
 }
 
 // NewConsumeError creates an error that has happened during consumption
@@ -36,7 +121,9 @@ func (e *ConsumeError) Error() string {
 
 // ConsumeCallback is the function that is to be used by actual consumers,
 // to process the data and use it for a practical purpose.
-type ConsumeCallback func(event *pkg.Event) *ConsumeError
+// The given context carries the span of the consumption,
+// part of the trace propagated by the producer of the event (if any).
+type ConsumeCallback func(ctx context.Context, event *pkg.Event) *ConsumeError
 
 // Consumer defines an interface on the consumption side of an RPC system
 // It's only required functionality is that it Listens to an open connection
@@ -46,4 +133,9 @@ type Consumer interface {
 	Close() error
 	// Listen to an open connection and Consume the data via the given callback
 	ListenAndConsume(ConsumeCallback)
+	// Cancel the consumption of data, ListenAndConsume returns
+	// once all data received prior to cancelling is consumed
+	Cancel() error
+	// Ping ensures the connection is open and usable
+	Ping() error
 }
@@ -0,0 +1,355 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is the subset of JSON Schema (draft 4) used to validate decoded JSON values.
+// Supported keywords: type, required, properties, additionalProperties,
+// readOnly, pattern, minLength, maxLength, minimum and maximum.
+// The non-standard maxBodySize keyword defines the maximum size (in bytes)
+// of the serialized value, it's up to the user of the schema to enforce it.
+type Schema struct {
+	Type                 Types              `json:"type,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MaxBodySize          int64              `json:"maxBodySize,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Types is the list of types a value is allowed to be,
+// in its serialized form it can be a single string, or an array of strings
+type Types []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("type has to be a string or an array of strings: %q", err)
+	}
+	*t = Types(multiple)
+	return nil
+}
+
+// Types supported by the schema
+const (
+	TypeObject  = "object"
+	TypeArray   = "array"
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeBoolean = "boolean"
+	TypeNull    = "null"
+)
+
+// Rules a value can violate, equal to the keyword that defines the rule
+const (
+	RuleType                 = "type"
+	RuleRequired             = "required"
+	RuleAdditionalProperties = "additionalProperties"
+	RuleReadOnly             = "readOnly"
+	RulePattern              = "pattern"
+	RuleMinLength            = "minLength"
+	RuleMaxLength            = "maxLength"
+	RuleMinimum              = "minimum"
+	RuleMaximum              = "maximum"
+	RuleMaxBodySize          = "maxBodySize"
+)
+
+// Parse a JSON Schema from its serialized form
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("couldn't decode schema: %q", err)
+	}
+	if err := s.compile(""); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// MustParse parses a JSON Schema, and panics if it is invalid
+func MustParse(data []byte) *Schema {
+	s, err := Parse(data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Load a JSON Schema from the file found at the given path
+func Load(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read schema: %q", err)
+	}
+	return Parse(data)
+}
+
+// compile validates the schema and prepares it for usage
+func (s *Schema) compile(field string) error {
+	for _, t := range s.Type {
+		switch t {
+		case TypeObject, TypeArray, TypeString, TypeNumber, TypeInteger, TypeBoolean, TypeNull:
+		default:
+			return fmt.Errorf("%s: unknown type %q", fieldName(field), t)
+		}
+	}
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("%s: invalid pattern: %q", fieldName(field), err)
+		}
+	}
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("%s: property has no schema", fieldName(joinField(field, name)))
+		}
+		if err := property.compile(joinField(field, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Violation of a single schema rule
+type Violation struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError is the error returned when a value violates one or multiple rules
+type ValidationError struct {
+	Violations []Violation
+}
+
+// Error implements error.Error
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for index, violation := range e.Violations {
+		messages[index] = fmt.Sprintf("%s: %s", fieldName(violation.Field), violation.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate a decoded JSON value against this schema,
+// returning a ValidationError listing all violations in case the value is invalid.
+// Numbers can be given as json.Number or as any of the builtin numerical types.
+func (s *Schema) Validate(value interface{}) error {
+	return s.validate(value, false)
+}
+
+// ValidateInput validates a decoded JSON value, supplied by a client, against this schema.
+// It's identical to Validate, except that read-only properties are not allowed.
+func (s *Schema) ValidateInput(value interface{}) error {
+	return s.validate(value, true)
+}
+
+// validate a value and collect all violations as a single error
+func (s *Schema) validate(value interface{}, input bool) error {
+	var violations []Violation
+	s.validateValue("", value, input, &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: violations}
+}
+
+// validateValue validates a value as the given field against this schema,
+// appending all violations it finds to the given slice
+func (s *Schema) validateValue(field string, value interface{}, input bool, violations *[]Violation) {
+	violate := func(rule, format string, args ...interface{}) {
+		*violations = append(*violations, Violation{
+			Field:   field,
+			Rule:    rule,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		violate(RuleType, "expected %s, got %s",
+			strings.Join(s.Type, " or "), typeOf(value))
+		return // other rules make no sense for a value of the wrong type
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*violations = append(*violations, Violation{
+					Field:   joinField(field, name),
+					Rule:    RuleRequired,
+					Message: "required property is missing",
+				})
+			}
+		}
+		// sort names, so that violations are reported in a stable order
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*violations = append(*violations, Violation{
+						Field:   joinField(field, name),
+						Rule:    RuleAdditionalProperties,
+						Message: "unknown property is not allowed",
+					})
+				}
+				continue
+			}
+			if input && property.ReadOnly {
+				*violations = append(*violations, Violation{
+					Field:   joinField(field, name),
+					Rule:    RuleReadOnly,
+					Message: "read-only property can't be supplied",
+				})
+				continue
+			}
+			property.validateValue(joinField(field, name), v[name], input, violations)
+		}
+
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			violate(RuleMinLength, "has to be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			violate(RuleMaxLength, "can be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			violate(RulePattern, "has to match pattern %q", s.Pattern)
+		}
+
+	default:
+		number, ok := toFloat(value)
+		if !ok {
+			return
+		}
+		if s.Minimum != nil && number < *s.Minimum {
+			violate(RuleMinimum, "has to be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			violate(RuleMaximum, "can be at most %v", *s.Maximum)
+		}
+	}
+}
+
+// matches returns true if the given value is of one of the types
+func (t Types) matches(value interface{}) bool {
+	actual := typeOf(value)
+	for _, expected := range t {
+		if expected == actual ||
+			(expected == TypeNumber && actual == TypeInteger) ||
+			(expected == TypeInteger && actual == TypeNumber && isInteger(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON type of a decoded value
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return TypeNull
+	case bool:
+		return TypeBoolean
+	case string:
+		return TypeString
+	case []interface{}:
+		return TypeArray
+	case map[string]interface{}:
+		return TypeObject
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return TypeInteger
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return TypeInteger
+		}
+		return TypeNumber
+	case float32, float64:
+		return TypeNumber
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// isInteger returns true if the numerical value has no fraction
+func isInteger(value interface{}) bool {
+	number, ok := toFloat(value)
+	return ok && !math.IsInf(number, 0) && number == math.Trunc(number)
+}
+
+// toFloat converts any numerical value to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// joinField joins a parent field and the name of one of its properties
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// fieldName returns a printable name for a field
+func fieldName(field string) string {
+	if field == "" {
+		return "(root)"
+	}
+	return field
+}
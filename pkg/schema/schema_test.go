@@ -0,0 +1,251 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"maxBodySize": 1024,
+	"required": ["name", "count"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "readOnly": true},
+		"name": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[a-z]+$"},
+		"count": {"type": "integer", "minimum": 0, "maximum": 10},
+		"ratio": {"type": "number", "minimum": 0.5},
+		"when": {"type": ["number", "string"]},
+		"nested": {
+			"type": "object",
+			"required": ["flag"],
+			"properties": {
+				"flag": {"type": "boolean"}
+			}
+		}
+	}
+}`
+
+// decode a JSON value the way the collector does, keeping numbers as json.Number
+func decode(t *testing.T, data string) interface{} {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// rules returns the field and rule of each violation, formatted as "field:rule"
+func rules(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	result := make([]string, len(verr.Violations))
+	for index, violation := range verr.Violations {
+		result[index] = violation.Field + ":" + violation.Rule
+	}
+	return result
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		schema string
+		err    string
+	}{
+		{`{"type": "object"}`, ""},
+		{`{"type": ["number", "string"]}`, ""},
+		{`{"type": "object", "properties": {"a": {"pattern": "^a+$"}}}`, ""},
+		{`{"type": 42}`, "type has to be a string or an array of strings"},
+		{`{"type": "float"}`, `(root): unknown type "float"`},
+		{`{"properties": {"a": {"type": ["string", "date"]}}}`, `a: unknown type "date"`},
+		{`{"properties": {"a": {"pattern": "("}}}`, "a: invalid pattern"},
+		{`{"properties": {"a": {"properties": {"b": null}}}}`, "a.b: property has no schema"},
+		{`{"type": "object"`, "couldn't decode schema"},
+	}
+	for _, tc := range testCases {
+		_, err := Parse([]byte(tc.schema))
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.schema, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.schema, tc.err, err)
+		}
+	}
+}
+
+func TestMustParse(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected MustParse to panic for an invalid schema")
+		}
+	}()
+	MustParse([]byte(`{"type": "float"}`))
+}
+
+func TestValidate(t *testing.T) {
+	s := MustParse([]byte(testSchema))
+	testCases := []struct {
+		value    string
+		expected []string
+	}{
+		// valid values
+		{`{"name": "ab", "count": 0}`, nil},
+		{`{"name": "abcd", "count": 10, "ratio": 0.5, "when": "now"}`, nil},
+		{`{"name": "ab", "count": 3, "when": 1500000000}`, nil},
+		{`{"name": "ab", "count": 3, "nested": {"flag": true}}`, nil},
+		{`{"name": "ab", "count": 3.0}`, nil},
+		{`{"name": "ab", "count": 3, "id": "foo"}`, nil},
+		// type
+		{`[]`, []string{":type"}},
+		{`"ab"`, []string{":type"}},
+		{`{"name": 12, "count": "3"}`, []string{"count:type", "name:type"}},
+		{`{"name": "ab", "count": 3.5}`, []string{"count:type"}},
+		{`{"name": "ab", "count": 3, "when": true}`, []string{"when:type"}},
+		{`{"name": "ab", "count": null}`, []string{"count:type"}},
+		// required
+		{`{}`, []string{"name:required", "count:required"}},
+		{`{"name": "ab"}`, []string{"count:required"}},
+		{`{"name": "ab", "count": 3, "nested": {}}`, []string{"nested.flag:required"}},
+		// additionalProperties
+		{`{"name": "ab", "count": 3, "unknown": 1}`, []string{"unknown:additionalProperties"}},
+		{`{"name": "ab", "count": 3, "nested": {"flag": false, "unknown": 1}}`, nil},
+		// pattern, minLength and maxLength
+		{`{"name": "AB", "count": 3}`, []string{"name:pattern"}},
+		{`{"name": "a", "count": 3}`, []string{"name:minLength"}},
+		{`{"name": "", "count": 3}`, []string{"name:minLength", "name:pattern"}},
+		{`{"name": "abcde", "count": 3}`, []string{"name:maxLength"}},
+		{`{"name": "ééé", "count": 3}`, []string{"name:pattern"}},
+		// minimum and maximum
+		{`{"name": "ab", "count": -1}`, []string{"count:minimum"}},
+		{`{"name": "ab", "count": 11}`, []string{"count:maximum"}},
+		{`{"name": "ab", "count": 3, "ratio": 0.25}`, []string{"ratio:minimum"}},
+		// multiple violations are all reported, in a stable order
+		{`{"count": 11, "name": "A", "ratio": 0, "x": 1}`,
+			[]string{"count:maximum", "name:minLength", "name:pattern", "ratio:minimum", "x:additionalProperties"}},
+	}
+	for _, tc := range testCases {
+		got := rules(t, s.Validate(decode(t, tc.value)))
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected violations %v, got %v", tc.value, tc.expected, got)
+		}
+	}
+}
+
+func TestValidateNumericalTypes(t *testing.T) {
+	s := MustParse([]byte(testSchema))
+	for _, count := range []interface{}{int(3), int32(3), int64(3), uint32(3), uint64(3), float64(3)} {
+		if err := s.Validate(map[string]interface{}{"name": "ab", "count": count}); err != nil {
+			t.Errorf("count as %T: unexpected error: %v", count, err)
+		}
+	}
+	got := rules(t, s.Validate(map[string]interface{}{"name": "ab", "count": int64(11)}))
+	if !reflect.DeepEqual(got, []string{"count:maximum"}) {
+		t.Errorf("expected count:maximum violation, got %v", got)
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	s := MustParse([]byte(testSchema))
+	value := decode(t, `{"name": "ab", "count": 3, "id": 42}`)
+
+	// read-only properties are allowed, and validated, when not supplied by a client
+	if got := rules(t, s.Validate(value)); !reflect.DeepEqual(got, []string{"id:type"}) {
+		t.Errorf("Validate: expected id:type violation, got %v", got)
+	}
+	// and not allowed at all when supplied by a client
+	if got := rules(t, s.ValidateInput(value)); !reflect.DeepEqual(got, []string{"id:readOnly"}) {
+		t.Errorf("ValidateInput: expected id:readOnly violation, got %v", got)
+	}
+	if err := s.ValidateInput(decode(t, `{"name": "ab", "count": 3}`)); err != nil {
+		t.Errorf("ValidateInput: unexpected error: %v", err)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	s := MustParse([]byte(testSchema))
+	err := s.Validate(decode(t, `{"name": "a", "x": 1}`))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	expected := []Violation{
+		{Field: "count", Rule: RuleRequired, Message: "required property is missing"},
+		{Field: "name", Rule: RuleMinLength, Message: "has to be at least 2 characters long"},
+		{Field: "x", Rule: RuleAdditionalProperties, Message: "unknown property is not allowed"},
+	}
+	if !reflect.DeepEqual(verr.Violations, expected) {
+		t.Errorf("expected violations %v, got %v", expected, verr.Violations)
+	}
+
+	data, err := json.Marshal(verr.Violations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"field":"count","rule":"required","message":"required property is missing"}` {
+		t.Errorf("unexpected serialized violation: %s", data)
+	}
+
+	message := "count: required property is missing; " +
+		"name: has to be at least 2 characters long; x: unknown property is not allowed"
+	if verr.Error() != message {
+		t.Errorf("expected error %q, got %q", message, verr.Error())
+	}
+	if got := s.Validate(decode(t, `[]`)).Error(); got != "(root): expected object, got array" {
+		t.Errorf("unexpected root error: %q", got)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	if s := MustParse([]byte(testSchema)); s.MaxBodySize != 1024 {
+		t.Errorf("expected max body size 1024, got %d", s.MaxBodySize)
+	}
+	if s := MustParse([]byte(`{"type": "object"}`)); s.MaxBodySize != 0 {
+		t.Errorf("expected no max body size, got %d", s.MaxBodySize)
+	}
+}
+
+func TestLoadEventSchema(t *testing.T) {
+	s, err := Load("../../schema/event.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MaxBodySize <= 0 {
+		t.Errorf("expected a max body size, got %d", s.MaxBodySize)
+	}
+
+	testCases := []struct {
+		value    string
+		expected []string
+	}{
+		{`{"username": "kodingbot", "metric": "kite_call", "count": 12412414}`, nil},
+		{`{"username": "Koding.Bot-1", "metric": "Ab3x", "count": 0, "timestamp": "2017-03-01T12:00:00Z"}`, nil},
+		{`{}`, []string{"username:required", "metric:required", "count:required"}},
+		{`{"username": "", "metric": "kite.call", "count": -1}`,
+			[]string{"count:minimum", "metric:pattern", "username:minLength", "username:pattern"}},
+		{`{"username": "kodingbot", "metric": "kite_call", "count": 1, "tenant": "koding"}`,
+			[]string{"tenant:readOnly"}},
+		{`{"username": "kodingbot", "metric": "kite_call", "count": 1, "extra": true}`,
+			[]string{"extra:additionalProperties"}},
+	}
+	for _, tc := range testCases {
+		got := rules(t, s.ValidateInput(decode(t, tc.value)))
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected violations %v, got %v", tc.value, tc.expected, got)
+		}
+	}
+
+	if _, err = Load("../../schema/missing.json"); err == nil {
+		t.Error("expected an error loading a missing schema file")
+	}
+}
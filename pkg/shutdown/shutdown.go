@@ -0,0 +1,104 @@
+package shutdown
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// Config is used to configure the graceful shutdown
+type Config struct {
+	// maximum amount of time a graceful shutdown is allowed to take
+	Timeout time.Duration
+}
+
+// DefaultConfig creates a shutdown config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{Timeout: time.Second * 30}
+}
+
+// RegisterFlags binds the properties of this config to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&cfg.Timeout, "shutdown-timeout", cfg.Timeout,
+		"maximum time to wait for in-flight work to finish when shutting down")
+}
+
+// Validate the Config properties
+func (cfg *Config) Validate() error {
+	if cfg.Timeout <= 0 {
+		return fmt.Errorf(
+			"%v is an invalid shutdown timeout, should be a positive duration", cfg.Timeout)
+	}
+	return nil
+}
+
+var (
+	signalOnce sync.Once
+	signalled  = make(chan struct{})
+)
+
+// Signal returns a channel that is closed
+// once the process receives SIGINT or SIGTERM
+func Signal() <-chan struct{} {
+	signalOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			log.Infof("received %v, shutting down gracefully", sig)
+			close(signalled)
+		}()
+	})
+	return signalled
+}
+
+// Context returns a context that expires once the shutdown timeout has passed
+func Context(cfg *Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cfg.Timeout)
+}
+
+// ListenAndServe serves HTTP requests using the given server until a shutdown signal is received,
+// after which the server stops accepting new connections and waits for in-flight requests
+// to finish, returning only once they did or once the shutdown timeout has passed.
+// Only an error to listen or serve is returned, requests still in flight once the
+// shutdown timeout has passed are abandoned (and logged), such that the caller can still
+// close everything else.
+func ListenAndServe(server *http.Server, cfg *Config) error {
+	return serve(server, cfg, server.ListenAndServe)
+}
+
+// Serve is like ListenAndServe, serving HTTP requests on a listener that is already opened
+func Serve(server *http.Server, listener net.Listener, cfg *Config) error {
+	return serve(server, cfg, func() error {
+		return server.Serve(listener)
+	})
+}
+
+// serve HTTP requests using the given serve function, until a shutdown signal is received
+func serve(server *http.Server, cfg *Config, serveFn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		<-Signal()
+		ctx, cancel := Context(cfg)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+
+	if err := serveFn(); err != http.ErrServerClosed {
+		return err
+	}
+	if err := <-done; err != nil {
+		log.Warningf("couldn't finish all in-flight requests within %v: %q", cfg.Timeout, err)
+	}
+	return nil
+}
@@ -0,0 +1,616 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// ErrFull is returned when appending a record would exceed the maximum spool size
+var ErrFull = errors.New("spool is full")
+
+// ErrClosed is returned when using a spool after it has been closed
+var ErrClosed = errors.New("spool is closed")
+
+// DefaultConfig creates a spool config with sane defaults
+func DefaultConfig(dir string) *Config {
+	return &Config{
+		Dir:         dir,
+		SegmentSize: 16 << 20,
+		MaxSize:     1 << 30,
+		DrainRate:   1000,
+	}
+}
+
+// Config is used to configure a spool
+type Config struct {
+	// directory the segments are stored in
+	Dir string
+	// size (in bytes) at which a new segment is started
+	SegmentSize int64
+	// maximum size (in bytes) of all records that still have to be drained
+	MaxSize int64
+	// maximum amount of records drained per second
+	DrainRate int
+}
+
+// WithSegmentSize sets the segment size configuration
+// and returns the updated version of itself
+func (cfg *Config) WithSegmentSize(size int64) *Config {
+	cfg.SegmentSize = size
+	return cfg
+}
+
+// WithMaxSize sets the max size configuration
+// and returns the updated version of itself
+func (cfg *Config) WithMaxSize(size int64) *Config {
+	cfg.MaxSize = size
+	return cfg
+}
+
+// WithDrainRate sets the drain rate configuration
+// and returns the updated version of itself
+func (cfg *Config) WithDrainRate(rate int) *Config {
+	cfg.DrainRate = rate
+	return cfg
+}
+
+// validate the Config properties
+func (cfg *Config) validate() error {
+	if cfg.Dir == "" {
+		return errors.New("no spool directory given")
+	}
+	if cfg.SegmentSize < recordHeaderSize+1 {
+		return fmt.Errorf("%d is an invalid SegmentSize, should be at least %d",
+			cfg.SegmentSize, recordHeaderSize+1)
+	}
+	if cfg.MaxSize < cfg.SegmentSize {
+		return fmt.Errorf("%d is an invalid MaxSize, should be at least the SegmentSize",
+			cfg.MaxSize)
+	}
+	if cfg.DrainRate < 1 {
+		return fmt.Errorf("%d is an invalid DrainRate, should be at least 1", cfg.DrainRate)
+	}
+	return nil
+}
+
+// Each record is stored as a fixed size header, followed by the record data.
+// Header: data length (4 bytes), append time in unix nanoseconds (8 bytes),
+// and the CRC-32 checksum of the data (4 bytes), all big endian.
+const recordHeaderSize = 16
+
+// file names used within the spool directory
+const (
+	segmentExtension = ".seg"
+	cursorFileName   = "cursor"
+)
+
+// interval on which the drain cursor is persisted, at the latest
+const cursorSyncInterval = time.Second
+
+// maximum time to wait before retrying to drain a record that failed to drain
+const maxDrainBackoff = time.Second * 30
+
+// Spool is an append-only, segment-based queue of records stored on local disk.
+// Records are appended to the last segment and drained in order from the first segment,
+// segments are removed once they are fully drained.
+// The drain position is persisted regularly, meaning that after a crash,
+// records that were drained right before the crash might be drained again.
+type Spool struct {
+	cfg *Config
+
+	mtx  sync.Mutex
+	cond *sync.Cond
+
+	// segment sequence numbers, ordered from oldest to newest
+	segments []uint64
+	// size (in bytes) of each segment
+	segmentSizes map[uint64]int64
+	// amount of records still to be drained of each segment
+	segmentRecords map[uint64]int64
+	// active segment (last segment) records are appended to
+	writer *os.File
+
+	// drain position: segment (first segment) and offset within it
+	readSegment uint64
+	readOffset  int64
+
+	// stats
+	size         int64 // bytes still to be drained
+	records      int64 // records still to be drained
+	oldest       time.Time
+	drained      uint64
+	skipped      uint64
+	drainedRate  float64
+	rateCount    uint64
+	rateStart    time.Time
+	lastDrainErr string
+
+	closed bool
+}
+
+// Open (or create) a spool in the configured directory,
+// restoring all records that weren't drained yet.
+// NOTE: Always make sure to Close an opened spool!
+func Open(cfg *Config) (*Spool, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("can't open spool as config is invalid: %q", err)
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create spool directory: %q", err)
+	}
+
+	s := &Spool{
+		cfg:            cfg,
+		segmentSizes:   make(map[uint64]int64),
+		segmentRecords: make(map[uint64]int64),
+		rateStart:      time.Now(),
+	}
+	s.cond = sync.NewCond(&s.mtx)
+
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+	if err := s.openWriter(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("opened spool in %s, %d records (%d bytes) still to be drained",
+		cfg.Dir, s.records, s.size)
+	return s, nil
+}
+
+// Append a record to the spool, ErrFull is returned
+// in case the record would make the spool exceed its maximum size
+func (s *Spool) Append(data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	recordSize := int64(recordHeaderSize + len(data))
+	if s.size+recordSize > s.cfg.MaxSize {
+		return ErrFull
+	}
+
+	// start a new segment once the active one is full
+	active := s.segments[len(s.segments)-1]
+	if s.segmentSizes[active] > 0 && s.segmentSizes[active]+recordSize > s.cfg.SegmentSize {
+		if err := s.writer.Close(); err != nil {
+			return fmt.Errorf("couldn't close segment: %q", err)
+		}
+		s.segments = append(s.segments, active+1)
+		s.segmentSizes[active+1] = 0
+		if err := s.openWriter(); err != nil {
+			return err
+		}
+		active++
+	}
+
+	now := time.Now()
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(record[4:12], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint32(record[12:16], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	if _, err := s.writer.Write(record); err != nil {
+		// truncate the partially written record, if any
+		s.writer.Truncate(s.segmentSizes[active])
+		s.writer.Seek(s.segmentSizes[active], io.SeekStart)
+		return fmt.Errorf("couldn't append record: %q", err)
+	}
+
+	s.segmentSizes[active] += recordSize
+	s.segmentRecords[active]++
+	s.size += recordSize
+	s.records++
+	if s.records == 1 {
+		s.oldest = now
+	}
+
+	s.cond.Broadcast() // wake up the drainer
+	return nil
+}
+
+// Pending returns the amount of records that still have to be drained
+func (s *Spool) Pending() int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.records
+}
+
+// Drain all records in order, passing them one by one to the given callback,
+// blocking until the spool is closed. Records are only removed from the spool
+// once the callback succeeds, a failing callback is retried using an exponential backoff.
+// Only a single drainer can be active for a spool.
+func (s *Spool) Drain(fn func(data []byte) error) {
+	log.Infof("draining spool %s at a maximum rate of %d records per second",
+		s.cfg.Dir, s.cfg.DrainRate)
+
+	interval := time.Second / time.Duration(s.cfg.DrainRate)
+	lastSync := time.Now()
+
+	var reader *os.File
+	var readerSegment uint64
+	defer func() {
+		if reader != nil {
+			reader.Close()
+		}
+	}()
+
+	for {
+		data, next, err := s.next(&reader, &readerSegment)
+		if err == ErrClosed {
+			return
+		}
+		if err != nil {
+			log.Warningf("couldn't read spool record: %q", err)
+			s.setDrainError(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		backoff := interval
+		for {
+			if err = fn(data); err == nil {
+				break
+			}
+			s.setDrainError(err)
+			if s.isClosed() {
+				return
+			}
+			if backoff *= 2; backoff > maxDrainBackoff {
+				backoff = maxDrainBackoff
+			}
+			log.Warningf("couldn't drain spool record, retrying in %v: %q", backoff, err)
+			time.Sleep(backoff)
+		}
+
+		s.advance(next)
+		if time.Since(lastSync) >= cursorSyncInterval {
+			if err = s.syncCursor(); err != nil {
+				log.Warningf("couldn't persist spool cursor: %q", err)
+			}
+			lastSync = time.Now()
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// String returns the spool metrics as a valid JSON Object,
+// implementing the expvar.Var interface
+func (s *Spool) String() string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var oldestAge float64
+	if s.records > 0 {
+		oldestAge = time.Since(s.oldest).Seconds()
+	}
+
+	return fmt.Sprintf(`{"size": %d, "maxSize": %d, "segments": %d, "records": %d, `+
+		`"oldestAge": %f, "drained": %d, "skipped": %d, "drainRate": %f, "maxDrainRate": %d, "lastDrainError": %s}`,
+		s.size, s.cfg.MaxSize, len(s.segments), s.records,
+		oldestAge, s.drained, s.skipped, s.drainedRate, s.cfg.DrainRate,
+		strconv.Quote(s.lastDrainErr))
+}
+
+// Close the spool, persisting the drain position,
+// and stopping any active drainer once it finished its current record
+func (s *Spool) Close() error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	err := s.writer.Close()
+	s.mtx.Unlock()
+
+	if syncErr := s.syncCursor(); syncErr != nil {
+		return syncErr
+	}
+	return err
+}
+
+// next reads the next record to drain, blocking until one is available.
+// The reader is (re)opened as required and the position of the next record is returned.
+// The rest of a segment is skipped once a record within it can't be read (see skipSegment).
+func (s *Spool) next(reader **os.File, readerSegment *uint64) ([]byte, int64, error) {
+	s.mtx.Lock()
+	for {
+		if s.closed {
+			s.mtx.Unlock()
+			return nil, 0, ErrClosed
+		}
+		// fully drained segments are removed, as long as they aren't the active segment
+		if s.readOffset >= s.segmentSizes[s.readSegment] && len(s.segments) > 1 {
+			s.removeFirstSegment()
+			continue
+		}
+		if s.readOffset < s.segmentSizes[s.readSegment] {
+			break
+		}
+		s.cond.Wait()
+	}
+	segment, offset := s.readSegment, s.readOffset
+	s.mtx.Unlock()
+
+	if *reader == nil || *readerSegment != segment {
+		if *reader != nil {
+			(*reader).Close()
+		}
+		file, err := os.Open(s.segmentPath(segment))
+		if err != nil {
+			*reader = nil
+			return nil, 0, err
+		}
+		*reader, *readerSegment = file, segment
+	}
+
+	data, err := s.readRecord(*reader, offset)
+	if err != nil {
+		s.skipSegment(segment, offset, err)
+		return s.next(reader, readerSegment)
+	}
+	return data, offset + int64(recordHeaderSize+len(data)), nil
+}
+
+// skipSegment skips the rest of a segment, starting at the record found at the given offset,
+// which can't be read (e.g. because it is corrupt). As the records following it can't be found either,
+// they're skipped as well, as would be the case when the spool is restored (see scanSegment).
+func (s *Spool) skipSegment(segment uint64, offset int64, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	skipped := s.segmentRecords[segment]
+	log.Warningf("skipping %d records of segment %d from offset %d: %q", skipped, segment, offset, err)
+	s.lastDrainErr = err.Error()
+
+	s.size -= s.segmentSizes[segment] - offset
+	s.records -= skipped
+	s.segmentRecords[segment] = 0
+	s.readOffset = s.segmentSizes[segment]
+	s.skipped += uint64(skipped)
+	s.updateOldest()
+}
+
+// advance the drain position to the given offset within the current segment
+func (s *Spool) advance(next int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.size -= next - s.readOffset
+	s.records--
+	s.segmentRecords[s.readSegment]--
+	s.readOffset = next
+	s.drained++
+
+	// measure the drain rate over (roughly) every second
+	s.rateCount++
+	if elapsed := time.Since(s.rateStart); elapsed >= time.Second {
+		s.drainedRate = float64(s.rateCount) / elapsed.Seconds()
+		s.rateCount = 0
+		s.rateStart = time.Now()
+	}
+
+	s.updateOldest()
+}
+
+// updateOldest updates the append time of the oldest record still to be drained
+func (s *Spool) updateOldest() {
+	if s.records == 0 {
+		return
+	}
+	offset := s.readOffset
+	segment := s.readSegment
+	if offset >= s.segmentSizes[segment] && len(s.segments) > 1 {
+		segment, offset = s.segments[1], 0
+	}
+	file, err := os.Open(s.segmentPath(segment))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var header [recordHeaderSize]byte
+	if _, err = file.ReadAt(header[:], offset); err == nil {
+		s.oldest = time.Unix(0, int64(binary.BigEndian.Uint64(header[4:12])))
+	}
+}
+
+// removeFirstSegment removes the first (fully drained) segment
+func (s *Spool) removeFirstSegment() {
+	segment := s.segments[0]
+	if err := os.Remove(s.segmentPath(segment)); err != nil {
+		log.Warningf("couldn't remove drained segment %d: %q", segment, err)
+	}
+	delete(s.segmentSizes, segment)
+	delete(s.segmentRecords, segment)
+	s.segments = s.segments[1:]
+	s.readSegment, s.readOffset = s.segments[0], 0
+}
+
+// syncCursor persists the current drain position,
+// by atomically replacing the cursor file
+func (s *Spool) syncCursor() error {
+	s.mtx.Lock()
+	cursor := fmt.Sprintf("%d %d\n", s.readSegment, s.readOffset)
+	s.mtx.Unlock()
+
+	tmp := filepath.Join(s.cfg.Dir, cursorFileName+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(cursor), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.cfg.Dir, cursorFileName))
+}
+
+// restore the segments and drain position found in the spool directory
+func (s *Spool) restore() error {
+	files, err := ioutil.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("couldn't read spool directory: %q", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			log.Warningf("ignoring unknown file %q in spool directory", name)
+			continue
+		}
+		s.segments = append(s.segments, segment)
+	}
+	sort.Sort(segmentList(s.segments))
+	if len(s.segments) == 0 {
+		s.segments = []uint64{1}
+	}
+	s.readSegment = s.segments[0]
+
+	// restore drain position, if it's still within the available segments
+	if raw, err := ioutil.ReadFile(filepath.Join(s.cfg.Dir, cursorFileName)); err == nil {
+		var segment uint64
+		var offset int64
+		if _, err = fmt.Sscanf(string(raw), "%d %d", &segment, &offset); err != nil {
+			log.Warningf("ignoring invalid spool cursor: %q", err)
+		} else {
+			for len(s.segments) > 1 && s.segments[0] < segment {
+				os.Remove(s.segmentPath(s.segments[0]))
+				s.segments = s.segments[1:]
+			}
+			if s.segments[0] == segment {
+				s.readSegment, s.readOffset = segment, offset
+			} else {
+				s.readSegment = s.segments[0]
+			}
+		}
+	}
+
+	// scan all segments, to restore the stats
+	// and truncate records that were only partially written prior to a crash
+	for _, segment := range s.segments {
+		size, err := s.scanSegment(segment)
+		if err != nil {
+			return err
+		}
+		s.segmentSizes[segment] = size
+	}
+	if s.readOffset > s.segmentSizes[s.readSegment] {
+		s.readOffset = s.segmentSizes[s.readSegment]
+	}
+	s.updateOldest()
+	return nil
+}
+
+// scanSegment counts the records of a segment still to be drained,
+// returning the size of all valid records within the segment
+func (s *Spool) scanSegment(segment uint64) (int64, error) {
+	file, err := os.OpenFile(s.segmentPath(segment), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't open segment %d: %q", segment, err)
+	}
+	defer file.Close()
+
+	var offset int64
+	for {
+		data, err := s.readRecord(file, offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warningf("truncating segment %d at offset %d: %q", segment, offset, err)
+			if err = file.Truncate(offset); err != nil {
+				return 0, fmt.Errorf("couldn't truncate segment %d: %q", segment, err)
+			}
+			break
+		}
+		size := int64(recordHeaderSize + len(data))
+		if segment != s.readSegment || offset >= s.readOffset {
+			s.size += size
+			s.records++
+			s.segmentRecords[segment]++
+		}
+		offset += size
+	}
+	return offset, nil
+}
+
+// openWriter opens the active (last) segment for appending
+func (s *Spool) openWriter() error {
+	active := s.segments[len(s.segments)-1]
+	file, err := os.OpenFile(s.segmentPath(active), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open segment %d: %q", active, err)
+	}
+	s.writer = file
+	return nil
+}
+
+func (s *Spool) segmentPath(segment uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", segment, segmentExtension))
+}
+
+func (s *Spool) setDrainError(err error) {
+	s.mtx.Lock()
+	s.lastDrainErr = err.Error()
+	s.mtx.Unlock()
+}
+
+func (s *Spool) isClosed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closed
+}
+
+// readRecord reads the data of the record found at the given offset,
+// io.EOF is returned in case no record is found at the given offset
+func (s *Spool) readRecord(file *os.File, offset int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	n, err := file.ReadAt(header[:], offset)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, fmt.Errorf("incomplete record header: %q", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[12:16])
+	if int64(length) > s.cfg.MaxSize {
+		return nil, fmt.Errorf("record length %d exceeds the maximum spool size", length)
+	}
+
+	data := make([]byte, length)
+	if n, err = file.ReadAt(data, offset+recordHeaderSize); n < len(data) {
+		return nil, fmt.Errorf("incomplete record: %q", err)
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return data, nil
+}
+
+// segmentList sorts segment sequence numbers from oldest to newest
+type segmentList []uint64
+
+func (l segmentList) Len() int           { return len(l) }
+func (l segmentList) Less(i, j int) bool { return l[i] < l[j] }
+func (l segmentList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,242 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// records of 20 bytes (header included), 2 records per segment:
+// segment 1 holds rec1 and rec2, segment 2 rec3 and rec4, segment 3 rec5
+var testRecords = []string{"rec1", "rec2", "rec3", "rec4", "rec5"}
+
+func testConfig(dir string) *Config {
+	return DefaultConfig(dir).
+		WithSegmentSize(2 * (recordHeaderSize + 4)).
+		WithMaxSize(1 << 20).
+		WithDrainRate(1000)
+}
+
+// writeTestSpool creates a spool in a new temporary directory, containing all test records
+func writeTestSpool(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range testRecords {
+		if err = s.Append([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func segmentFile(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", segment, segmentExtension))
+}
+
+func writeCursor(t *testing.T, dir, cursor string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, cursorFileName), []byte(cursor), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drainAll drains the given amount of records from an opened spool
+func drainAll(t *testing.T, s *Spool, count int) []string {
+	records := make(chan string, count)
+	go s.Drain(func(data []byte) error {
+		records <- string(data)
+		return nil
+	})
+
+	var drained []string
+	for len(drained) < count {
+		select {
+		case record := <-records:
+			drained = append(drained, record)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("only drained %v, expected %d records", drained, count)
+		}
+	}
+	return drained
+}
+
+func TestRestore(t *testing.T) {
+	testCases := []struct {
+		name     string
+		prepare  func(t *testing.T, dir string)
+		expected []string
+	}{
+		{"clean", func(*testing.T, string) {}, testRecords},
+		{"cursor within segment", func(t *testing.T, dir string) {
+			writeCursor(t, dir, "1 20\n")
+		}, testRecords[1:]},
+		{"cursor at end of segment", func(t *testing.T, dir string) {
+			writeCursor(t, dir, "1 40\n")
+		}, testRecords[2:]},
+		{"cursor within later segment", func(t *testing.T, dir string) {
+			writeCursor(t, dir, "2 20\n")
+		}, testRecords[3:]},
+		{"cursor beyond segment", func(t *testing.T, dir string) {
+			writeCursor(t, dir, "1 1000\n")
+		}, testRecords[2:]},
+		{"invalid cursor", func(t *testing.T, dir string) {
+			writeCursor(t, dir, "garbage\n")
+		}, testRecords},
+		{"partial record", func(t *testing.T, dir string) {
+			file, err := os.OpenFile(segmentFile(dir, 3), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			// a crash while appending rec6, only part of its header was written
+			file.Write([]byte{0, 0, 0, 4, 1, 2})
+		}, testRecords},
+		{"corrupt record", func(t *testing.T, dir string) {
+			file, err := os.OpenFile(segmentFile(dir, 2), os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			// corrupt the data of rec4, truncating segment 2 prior to it
+			file.WriteAt([]byte("x"), 20+recordHeaderSize)
+		}, []string{"rec1", "rec2", "rec3", "rec5"}},
+	}
+
+	for _, tc := range testCases {
+		dir := writeTestSpool(t)
+		tc.prepare(t, dir)
+
+		s, err := Open(testConfig(dir))
+		if err != nil {
+			t.Errorf("%s: couldn't open spool: %v", tc.name, err)
+			os.RemoveAll(dir)
+			continue
+		}
+		if pending := s.Pending(); pending != int64(len(tc.expected)) {
+			t.Errorf("%s: expected %d pending records, got %d", tc.name, len(tc.expected), pending)
+		}
+		// records appended after restoring follow the restored ones
+		if err = s.Append([]byte("rec6")); err != nil {
+			t.Errorf("%s: couldn't append record: %v", tc.name, err)
+		}
+		expected := append(append([]string{}, tc.expected...), "rec6")
+		drained := drainAll(t, s, len(expected))
+		s.Close()
+
+		if fmt.Sprint(drained) != fmt.Sprint(expected) {
+			t.Errorf("%s: expected to drain %v, got %v", tc.name, expected, drained)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReopenAfterDrain(t *testing.T) {
+	dir := writeTestSpool(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(testConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainAll(t, s, 3)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the persisted cursor ensures drained records aren't drained again
+	if s, err = Open(testConfig(dir)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if pending := s.Pending(); pending != 2 {
+		t.Errorf("expected 2 pending records, got %d", pending)
+	}
+	if _, err = os.Stat(segmentFile(dir, 1)); !os.IsNotExist(err) {
+		t.Errorf("expected the drained segment to be removed, got %v", err)
+	}
+}
+
+func TestAppendFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(testConfig(dir).WithMaxSize(3 * (recordHeaderSize + 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i, record := range testRecords[:3] {
+		if err = s.Append([]byte(record)); err != nil {
+			t.Fatalf("couldn't append record %d: %v", i, err)
+		}
+	}
+	if err = s.Append([]byte("rec4")); err != ErrFull {
+		t.Errorf("expected %v, got %v", ErrFull, err)
+	}
+}
+
+func TestDrainCorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 3 records per segment: segment 1 holds rec1 up to rec3, segment 2 rec4 and rec5
+	s, err := Open(testConfig(dir).WithSegmentSize(3 * (recordHeaderSize + 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, record := range testRecords {
+		if err = s.Append([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// corrupt the data of rec2, in the middle of segment 1, while the spool is open
+	file, err := os.OpenFile(segmentFile(dir, 1), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("x"), 20+recordHeaderSize)
+	file.Close()
+
+	// the rest of segment 1 is skipped, records of later segments (and appended ones) are still drained
+	if err = s.Append([]byte("rec6")); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"rec1", "rec4", "rec5", "rec6"}
+	if drained := drainAll(t, s, len(expected)); fmt.Sprint(drained) != fmt.Sprint(expected) {
+		t.Errorf("expected to drain %v, got %v", expected, drained)
+	}
+
+	// the last record is only removed once drained
+	deadline := time.Now().Add(time.Second * 5)
+	for s.Pending() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if pending := s.Pending(); pending != 0 {
+		t.Errorf("expected no pending records, got %d", pending)
+	}
+	s.mtx.Lock()
+	size, skipped := s.size, s.skipped
+	s.mtx.Unlock()
+	if size != 0 || skipped != 2 {
+		t.Errorf("expected 2 skipped records and no size left, got %d skipped records and %d bytes", skipped, size)
+	}
+}
@@ -0,0 +1,408 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/glendc/data-ingestion-challenge/pkg/log"
+)
+
+// Config is used to configure the exporters of finished spans
+type Config struct {
+	// file to which spans are appended, not exported to a file if empty
+	File string
+	// OTLP/HTTP endpoint to which spans are exported, not exported to a collector if empty
+	OTLPEndpoint string
+	// name of the service, as reported with each exported span
+	Service string
+	// amount of finished spans that can wait to be exported
+	BufferSize int
+}
+
+// DefaultConfig creates a trace config with sane defaults,
+// which are also the defaults of its flags
+func DefaultConfig() *Config {
+	return &Config{
+		Service:    filepath.Base(os.Args[0]),
+		BufferSize: 4096,
+	}
+}
+
+// RegisterFlags binds the properties of this config to flags of the given flag set
+func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.File, "trace-file", cfg.File,
+		"file to which finished spans are appended, as JSON lines (not exported to a file if not given)")
+	fs.StringVar(&cfg.OTLPEndpoint, "trace-otlp-endpoint", cfg.OTLPEndpoint,
+		"OTLP/HTTP endpoint to which finished spans are exported, e.g. http://localhost:4318/v1/traces "+
+			"(not exported to a collector if not given)")
+	fs.StringVar(&cfg.Service, "trace-service", cfg.Service,
+		"name of the service, as reported with each exported span")
+	fs.IntVar(&cfg.BufferSize, "trace-buffer", cfg.BufferSize,
+		"amount of finished spans that can wait to be exported, spans are dropped once it is full")
+}
+
+// Validate the Config properties
+func (cfg *Config) Validate() error {
+	if cfg.BufferSize < 1 {
+		return fmt.Errorf("%d is an invalid trace buffer size, should be at least 1", cfg.BufferSize)
+	}
+	return nil
+}
+
+// Export constants
+const (
+	// maximum amount of spans written at once
+	exportBatchSize = 512
+	// maximum time a finished span waits to be exported
+	exportInterval = time.Second
+	// maximum time a single OTLP export request can take
+	otlpTimeout = time.Second * 5
+)
+
+// exporter exports finished spans in the background,
+// to a file and/or an OTLP collector
+var exporter struct {
+	mtx     sync.RWMutex
+	spans   chan *Span // nil if exporting is disabled or closed
+	done    chan struct{}
+	writers []spanWriter
+}
+
+// spanWriter writes a batch of finished spans to a destination
+type spanWriter interface {
+	write(spans []*Span) error
+	close() error
+}
+
+// exportMetrics counts the exported spans, published as the "trace" expvar
+type exportMetrics struct {
+	exported int64
+	dropped  int64
+	failed   int64
+}
+
+var metrics = new(exportMetrics)
+
+// String returns the export metrics as a JSON object,
+// implementing the expvar.Var interface
+func (m *exportMetrics) String() string {
+	return fmt.Sprintf(`{"exported":%d,"dropped":%d,"failed":%d}`,
+		atomic.LoadInt64(&m.exported), atomic.LoadInt64(&m.dropped), atomic.LoadInt64(&m.failed))
+}
+
+// Open the exporter(s) configured using the given config, should be called once its flags are parsed.
+// Spans are still propagated when no exporter is configured, they're just not exported.
+// NOTE: Always make sure to Close the exporter, such that all finished spans are exported!
+func Open(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var writers []spanWriter
+	if cfg.File != "" {
+		w, err := newFileWriter(cfg.File, cfg.Service)
+		if err != nil {
+			return err
+		}
+		writers = append(writers, w)
+	}
+	if cfg.OTLPEndpoint != "" {
+		writers = append(writers, newOTLPWriter(cfg.OTLPEndpoint, cfg.Service))
+	}
+	if len(writers) == 0 {
+		log.Infof("no trace file or OTLP endpoint given, spans won't be exported")
+		return nil
+	}
+
+	exporter.mtx.Lock()
+	defer exporter.mtx.Unlock()
+	exporter.spans = make(chan *Span, cfg.BufferSize)
+	exporter.done = make(chan struct{})
+	exporter.writers = writers
+	go exportLoop(exporter.spans, exporter.done, writers)
+	return nil
+}
+
+// Close the exporter, waiting until all finished spans are exported
+func Close() error {
+	exporter.mtx.Lock()
+	spans, done := exporter.spans, exporter.done
+	exporter.spans = nil
+	exporter.mtx.Unlock()
+	if spans == nil {
+		return nil
+	}
+
+	close(spans)
+	<-done
+
+	var err error
+	for _, w := range exporter.writers {
+		if cerr := w.close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// export a finished span, dropping it in case the buffer is full,
+// such that tracing never blocks the traced operation
+func export(s *Span) {
+	exporter.mtx.RLock()
+	defer exporter.mtx.RUnlock()
+	if exporter.spans == nil {
+		return
+	}
+	select {
+	case exporter.spans <- s:
+	default:
+		atomic.AddInt64(&metrics.dropped, 1)
+	}
+}
+
+// exportLoop writes finished spans in batches, until the given channel is closed
+func exportLoop(spans <-chan *Span, done chan<- struct{}, writers []spanWriter) {
+	defer close(done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, w := range writers {
+			if err := w.write(batch); err != nil {
+				atomic.AddInt64(&metrics.failed, int64(len(batch)))
+				log.Warningf("couldn't export %d spans: %q", len(batch), err)
+				continue
+			}
+			atomic.AddInt64(&metrics.exported, int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s, ok := <-spans:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// jsonSpan is the format in which spans are written to a file, one per line
+type jsonSpan struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Service      string                 `json:"service"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	Duration     float64                `json:"duration"` // in seconds
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// fileWriter appends spans to a file, as JSON lines
+type fileWriter struct {
+	file    *os.File
+	service string
+}
+
+func newFileWriter(path, service string) (*fileWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create trace directory: %q", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open trace file: %q", err)
+	}
+	return &fileWriter{file: file, service: service}, nil
+}
+
+func (w *fileWriter) write(spans []*Span) error {
+	buf := bufio.NewWriter(w.file)
+	encoder := json.NewEncoder(buf)
+	for _, s := range spans {
+		span := jsonSpan{
+			TraceID:  s.context.TraceIDString(),
+			SpanID:   s.context.SpanIDString(),
+			Name:     s.name,
+			Service:  w.service,
+			Start:    s.start.UTC(),
+			End:      s.end.UTC(),
+			Duration: s.end.Sub(s.start).Seconds(),
+			Error:    s.err,
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.SpanIDString()
+		}
+		if len(s.attributes) > 0 {
+			span.Attributes = make(map[string]interface{}, len(s.attributes))
+			for _, attr := range s.attributes {
+				span.Attributes[attr.key] = attr.value
+			}
+		}
+		if err := encoder.Encode(&span); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+func (w *fileWriter) close() error {
+	return w.file.Close()
+}
+
+// otlpWriter exports spans to an OTLP collector, using OTLP/HTTP with JSON encoding
+// More information: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type otlpWriter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func newOTLPWriter(endpoint, service string) *otlpWriter {
+	return &otlpWriter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: otlpTimeout},
+	}
+}
+
+// OTLP JSON structures, only containing the fields we use
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 1 = ok, 2 = error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpValue returns the OTLP any value of an attribute
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+}
+
+func (w *otlpWriter) write(spans []*Span) error {
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/glendc/data-ingestion-challenge/pkg/trace"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.context.TraceIDString(),
+			SpanID:            s.context.SpanIDString(),
+			Name:              s.name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parent.IsValid() {
+			span.ParentSpanID = s.parent.SpanIDString()
+		}
+		for _, attr := range s.attributes {
+			span.Attributes = append(span.Attributes,
+				otlpAttribute{Key: attr.key, Value: otlpValue(attr.value)})
+		}
+		if s.err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	body, err := json.Marshal(&otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: "service.name", Value: otlpValue(w.service)},
+			}},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body) // ensure the connection can be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *otlpWriter) close() error {
+	return nil
+}
+
+func init() {
+	expvar.Publish("trace", metrics)
+}
@@ -0,0 +1,209 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Header is the (W3C Trace Context) header used to propagate a trace,
+// both as HTTP header and as AMQP message header
+// More information: https://www.w3.org/TR/trace-context/
+const Header = "traceparent"
+
+// SpanContext identifies a span within a trace,
+// it is what is propagated between processes
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns true if both the trace and span ID are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceIDString returns the hex encoded trace ID
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// SpanIDString returns the hex encoded span ID
+func (sc SpanContext) SpanIDString() string {
+	return hex.EncodeToString(sc.SpanID[:])
+}
+
+// Traceparent formats the span context as a traceparent header value,
+// e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceIDString() + "-" + sc.SpanIDString() + "-" + flags
+}
+
+// ErrInvalidTraceparent is returned when parsing an invalid traceparent header value
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+// ParseTraceparent parses a traceparent header value,
+// fields appended by future versions are ignored
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) {
+		return sc, ErrInvalidTraceparent
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, ErrInvalidTraceparent
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, ErrInvalidTraceparent
+	}
+	// all fields are lowercase hex, as decoding them also accepts uppercase hex
+	for _, part := range parts[:4] {
+		if strings.ToLower(part) != part {
+			return sc, ErrInvalidTraceparent
+		}
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, ErrInvalidTraceparent
+	}
+	if !sc.IsValid() {
+		return sc, ErrInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	return sc, nil
+}
+
+// contextKey is the key used to store the current span context in a context
+type contextKey struct{}
+
+// ContextWith returns a context carrying the given span context,
+// as the parent of spans started using that context
+func ContextWith(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by the given context, if any
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Extract a (remote) parent span context from a traceparent header value,
+// returning the given context as is in case the value is empty or invalid
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return ContextWith(ctx, sc)
+}
+
+// Inject returns the traceparent header value of the span carried by the given context,
+// empty in case the context carries no span
+func Inject(ctx context.Context) string {
+	sc, ok := FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// Span is a single timed operation within a trace,
+// exported once it is finished. A span is not goroutine-safe.
+type Span struct {
+	name       string
+	context    SpanContext
+	parent     SpanContext // zero in case it is the root of its trace
+	start      time.Time
+	end        time.Time
+	attributes []attribute
+	err        string
+}
+
+// attribute is a key/value pair describing a span
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Start a span as a child of the span carried by the given context,
+// or as the root of a new (sampled) trace in case it carries no span,
+// returning a context carrying the started span
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{name: name, start: time.Now()}
+	if parent, ok := FromContext(ctx); ok {
+		span.parent = parent
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+	} else {
+		randomID(span.context.TraceID[:])
+		span.context.Sampled = true
+	}
+	randomID(span.context.SpanID[:])
+	return ContextWith(ctx, span.context), span
+}
+
+// Context returns the span context identifying this span
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// SetAttribute sets an attribute describing this span (e.g. the ID of the processed event)
+func (s *Span) SetAttribute(key string, value interface{}) {
+	for index := range s.attributes {
+		if s.attributes[index].key == key {
+			s.attributes[index].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// Finish the span, marking it as failed in case the given error isn't nil,
+// after which it is exported (if sampled). Finishing a span more than once has no effect.
+func (s *Span) Finish(err error) {
+	if !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	if s.context.Sampled {
+		export(s)
+	}
+}
+
+// randomID fills the given ID with random bytes, ensuring it isn't all zeros (invalid)
+func randomID(id []byte) {
+	for {
+		if _, err := rand.Read(id); err != nil {
+			panic(fmt.Sprintf("couldn't generate random trace ID: %q", err))
+		}
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package trace
+
+import (
+	"context"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{"00-" + testTraceID + "-" + testSpanID + "-01", true, true},
+		{"00-" + testTraceID + "-" + testSpanID + "-00", true, false},
+		{"00-" + testTraceID + "-" + testSpanID + "-03", true, true},
+		{"  00-" + testTraceID + "-" + testSpanID + "-01 ", true, true},
+		// fields appended by future versions are ignored
+		{"01-" + testTraceID + "-" + testSpanID + "-01-future", true, true},
+		{"00-" + testTraceID + "-" + testSpanID + "-01-future", false, false},
+		{"ff-" + testTraceID + "-" + testSpanID + "-01", false, false},
+		{"0g-" + testTraceID + "-" + testSpanID + "-01", false, false},
+		{"000-" + testTraceID + "-" + testSpanID + "-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01", false, false},
+		{"00-" + testTraceID + "-00F067AA0BA902B7-01", false, false},
+		{"00-00000000000000000000000000000000-" + testSpanID + "-01", false, false},
+		{"00-" + testTraceID + "-0000000000000000-01", false, false},
+		{"00-" + testTraceID[1:] + "-" + testSpanID + "-01", false, false},
+		{"00-" + testTraceID + "-" + testSpanID[1:] + "-01", false, false},
+		{"00-" + testTraceID + "-" + testSpanID + "-1", false, false},
+		{"00-" + testTraceID + "-" + testSpanID + "-zz", false, false},
+		{"00-" + testTraceID[:31] + "x-" + testSpanID + "-01", false, false},
+		{"00-" + testTraceID + "-" + testSpanID, false, false},
+		{"", false, false},
+	}
+
+	for _, tc := range testCases {
+		sc, err := ParseTraceparent(tc.value)
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("%q: expected valid=%v, got %v", tc.value, tc.valid, err)
+			continue
+		}
+		if !tc.valid {
+			continue
+		}
+		if sc.TraceIDString() != testTraceID || sc.SpanIDString() != testSpanID {
+			t.Errorf("%q: expected trace %s and span %s, got %s and %s", tc.value,
+				testTraceID, testSpanID, sc.TraceIDString(), sc.SpanIDString())
+		}
+		if sc.Sampled != tc.sampled {
+			t.Errorf("%q: expected sampled=%v, got %v", tc.value, tc.sampled, sc.Sampled)
+		}
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, value := range []string{
+		"00-" + testTraceID + "-" + testSpanID + "-01",
+		"00-" + testTraceID + "-" + testSpanID + "-00",
+	} {
+		sc, err := ParseTraceparent(value)
+		if err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if formatted := sc.Traceparent(); formatted != value {
+			t.Errorf("expected %q, got %q", value, formatted)
+		}
+	}
+}
+
+func TestExtractInject(t *testing.T) {
+	value := "00-" + testTraceID + "-" + testSpanID + "-01"
+	testCases := []struct {
+		traceparent string
+		expected    string
+	}{
+		{value, value},
+		{"", ""},
+		{"invalid", ""},
+	}
+	for _, tc := range testCases {
+		if injected := Inject(Extract(context.Background(), tc.traceparent)); injected != tc.expected {
+			t.Errorf("%q: expected %q to be injected, got %q", tc.traceparent, tc.expected, injected)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	// a span started without a parent starts a new sampled trace
+	ctx, root := Start(context.Background(), "root")
+	defer root.Finish(nil)
+	if !root.Context().IsValid() || !root.Context().Sampled {
+		t.Errorf("expected a valid sampled root span, got %+v", root.Context())
+	}
+
+	// a child continues the trace of its parent, using its own span ID
+	_, child := Start(ctx, "child")
+	defer child.Finish(nil)
+	if child.Context().TraceID != root.Context().TraceID {
+		t.Error("expected the child to continue the trace of its parent")
+	}
+	if child.Context().SpanID == root.Context().SpanID {
+		t.Error("expected the child to have its own span ID")
+	}
+	if child.parent != root.Context() {
+		t.Error("expected the root span to be the parent of the child")
+	}
+
+	// the sampling decision of a remote parent is respected
+	remote := Extract(context.Background(), "00-"+testTraceID+"-"+testSpanID+"-00")
+	_, span := Start(remote, "remote")
+	defer span.Finish(nil)
+	if span.Context().Sampled || span.Context().TraceIDString() != testTraceID {
+		t.Errorf("expected an unsampled span continuing the remote trace, got %+v", span.Context())
+	}
+}